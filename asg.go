@@ -1,6 +1,7 @@
 package awsecs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,13 +11,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/cenkalti/backoff"
-	"log"
 	"strings"
 	"sync"
 )
 
-func listASGInstances(ASAPI autoscalingiface.AutoScalingAPI, asgName string) ([]*autoscaling.Instance, *string, error) {
-	output, err := ASAPI.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+func listASGInstances(ctx context.Context, ASAPI autoscalingiface.AutoScalingAPI, asgName string) ([]*autoscaling.Instance, *string, error) {
+	output, err := ASAPI.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []*string{aws.String(asgName)},
 	})
 	if err != nil {
@@ -27,7 +27,7 @@ func listASGInstances(ASAPI autoscalingiface.AutoScalingAPI, asgName string) ([]
 		return autoScalingGroup.Instances, autoScalingGroup.LaunchConfigurationName, nil
 	}
 
-	return []*autoscaling.Instance{}, nil, errors.New("asg not found")
+	return []*autoscaling.Instance{}, nil, fmt.Errorf("%w: %s", ErrASGNotFound, asgName)
 }
 
 func needReplacement(expectedLaunchConfig string, instance autoscaling.Instance) bool {
@@ -72,10 +72,11 @@ func containerInstanceArnToContainerInstanceID(input string) (output string) {
 	return
 }
 
-func instancesToContainerInstances(ECSAPI ecs.ECS, instances []autoscaling.Instance, clusterName string) ([]ecsEC2Instance, error) {
+func instancesToContainerInstances(ctx context.Context, ECSAPI ecs.ECS, instances []autoscaling.Instance, clusterName string) ([]ecsEC2Instance, error) {
 	var ecsEC2Instances []ecsEC2Instance
 	var describeContainerInstancesInputs []*ecs.DescribeContainerInstancesInput
-	err := ECSAPI.ListContainerInstancesPages(
+	err := ECSAPI.ListContainerInstancesPagesWithContext(
+		ctx,
 		&ecs.ListContainerInstancesInput{Cluster: aws.String(clusterName)},
 		func(page *ecs.ListContainerInstancesOutput, lastPage bool) bool {
 			describeContainerInstancesInputs = append(describeContainerInstancesInputs, &ecs.DescribeContainerInstancesInput{
@@ -88,7 +89,7 @@ func instancesToContainerInstances(ECSAPI ecs.ECS, instances []autoscaling.Insta
 		return []ecsEC2Instance{}, fmt.Errorf("on instances to container instances map while paginating container instances: %w", err)
 	}
 	for _, input := range describeContainerInstancesInputs {
-		output, err := ECSAPI.DescribeContainerInstances(input)
+		output, err := ECSAPI.DescribeContainerInstancesWithContext(ctx, input)
 		if err != nil {
 			return []ecsEC2Instance{}, fmt.Errorf("on instances to container instances map while describe container instances: %w", err)
 		}
@@ -108,63 +109,82 @@ func instancesToContainerInstances(ECSAPI ecs.ECS, instances []autoscaling.Insta
 	return ecsEC2Instances, nil
 }
 
-func detachAndDrain(ASAPI autoscaling.AutoScaling, ECSAPI ecs.ECS, instance ecsEC2Instance, asgName, clusterName string) error {
-	output, err := ASAPI.DetachInstances(&autoscaling.DetachInstancesInput{
+func detachAndDrain(ctx context.Context, ASAPI autoscaling.AutoScaling, ECSAPI ecs.ECS, instance ecsEC2Instance, asgName, clusterName string) error {
+	output, err := ASAPI.DetachInstancesWithContext(ctx, &autoscaling.DetachInstancesInput{
 		AutoScalingGroupName:           aws.String(asgName),
 		InstanceIds:                    []*string{aws.String(instance.ec2InstanceID)},
 		ShouldDecrementDesiredCapacity: aws.Bool(false),
 	})
 
 	if err != nil {
-		return fmt.Errorf("%v %v", instance, err)
+		return fmt.Errorf("%v %w", instance, err)
 	}
 
 	for _, activity := range output.Activities {
-		log.Printf("%v %v", instance, *activity.Description)
+		emit(ctx, InstanceDetached{InstanceId: instance.ec2InstanceID, ContainerInstanceId: instance.ecsContainerInstanceID, Activity: *activity.Description})
 	}
 
-	_, err = ECSAPI.UpdateContainerInstancesState(&ecs.UpdateContainerInstancesStateInput{
+	_, err = ECSAPI.UpdateContainerInstancesStateWithContext(ctx, &ecs.UpdateContainerInstancesStateInput{
 		Cluster:            aws.String(clusterName),
 		ContainerInstances: []*string{aws.String(instance.ecsContainerInstanceID)},
 		Status:             aws.String("DRAINING"),
 	})
 
+	// the instance must be re-attached even if the enforcement was cancelled
+	undoCtx := detachedContext{parent: ctx}
+
 	reAttach := func() {
-		_, err2 := ASAPI.AttachInstances(&autoscaling.AttachInstancesInput{
+		_, err2 := ASAPI.AttachInstancesWithContext(undoCtx, &autoscaling.AttachInstancesInput{
 			AutoScalingGroupName: aws.String(asgName),
 			InstanceIds:          []*string{aws.String(instance.ec2InstanceID)},
 		})
 		if err2 != nil {
-			log.Printf("[ACTIONABLE ACTION REQUIRED] instance re-attachment failed!")
-			log.Printf("%v %v", instance, err2)
+			emit(ctx, InstanceActionRequired{InstanceId: instance.ec2InstanceID, ContainerInstanceId: instance.ecsContainerInstanceID, Action: "instance re-attachment failed!", Err: err2})
 		}
 	}
 
 	if err != nil {
 		reAttach()
-		return fmt.Errorf("%v %v", instance, err)
+		return fmt.Errorf("%v %w", instance, err)
+	}
+
+	reActivate := func() {
+		_, err2 := ECSAPI.UpdateContainerInstancesStateWithContext(undoCtx, &ecs.UpdateContainerInstancesStateInput{
+			Cluster:            aws.String(clusterName),
+			ContainerInstances: []*string{aws.String(instance.ecsContainerInstanceID)},
+			Status:             aws.String("ACTIVE"),
+		})
+		if err2 != nil {
+			emit(ctx, InstanceActionRequired{InstanceId: instance.ec2InstanceID, ContainerInstanceId: instance.ecsContainerInstanceID, Action: "instance re-activation failed!", Err: err2})
+		}
 	}
 
 	operation := func() error {
-		err := drainingContainerInstanceIsDrained(ECSAPI, clusterName, instance.ecsContainerInstanceID)
+		err := drainingContainerInstanceIsDrained(ctx, ECSAPI, clusterName, instance.ecsContainerInstanceID)
 		if err != nil {
-			log.Printf("%v %v", instance, err)
+			emit(ctx, InstanceDraining{InstanceId: instance.ec2InstanceID, ContainerInstanceId: instance.ecsContainerInstanceID, Err: err})
 		}
 		return err
 	}
 
-	err = backoff.Retry(operation, backoff.NewExponentialBackOff())
+	err = backoff.Retry(operation, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+	if err != nil && ctx.Err() != nil {
+		reActivate()
+		reAttach()
+		return fmt.Errorf("%v %w", instance, ctx.Err())
+	}
 	if err != nil {
 		reAttach()
-		log.Printf("[ACTIONABLE ACTION REQUIRED] instance left in DRAINING status!")
-		return fmt.Errorf("%v %v", instance, err)
+		emit(ctx, InstanceActionRequired{InstanceId: instance.ec2InstanceID, ContainerInstanceId: instance.ecsContainerInstanceID, Action: "instance left in DRAINING status!"})
+		return fmt.Errorf("%v %w", instance, err)
 	}
 
+	emit(ctx, InstanceDrained{InstanceId: instance.ec2InstanceID, ContainerInstanceId: instance.ecsContainerInstanceID})
 	return nil
 }
 
-func drainingContainerInstanceIsDrained(ECSAPI ecs.ECS, clusterName, containerInstanceID string) error {
-	output, err := ECSAPI.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+func drainingContainerInstanceIsDrained(ctx context.Context, ECSAPI ecs.ECS, clusterName, containerInstanceID string) error {
+	output, err := ECSAPI.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
 		Cluster:            aws.String(clusterName),
 		ContainerInstances: []*string{aws.String(containerInstanceID)},
 	})
@@ -207,16 +227,17 @@ func checkDrainingContainerInstance(containerInstance *ecs.ContainerInstance, pa
 	return ErrContainerInstanceNotFound
 }
 
-func drainAll(ASAPI autoscaling.AutoScaling, ECSAPI ecs.ECS, EC2API ec2.EC2, instances []ecsEC2Instance, asgName, clusterName string) error {
+func drainAll(ctx context.Context, ASAPI autoscaling.AutoScaling, ECSAPI ecs.ECS, EC2API ec2.EC2, instances []ecsEC2Instance, asgName, clusterName string) error {
 	errors := make([]error, len(instances))
 	var wg sync.WaitGroup
 	for i, instance := range instances {
 		wg.Add(1)
 		go func(thatInstance ecsEC2Instance, index int) {
 			defer wg.Done()
-			errors[index] = detachAndDrain(ASAPI, ECSAPI, thatInstance, asgName, clusterName)
+			errors[index] = detachAndDrain(ctx, ASAPI, ECSAPI, thatInstance, asgName, clusterName)
 			if errors[index] == nil {
-				_, err := EC2API.TerminateInstances(&ec2.TerminateInstancesInput{
+				// a drained and detached instance is terminated even if the enforcement was cancelled meanwhile
+				_, err := EC2API.TerminateInstancesWithContext(detachedContext{parent: ctx}, &ec2.TerminateInstancesInput{
 					InstanceIds: []*string{
 						aws.String(thatInstance.ec2InstanceID),
 					},
@@ -226,28 +247,28 @@ func drainAll(ASAPI autoscaling.AutoScaling, ECSAPI ecs.ECS, EC2API ec2.EC2, ins
 		}(instance, i)
 	}
 	wg.Wait()
-	var onlyErrors []error
+	var onlyErrors errorList
 	for _, err := range errors {
 		if err != nil {
 			onlyErrors = append(onlyErrors, err)
 		}
 	}
 	if len(onlyErrors) > 0 {
-		return fmt.Errorf("%v", onlyErrors)
+		return onlyErrors
 	}
 	return nil
 }
 
-func enforceLaunchConfig(ECSAPI ecs.ECS, ASAPI autoscaling.AutoScaling, EC2API ec2.EC2, asgName, clusterName string, bo backoff.BackOff) error {
-	asgInstances, expectedLaunchConfig, err := listASGInstances(&ASAPI, asgName)
+func enforceLaunchConfig(ctx context.Context, ECSAPI ecs.ECS, ASAPI autoscaling.AutoScaling, EC2API ec2.EC2, asgName, clusterName string, bo backoff.BackOff) error {
+	asgInstances, expectedLaunchConfig, err := listASGInstances(ctx, &ASAPI, asgName)
 	if err != nil {
 		return err
 	}
-	instances, err := instancesToContainerInstances(ECSAPI, filterInstancesToReplace(expectedLaunchConfig, asgInstances), clusterName)
+	instances, err := instancesToContainerInstances(ctx, ECSAPI, filterInstancesToReplace(expectedLaunchConfig, asgInstances), clusterName)
 	if err != nil {
 		return err
 	}
-	return drainAll(ASAPI, ECSAPI, EC2API, instances, asgName, clusterName)
+	return drainAll(ctx, ASAPI, ECSAPI, EC2API, instances, asgName, clusterName)
 }
 
 // EnforceLaunchConfig encapsulates the attributes of a LaunchConfig enforcement
@@ -258,9 +279,17 @@ type EnforceLaunchConfig struct {
 	ASGName        string
 	ECSClusterName string
 	BackOff        backoff.BackOff
+	EventSink      EventSink // Receives the progress events, if nil LogEventSink is used
 }
 
 // Apply the LaunchConfig enforcement
 func (e *EnforceLaunchConfig) Apply() error {
-	return enforceLaunchConfig(e.ECSAPI, e.ASAPI, e.EC2API, e.ASGName, e.ECSClusterName, e.BackOff)
+	return e.ApplyWithContext(context.Background())
+}
+
+// ApplyWithContext applies the LaunchConfig enforcement, if the context is cancelled instances being drained are
+// re-activated and re-attached
+func (e *EnforceLaunchConfig) ApplyWithContext(ctx context.Context) error {
+	ctx = withEventSink(ctx, e.EventSink)
+	return enforceLaunchConfig(ctx, e.ECSAPI, e.ASAPI, e.EC2API, e.ASGName, e.ECSClusterName, e.BackOff)
 }
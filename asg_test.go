@@ -1,8 +1,10 @@
 package awsecs
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ecs"
@@ -13,7 +15,7 @@ type mockAutoScalingClient struct {
 	autoscalingiface.AutoScalingAPI
 }
 
-func (m *mockAutoScalingClient) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+func (m *mockAutoScalingClient) DescribeAutoScalingGroupsWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	name := ""
 	return &autoscaling.DescribeAutoScalingGroupsOutput{
 		AutoScalingGroups: []*autoscaling.Group{
@@ -28,7 +30,7 @@ func (m *mockAutoScalingClient) DescribeAutoScalingGroups(input *autoscaling.Des
 }
 
 func TestListASGInstaces(t *testing.T) {
-	instances, name, err := listASGInstances(&mockAutoScalingClient{}, "")
+	instances, name, err := listASGInstances(context.Background(), &mockAutoScalingClient{}, "")
 	if len(instances) != 0 {
 		t.Errorf("unexpected")
 	}
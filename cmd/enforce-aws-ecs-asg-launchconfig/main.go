@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"github.com/Autodesk/go-awsecs"
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,14 +13,74 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/cenkalti/backoff"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// summary the last line of -output json
+type summary struct {
+	Type             string   `json:"type"` // Always "summary"
+	Cluster          string   `json:"cluster"`
+	ASG              string   `json:"asg"`
+	DurationSeconds  float64  `json:"durationSeconds"`
+	Outcome          string   `json:"outcome"` // "success" or "failure"
+	InstancesDrained []string `json:"instancesDrained"`
+	Errors           []string `json:"errors,omitempty"` // The error chain, outermost first
+}
+
+// jsonReport writes the progress events as lines of JSON and keeps the drained instances for the summary
+type jsonReport struct {
+	awsecs.JSONEventSink
+	mu      sync.Mutex
+	drained []string
+}
+
+func (r *jsonReport) Emit(event awsecs.Event) {
+	if drained, ok := event.(awsecs.InstanceDrained); ok {
+		r.mu.Lock()
+		r.drained = append(r.drained, drained.InstanceId)
+		r.mu.Unlock()
+	}
+	r.JSONEventSink.Emit(event)
+}
+
+func (r *jsonReport) summarize(cluster, asg string, started time.Time, err error) {
+	s := summary{Type: "summary", Cluster: cluster, ASG: asg, DurationSeconds: time.Since(started).Seconds(), Outcome: "success", InstancesDrained: []string{}}
+	if err != nil {
+		s.Outcome = "failure"
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		s.Errors = append(s.Errors, err.Error())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.InstancesDrained = append(s.InstancesDrained, r.drained...)
+	if err := json.NewEncoder(r.Writer).Encode(s); err != nil {
+		log.Printf("on JSON report while write summary: %v", err)
+	}
+}
+
 func main() {
 	cluster := flag.String("cluster", "", "cluster name")
 	asg := flag.String("asg", "", "asg name")
 	profile := flag.String("profile", "", "profile name")
 	region := flag.String("region", "", "region name")
+	output := flag.String("output", "text", "text, or json to write newline-delimited JSON progress records and a final summary to stdout")
+	metrics := flag.String("metrics", "", "prometheus=<path> of a textfile collector file, statsd=<host:port> or emf[=<namespace>] to write the metrics of the enforcement to stderr in the CloudWatch Embedded Metric Format")
 	flag.Parse()
+	started := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("received %v, cancelling", <-signals)
+		cancel()
+	}()
 
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		Profile: *profile,
@@ -36,7 +99,43 @@ func main() {
 		BackOff:        backoff.NewExponentialBackOff(),
 	}
 
-	if err := elc.Apply(); err != nil {
-		log.Fatal(err)
+	var report *jsonReport
+	switch *output {
+	case "text":
+	case "json":
+		report = &jsonReport{JSONEventSink: awsecs.JSONEventSink{Writer: os.Stdout}}
+		elc.EventSink = report
+	default:
+		log.Printf("output: unknown format %q", *output)
+		os.Exit(awsecs.ExitCodeInvalidInput)
+	}
+
+	var collector *awsecs.MetricsCollector
+	if *metrics != "" {
+		sink, err := awsecs.ParseMetricsSink(*metrics, os.Stderr)
+		if err != nil {
+			log.Printf("metrics: %v", err)
+			os.Exit(awsecs.ExitCodeInvalidInput)
+		}
+		collector = awsecs.NewMetricsCollector(elc.EventSink, sink, map[string]string{"tool": "enforce-aws-ecs-asg-launchconfig", "cluster": *cluster, "asg": *asg})
+		elc.EventSink = collector
+	}
+
+	err := elc.ApplyWithContext(ctx)
+	if report != nil {
+		report.summarize(*cluster, *asg, started, err)
+	}
+	if collector != nil {
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		if err := collector.Flush(outcome); err != nil {
+			log.Printf("on metrics: %v", err)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(awsecs.ExitCode(err))
 	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Autodesk/go-awsecs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cenkalti/backoff"
+	"io/ioutil"
+	"strings"
+)
+
+// deploymentPlan declares ordered waves of services, the other flags and the manifest apply to every service
+type deploymentPlan struct {
+	MaxParallel int                  `json:"maxParallel" yaml:"maxParallel"`
+	Waves       []deploymentPlanWave `json:"waves" yaml:"waves"`
+}
+
+type deploymentPlanWave struct {
+	Name        string                  `json:"name" yaml:"name"`
+	Cluster     string                  `json:"cluster" yaml:"cluster"`
+	Region      string                  `json:"region" yaml:"region"`
+	MaxParallel int                     `json:"maxParallel" yaml:"maxParallel"`
+	Services    []deploymentPlanService `json:"services" yaml:"services"`
+}
+
+type deploymentPlanService struct {
+	Name    string   `json:"name" yaml:"name"`
+	Service string   `json:"service" yaml:"service"`
+	Cluster string   `json:"cluster" yaml:"cluster"`
+	Region  string   `json:"region" yaml:"region"`
+	After   []string `json:"after" yaml:"after"`
+}
+
+func parseDeploymentPlan(name string, data []byte) (deploymentPlan, error) {
+	p := deploymentPlan{}
+	if err := decodeFile("plan", name, data, &p); err != nil {
+		return deploymentPlan{}, fmt.Errorf("plan %s: %w", name, err)
+	}
+	if err := p.validate(); err != nil {
+		return deploymentPlan{}, fmt.Errorf("plan %s: %w", name, err)
+	}
+	return p, nil
+}
+
+func readDeploymentPlan(name string) (deploymentPlan, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return deploymentPlan{}, err
+	}
+	return parseDeploymentPlan(name, data)
+}
+
+func (p deploymentPlan) validate() error {
+	var problems []string
+	if len(p.Waves) == 0 {
+		problems = append(problems, "waves: no waves")
+	}
+	if p.MaxParallel < 0 {
+		problems = append(problems, fmt.Sprintf("maxParallel: must not be negative, got %d", p.MaxParallel))
+	}
+	for _, wave := range p.Waves {
+		if wave.MaxParallel < 0 {
+			problems = append(problems, fmt.Sprintf("waves: %s: maxParallel: must not be negative, got %d", wave.Name, wave.MaxParallel))
+		}
+		for _, service := range wave.Services {
+			if service.Service == "" {
+				problems = append(problems, fmt.Sprintf("waves: %s: empty service name", wave.Name))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// deploymentPlan returns the waves of updates of esu, the services without cluster use the one of esu, the services
+// without region the one of sess. The pre-deploy task runs once, with the first service, before any service is updated
+func (p deploymentPlan) deploymentPlan(esu awsecs.ECSServiceUpdate, sess *session.Session) awsecs.DeploymentPlan {
+	type apis struct {
+		ecs        *ecs.ECS
+		elbv2      *elbv2.ELBV2
+		codedeploy *codedeploy.CodeDeploy
+	}
+	regions := map[string]apis{}
+	regionApis := func(region string) apis {
+		if _, found := regions[region]; !found {
+			regionSess := sess
+			if region != "" {
+				regionSess = sess.Copy(&aws.Config{Region: aws.String(region)})
+			}
+			regions[region] = apis{ecs: ecs.New(regionSess), elbv2: elbv2.New(regionSess), codedeploy: codedeploy.New(regionSess)}
+		}
+		return regions[region]
+	}
+
+	plan := awsecs.DeploymentPlan{MaxParallel: p.MaxParallel, PreDeployTask: esu.PreDeployTask}
+	for _, wave := range p.Waves {
+		planWave := awsecs.Wave{Name: wave.Name, MaxParallel: wave.MaxParallel}
+		for _, service := range wave.Services {
+			update := esu
+			update.Service = service.Service
+			update.BackOff = backoff.NewExponentialBackOff()
+			update.PreDeployTask = nil
+			if cluster := firstNonEmpty(service.Cluster, wave.Cluster); cluster != "" {
+				update.Cluster = cluster
+			}
+			if region := firstNonEmpty(service.Region, wave.Region); region != "" {
+				update.EcsApi, update.ElbApi = regionApis(region).ecs, regionApis(region).elbv2
+				if update.CodeDeploy != nil {
+					codeDeploy := *update.CodeDeploy
+					codeDeploy.Api = regionApis(region).codedeploy
+					update.CodeDeploy = &codeDeploy
+				}
+			}
+			planWave.Services = append(planWave.Services, awsecs.WaveService{Name: service.Name, After: service.After, Update: update})
+		}
+		plan.Waves = append(plan.Waves, planWave)
+	}
+	return plan
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
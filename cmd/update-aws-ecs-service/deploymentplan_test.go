@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/Autodesk/go-awsecs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDeploymentPlan(t *testing.T) {
+	want := deploymentPlan{
+		MaxParallel: 2,
+		Waves: []deploymentPlanWave{
+			{Name: "backend", Cluster: "backend-cluster", Services: []deploymentPlanService{
+				{Service: "api"},
+				{Service: "worker", After: []string{"api"}},
+			}},
+			{Name: "edge", Region: "us-east-1", Services: []deploymentPlanService{
+				{Service: "gateway", Cluster: "edge-cluster", After: []string{"worker"}},
+			}},
+		},
+	}
+	yamlPlan := `
+maxParallel: 2
+waves:
+  - name: backend
+    cluster: backend-cluster
+    services:
+      - service: api
+      - service: worker
+        after: [api]
+  - name: edge
+    region: us-east-1
+    services:
+      - service: gateway
+        cluster: edge-cluster
+        after: [worker]
+`
+	jsonPlan := `{
+  "maxParallel": 2,
+  "waves": [
+    {"name": "backend", "cluster": "backend-cluster", "services": [{"service": "api"}, {"service": "worker", "after": ["api"]}]},
+    {"name": "edge", "region": "us-east-1", "services": [{"service": "gateway", "cluster": "edge-cluster", "after": ["worker"]}]}
+  ]
+}`
+	for name, data := range map[string]string{"plan.yaml": yamlPlan, "plan.json": jsonPlan} {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseDeploymentPlan(name, []byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parseDeploymentPlan() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseDeploymentPlanErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		wantErr string
+	}{
+		{name: "no waves", file: "plan.yaml", data: "maxParallel: 1\n", wantErr: "waves: no waves"},
+		{name: "negative", file: "plan.yaml", data: "maxParallel: -1\nwaves:\n  - services:\n      - service: api\n", wantErr: "maxParallel: must not be negative"},
+		{name: "empty service", file: "plan.yaml", data: "waves:\n  - name: backend\n    services:\n      - after: [api]\n", wantErr: "waves: backend: empty service name"},
+		{name: "unknown field", file: "plan.json", data: `{"waves": [{"services": [{"service": "api", "cluser": "x"}]}]}`, wantErr: "cluser"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDeploymentPlan(tt.file, []byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDeploymentPlanUpdates(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-west-2")}))
+	esu := awsecs.ECSServiceUpdate{
+		EcsApi:        ecs.New(sess),
+		Cluster:       "my-cluster",
+		PreDeployTask: &awsecs.PreDeployTask{},
+	}
+	p := deploymentPlan{MaxParallel: 2, Waves: []deploymentPlanWave{
+		{Name: "backend", Cluster: "backend-cluster", Services: []deploymentPlanService{{Service: "api"}, {Service: "worker", After: []string{"api"}}}},
+		{Name: "edge", Region: "us-east-1", Services: []deploymentPlanService{{Service: "gateway", Cluster: "edge-cluster"}, {Service: "cache"}}},
+	}}
+	plan := p.deploymentPlan(esu, sess)
+	if plan.MaxParallel != 2 || len(plan.Waves) != 2 || plan.PreDeployTask == nil {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	want := []struct {
+		service string
+		cluster string
+		region  string
+	}{
+		{"api", "backend-cluster", "us-west-2"},
+		{"worker", "backend-cluster", "us-west-2"},
+		{"gateway", "edge-cluster", "us-east-1"},
+		{"cache", "my-cluster", "us-east-1"},
+	}
+	var i int
+	for _, wave := range plan.Waves {
+		for _, service := range wave.Services {
+			update := service.Update
+			if update.Service != want[i].service || update.Cluster != want[i].cluster {
+				t.Errorf("expected %s in %s, got %s in %s", want[i].service, want[i].cluster, update.Service, update.Cluster)
+			}
+			if region := *update.EcsApi.(*ecs.ECS).Config.Region; region != want[i].region {
+				t.Errorf("%s: expected region %s, got %s", update.Service, want[i].region, region)
+			}
+			if update.PreDeployTask != nil {
+				t.Errorf("%s: expected the pre-deploy task to run once for the plan, got %v", update.Service, update.PreDeployTask)
+			}
+			if update.BackOff == nil {
+				t.Errorf("%s: expected a backoff", update.Service)
+			}
+			i++
+		}
+	}
+}
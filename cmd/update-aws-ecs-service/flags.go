@@ -1,6 +1,41 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type stringsFlag []string
+
+func (values *stringsFlag) String() string {
+	return fmt.Sprintf("%v", *values)
+}
+
+func (values *stringsFlag) Set(value string) error {
+	*values = append(*values, value)
+	return nil
+}
+
+type int64sFlag []int64
+
+func (values *int64sFlag) String() string {
+	return fmt.Sprintf("%v", *values)
+}
+
+// Set replaces the values with the comma separated ones
+func (values *int64sFlag) Set(value string) error {
+	var parsed []int64
+	for _, field := range strings.Split(value, ",") {
+		i, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, i)
+	}
+	*values = parsed
+	return nil
+}
 
 type mapMapMapFlag map[string]map[string]map[string]string
 
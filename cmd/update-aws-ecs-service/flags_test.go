@@ -5,6 +5,19 @@ import (
 	"testing"
 )
 
+func TestInt64sFlag_Set(t *testing.T) {
+	actual := int64sFlag{10, 50, 100}
+	if err := actual.Set("25, 100"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(int64sFlag{25, 100}, actual) {
+		t.Fatalf("unexpected %v", actual)
+	}
+	if err := actual.Set("25,half"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
 func TestMapMapMapFlag_Set(t *testing.T) {
 	actualStruct := mapMapMapFlag{}
 	if err := actualStruct.Set("container1=awslogs=region=us-west-2"); err != nil {
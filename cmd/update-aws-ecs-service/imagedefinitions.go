@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// imageDefinition entry of the CodePipeline imagedefinitions.json file
+type imageDefinition struct {
+	Name     string `json:"name"`
+	ImageURI string `json:"imageUri"`
+}
+
+// imageDetail the CodePipeline ECS blue/green imageDetail.json file, the ECR source action writes other fields about
+// the image too, they are ignored
+type imageDetail struct {
+	ImageURI string `json:"ImageURI"`
+}
+
+func parseImageDefinitions(container string, data []byte) (map[string]string, error) {
+	images := map[string]string{}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, errors.New("empty image definitions")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	switch trimmed[0] {
+	case '[':
+		if container != "" {
+			return nil, errors.New("imagedefinitions.json declares the container names, no container name expected")
+		}
+		decoder.DisallowUnknownFields()
+		var definitions []imageDefinition
+		if err := decoder.Decode(&definitions); err != nil {
+			return nil, err
+		}
+		for i, definition := range definitions {
+			if definition.Name == "" || definition.ImageURI == "" {
+				return nil, fmt.Errorf("entry %d: name and imageUri are required", i)
+			}
+			if _, found := images[definition.Name]; found {
+				return nil, fmt.Errorf("entry %d: duplicated container name %s", i, definition.Name)
+			}
+			images[definition.Name] = definition.ImageURI
+		}
+	case '{':
+		if container == "" {
+			return nil, errors.New("imageDetail.json does not declare the container name, use container-name=path")
+		}
+		var detail imageDetail
+		if err := decoder.Decode(&detail); err != nil {
+			return nil, err
+		}
+		if detail.ImageURI == "" {
+			return nil, errors.New("ImageURI is required")
+		}
+		images[container] = detail.ImageURI
+	default:
+		return nil, errors.New("expected imagedefinitions.json or imageDetail.json contents")
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the image definitions")
+	}
+	return images, nil
+}
+
+func readImageDefinitions(value string) (map[string]string, error) {
+	container, path := "", value
+	if key, rest := keyEqValue(value); rest != "" {
+		container, path = key, rest
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	images, err := parseImageDefinitions(container, data)
+	if err != nil {
+		return nil, fmt.Errorf("image definitions %s: %w", path, err)
+	}
+	return images, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseImageDefinitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		container string
+		data      string
+		want      map[string]string
+		wantErr   bool
+	}{
+		{
+			name: "imagedefinitions.json",
+			data: `[{"name": "app", "imageUri": "myrepo/app:1a2b3c4"}, {"name": "sidecar", "imageUri": "myrepo/sidecar:1a2b3c4"}]`,
+			want: map[string]string{"app": "myrepo/app:1a2b3c4", "sidecar": "myrepo/sidecar:1a2b3c4"},
+		},
+		{
+			name:      "imageDetail.json",
+			container: "app",
+			data:      `{"ImageURI": "123456789012.dkr.ecr.us-west-2.amazonaws.com/app@sha256:0123"}`,
+			want:      map[string]string{"app": "123456789012.dkr.ecr.us-west-2.amazonaws.com/app@sha256:0123"},
+		},
+		{
+			name:      "imageDetail.json of the ECR source action",
+			container: "app",
+			data: `{
+  "ImageSizeInBytes": "44728918",
+  "ImageDigest": "sha256:EXAMPLE11223344556677889900bfea42ea2d3b8a1ee8329ba7e68694950afd3",
+  "Version": "1.0",
+  "ImagePushedAt": "Mon Jan 21 20:04:00 UTC 2019",
+  "RegistryId": "123456789012",
+  "RepositoryName": "app",
+  "ImageURI": "123456789012.dkr.ecr.us-west-2.amazonaws.com/app@sha256:EXAMPLE11223344556677889900bfea42ea2d3b8a1ee8329ba7e68694950afd3",
+  "ImageTags": ["latest"]
+}`,
+			want: map[string]string{"app": "123456789012.dkr.ecr.us-west-2.amazonaws.com/app@sha256:EXAMPLE11223344556677889900bfea42ea2d3b8a1ee8329ba7e68694950afd3"},
+		},
+		{
+			name:    "imageDetail.json without container name",
+			data:    `{"ImageURI": "myrepo/app:1a2b3c4"}`,
+			wantErr: true,
+		},
+		{
+			name:      "imagedefinitions.json with container name",
+			container: "app",
+			data:      `[{"name": "app", "imageUri": "myrepo/app:1a2b3c4"}]`,
+			wantErr:   true,
+		},
+		{
+			name:    "duplicated container name",
+			data:    `[{"name": "app", "imageUri": "myrepo/app:1"}, {"name": "app", "imageUri": "myrepo/app:2"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing imageUri",
+			data:    `[{"name": "app"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			data:    `[{"name": "app", "image": "myrepo/app:1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			data:    `app: myrepo/app:1`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImageDefinitions(tt.container, []byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseImageDefinitions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("parseImageDefinitions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
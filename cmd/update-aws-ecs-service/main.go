@@ -1,19 +1,32 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/Autodesk/go-awsecs"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/cenkalti/backoff"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// summaryReport the report of -output json, nil with -output text. The exits before the update write its summary
+var summaryReport *jsonReport
+
 func int64ptr(x int64) *int64 {
 	if x < 0 {
 		return nil
@@ -21,6 +34,40 @@ func int64ptr(x int64) *int64 {
 	return &x
 }
 
+func parseCommand(command string) ([]string, error) {
+	command = strings.TrimSpace(command)
+	if strings.HasPrefix(command, "[") {
+		var args []string
+		err := json.Unmarshal([]byte(command), &args)
+		return args, err
+	}
+	return strings.Fields(command), nil
+}
+
+// hooks returns the local command hook followed by the one-off task hook, task is container-name=command
+func hooks(command, task string, timeout time.Duration) ([]awsecs.Hook, error) {
+	var hooks []awsecs.Hook
+	if command != "" {
+		args, err := parseCommand(command)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, &awsecs.CommandHook{Command: args, Timeout: timeout})
+	}
+	if task != "" {
+		container, command := keyEqValue(task)
+		if container == "" {
+			return nil, fmt.Errorf("the task requires the container name, container-name=command: %q", task)
+		}
+		args, err := parseCommand(command)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, &awsecs.TaskHook{Container: container, Command: args, Timeout: timeout})
+	}
+	return hooks, nil
+}
+
 func keyEqValue(kv string) (string, string) {
 	parts := strings.SplitN(kv, "=", 2)
 	return strings.TrimSpace(strings.Join(parts[0:1], "")), strings.TrimSpace(strings.Join(parts[1:2], ""))
@@ -56,20 +103,58 @@ func (kvs mapMapFlag) Set(value string) error {
 
 func main() {
 	cluster := flag.String("cluster", "", "cluster name")
-	service := flag.String("service", "", "service name")
+	parallel := flag.Bool("parallel", false, "update the services at the same time instead of in order, each once the previous one is validated")
 	profile := flag.String("profile", "", "profile name")
 	region := flag.String("region", "", "region name")
 	taskdef := flag.String("taskdef", "", "base task definition (instead of current)")
 	desiredCount := flag.Int64("desired-count", -1, "desired-count (negative: no change)")
 	taskrole := flag.String("task-role", "", fmt.Sprintf(`task iam role, set to "%s" to clear`, awsecs.TaskRoleKnockoutValue))
-	waituntil := flag.String("wait-until", awsecs.WaitUntilPrimaryRolled, fmt.Sprintf("valid options are: %s", strings.Join(awsecs.WaitUntilOptionList, ", ")))
+	waituntil := flag.String("wait-until", awsecs.WaitUntilPrimaryRolled, fmt.Sprintf("comma separated, every option must pass, valid options are: %s", strings.Join(awsecs.WaitUntilOptionList, ", ")))
+	imageDefinitions := flag.String("image-definitions", "", "CodePipeline imagedefinitions.json path or container-name=imageDetail.json path, -container-image overrides it")
+	planFile := flag.String("plan", "", "deployment plan file (.json, .yaml or .yml) of ordered waves of services, the other flags apply to every service")
+	manifestFile := flag.String("manifest", "", "deployment manifest file (.json, .yaml or .yml), flags override the manifest values")
+	pinDigests := flag.Bool("pin-digests", false, "resolve container images to immutable digests before registering the task definition")
+	failedTasksThreshold := flag.Int("failed-tasks-threshold", awsecs.DefaultFailedTasksThreshold, "consecutive failed tasks after which the deployment is rolled back (0: ignore failed tasks)")
+	unhealthyThreshold := flag.Int("unhealthy-threshold", awsecs.DefaultUnhealthyThreshold, "consecutive unhealthy checks of a new target after which the deployment is rolled back (only with -wait-until targets-healthy)")
+	smokeTestURL := flag.String("smoke-test-url", "", "URL to GET after the deployment rolled, the deployment is rolled back unless it responds as expected")
+	smokeTestStatus := flag.Int("smoke-test-status", http.StatusOK, "expected smoke test response status")
+	smokeTestBody := flag.String("smoke-test-body", "", "regexp the smoke test response body must match")
+	smokeTestTimeout := flag.Duration("smoke-test-timeout", 2*time.Minute, "time the smoke test may fail before the deployment is rolled back")
+	smokeTestRequestTimeout := flag.Duration("smoke-test-request-timeout", 10*time.Second, "timeout of each smoke test request")
+	preDeployTask := flag.Bool("pre-deploy-task", false, "run the new task definition as a one-off task before updating the service, the service is only updated if it exits with a zero exit code")
+	preDeployContainer := flag.String("pre-deploy-container", "", "container of the pre-deploy task to override the command of and to check the exit code of (implies -pre-deploy-task)")
+	preDeployCommand := flag.String("pre-deploy-command", "", `pre-deploy task command override, space separated or a JSON array, e.g. "./manage.py migrate" (requires -pre-deploy-container)`)
+	preDeployTimeout := flag.Duration("pre-deploy-timeout", awsecs.DefaultPreDeployTaskTimeout, "time the pre-deploy task may run before it is stopped and the deployment aborted")
+	postSuccessCommand := flag.String("post-success-command", "", "local command to run after a successful deployment, space separated or a JSON array, a failure exits non-zero but doesn't roll back")
+	postSuccessTask := flag.String("post-success-task", "", "container-name=command of a one-off task to run with the new task definition after a successful deployment, a failure exits non-zero but doesn't roll back")
+	postRollbackCommand := flag.String("post-rollback-command", "", "local command to run after a rollback, space separated or a JSON array, a failure is only logged")
+	postRollbackTask := flag.String("post-rollback-task", "", "container-name=command of a one-off task to run with the old task definition after a rollback, a failure is only logged")
+	hookTimeout := flag.Duration("hook-timeout", awsecs.DefaultHookTimeout, "time each post-success or post-rollback hook may run")
+	canary := flag.Bool("canary", false, fmt.Sprintf("run the new task definition in a <service>%s service sharing the load balancers of the service first, the service is only updated once it is validated and baked", awsecs.CanarySuffix))
+	canaryCount := flag.Int64("canary-count", 1, "tasks of the canary service (only with -canary)")
+	canaryBakeTime := flag.Duration("canary-bake-time", 5*time.Minute, "time the canary service must keep passing the validation before the service is updated (only with -canary)")
+	codeDeployApplication := flag.String("codedeploy-application", "", "CodeDeploy application of services with the CODE_DEPLOY deployment controller (default AppECS-<cluster>-<service>)")
+	codeDeployDeploymentGroup := flag.String("codedeploy-deployment-group", "", "CodeDeploy deployment group of services with the CODE_DEPLOY deployment controller (default DgpECS-<cluster>-<service>)")
+	listener := flag.String("listener", "", "ALB listener whose default action forwards to the -blue and -green target groups")
+	listenerRule := flag.String("listener-rule", "", "ALB listener rule whose action forwards to the -blue and -green target groups (instead of -listener)")
+	trafficStepTime := flag.Duration("traffic-step-time", 5*time.Minute, "time each traffic shift step must keep passing the validation before the next step (only with -blue and -green)")
+	output := flag.String("output", outputText, fmt.Sprintf("%s, or %s to write newline-delimited JSON progress records and a final summary to stdout", outputText, outputJSON))
+	metrics := flag.String("metrics", "", "prometheus=<path> of a textfile collector file, statsd=<host:port> or emf[=<namespace>] to write the metrics of the update to stderr in the CloudWatch Embedded Metric Format")
+	dryRun := flag.Bool("dry-run", false, "print the task definition diff and service changes without applying them")
 
+	var services stringsFlag
+	var blue, green string
+	var trafficSteps int64sFlag = awsecs.DefaultTrafficShiftSteps
 	var images mapFlag = map[string]string{}
 	var envs mapMapFlag = map[string]map[string]string{}
 	var secrets mapMapFlag = map[string]map[string]string{}
 	var logopts mapMapMapFlag = map[string]map[string]map[string]string{}
 	var logsecrets mapMapMapFlag = map[string]map[string]map[string]string{}
 
+	flag.Var(&services, "service", "service name, repeat to update several services as a single rollback unit")
+	flag.StringVar(&blue, "blue", "", "service=target-group-arn of one of the services to shift the traffic between, the idle one is updated (requires -green)")
+	flag.StringVar(&green, "green", "", "service=target-group-arn of the other service to shift the traffic between (requires -blue)")
+	flag.Var(&trafficSteps, "traffic-steps", "comma separated percentages of the traffic shifted to the updated service, increasing and ending with 100 (only with -blue and -green)")
 	flag.Var(&images, "container-image", "container-name=image")
 	flag.Var(&envs, "container-envvar", "container-name=envvar-name=envvar-value")
 	flag.Var(&secrets, "container-secret", "container-name=secret-name=secret-valuefrom")
@@ -77,6 +162,15 @@ func main() {
 	flag.Var(&logsecrets, "container-logsecret", "container-name=logdriver=logsecret=valuefrom")
 	flag.Parse()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("received %v, cancelling", <-signals)
+		cancel()
+	}()
+
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		Profile: *profile,
 	}))
@@ -86,27 +180,301 @@ func main() {
 	}
 
 	esu := awsecs.ECSServiceUpdate{
-		EcsApi:           ecs.New(sess),
-		ElbApi:           elbv2.New(sess),
-		Cluster:          *cluster,
-		Service:          *service,
-		Image:            images,
-		Environment:      envs,
-		Secrets:          secrets,
-		LogDriverOptions: logopts,
-		LogDriverSecrets: logsecrets,
-		TaskRole:         *taskrole,
-		DesiredCount:     int64ptr(*desiredCount),
-		Taskdef:          *taskdef,
-		WaitUntil:        waituntil,
-		BackOff:          backoff.NewExponentialBackOff(),
-	}
-
-	if err := esu.Apply(); err != nil {
-		if err != awsecs.ErrFailedRollback {
-			log.Fatal(err)
+		EcsApi:               ecs.New(sess),
+		ElbApi:               elbv2.New(sess),
+		Cluster:              *cluster,
+		Image:                images,
+		Environment:          envs,
+		Secrets:              secrets,
+		LogDriverOptions:     logopts,
+		LogDriverSecrets:     logsecrets,
+		TaskRole:             *taskrole,
+		DesiredCount:         int64ptr(*desiredCount),
+		Taskdef:              *taskdef,
+		WaitUntil:            waituntil,
+		FailedTasksThreshold: *failedTasksThreshold,
+		UnhealthyThreshold:   *unhealthyThreshold,
+		BackOff:              backoff.NewExponentialBackOff(),
+		CodeDeploy: &awsecs.CodeDeploy{
+			Api:             codedeploy.New(sess),
+			Application:     *codeDeployApplication,
+			DeploymentGroup: *codeDeployDeploymentGroup,
+		},
+	}
+
+	switch *output {
+	case outputText:
+	case outputJSON:
+		summaryReport = newJSONReport(os.Stdout, *waituntil)
+		esu.EventSink = summaryReport
+	default:
+		fatalInput("output: unknown format %q", *output)
+	}
+
+	if *pinDigests {
+		esu.ImageResolver = &awsecs.ECRImageResolver{
+			NewECRAPI: func(region string) ecriface.ECRAPI {
+				return ecr.New(sess, &aws.Config{Region: aws.String(region)})
+			},
+			Fallback: &awsecs.RegistryImageResolver{Client: http.DefaultClient},
+		}
+	}
+
+	if *preDeployTask || *preDeployContainer != "" || *preDeployCommand != "" {
+		command, err := parseCommand(*preDeployCommand)
+		if err != nil {
+			fatalInput("pre-deploy-command: %w", err)
+		}
+		esu.PreDeployTask = &awsecs.PreDeployTask{
+			Container: *preDeployContainer,
+			Command:   command,
+			Timeout:   *preDeployTimeout,
+		}
+	}
+
+	if *canary {
+		esu.Canary = &awsecs.Canary{
+			Count:    *canaryCount,
+			BakeTime: *canaryBakeTime,
+		}
+	}
+
+	postSuccessHooks, err := hooks(*postSuccessCommand, *postSuccessTask, *hookTimeout)
+	if err != nil {
+		fatalInput("post-success: %w", err)
+	}
+	postRollbackHooks, err := hooks(*postRollbackCommand, *postRollbackTask, *hookTimeout)
+	if err != nil {
+		fatalInput("post-rollback: %w", err)
+	}
+	esu.PostSuccessHooks = append(esu.PostSuccessHooks, postSuccessHooks...)
+	esu.PostRollbackHooks = append(esu.PostRollbackHooks, postRollbackHooks...)
+
+	if *smokeTestURL != "" {
+		smokeTest := &awsecs.SmokeTest{
+			Client:         http.DefaultClient,
+			URL:            *smokeTestURL,
+			ExpectedStatus: *smokeTestStatus,
+			Timeout:        *smokeTestTimeout,
+			RequestTimeout: *smokeTestRequestTimeout,
+		}
+		if *smokeTestBody != "" {
+			bodyRegexp, err := regexp.Compile(*smokeTestBody)
+			if err != nil {
+				fatalInput("smoke-test-body: %w", err)
+			}
+			smokeTest.BodyRegexp = bodyRegexp
+		}
+		esu.Validators = append(esu.Validators, smokeTest.Validate)
+	}
+
+	if *imageDefinitions != "" {
+		definitions, err := readImageDefinitions(*imageDefinitions)
+		if err != nil {
+			fatalInput("%w", err)
+		}
+		for container, image := range definitions {
+			if _, found := images[container]; !found {
+				images[container] = image
+			}
+		}
+	}
+
+	if *manifestFile != "" {
+		m, err := readManifest(*manifestFile)
+		if err != nil {
+			fatalInput("%w", err)
+		}
+		setFlags := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			setFlags[f.Name] = true
+		})
+		m.applyTo(&esu, setFlags)
+		m.applyServicesTo(&services, parallel, setFlags)
+	}
+	if len(services) > 0 {
+		esu.Service = services[0]
+	}
+
+	if *metrics != "" {
+		sink, err := awsecs.ParseMetricsSink(*metrics, os.Stderr)
+		if err != nil {
+			fatalInput("metrics: %w", err)
+		}
+		serviceNames := []string(services)
+		if blue != "" || green != "" {
+			blueService, _ := keyEqValue(blue)
+			greenService, _ := keyEqValue(green)
+			serviceNames = []string{blueService, greenService}
+		}
+		if !*dryRun {
+			esu.EventSink = awsecs.NewMetricsCollector(esu.EventSink, sink, map[string]string{"tool": "update-aws-ecs-service", "cluster": esu.Cluster, "service": strings.Join(serviceNames, ",")})
+		}
+	}
+
+	if *planFile != "" {
+		p, err := readDeploymentPlan(*planFile)
+		if err != nil {
+			fatalInput("%w", err)
+		}
+		applyDeploymentPlan(ctx, p.deploymentPlan(esu, sess), esu.EventSink, *dryRun)
+		return
+	}
+
+	if blue != "" || green != "" {
+		blueService, blueTargetGroup := keyEqValue(blue)
+		greenService, greenTargetGroup := keyEqValue(green)
+		shift := awsecs.ECSTrafficShiftUpdate{
+			Update:      esu,
+			ListenerArn: *listener,
+			RuleArn:     *listenerRule,
+			Blue:        awsecs.TrafficShiftService{Service: blueService, TargetGroupArn: blueTargetGroup},
+			Green:       awsecs.TrafficShiftService{Service: greenService, TargetGroupArn: greenTargetGroup},
+			Steps:       trafficSteps,
+			StepTime:    *trafficStepTime,
+		}
+		applyTrafficShift(ctx, shift, *dryRun)
+		return
+	}
+
+	if len(services) > 1 {
+		applyServices(ctx, esu, services, *parallel, *dryRun)
+		return
+	}
+
+	if *dryRun {
+		plan, err := esu.PlanWithContext(ctx)
+		exitDryRun(plan, err, notUpdatedResults(esu.Cluster, []string{esu.Service}, err))
+		return
+	}
+
+	err = esu.ApplyWithContext(ctx)
+	if report, ok := jsonReportOf(esu.EventSink); ok {
+		report.summarize(err, []awsecs.ServiceResult{updatedResult(esu.Cluster, esu.Service, err)})
+	}
+	flushMetrics(esu.EventSink, err)
+	exit(err)
+}
+
+// applyServices updates the services as a single rollback unit, the pre-deploy task runs once, with the first service,
+// before any service is updated
+func applyServices(ctx context.Context, esu awsecs.ECSServiceUpdate, services []string, parallel, dryRun bool) {
+	msu := awsecs.ECSMultiServiceUpdate{Parallel: parallel, PreDeployTask: esu.PreDeployTask}
+	for _, service := range services {
+		update := esu
+		update.Service = service
+		update.BackOff = backoff.NewExponentialBackOff()
+		update.PreDeployTask = nil
+		msu.Services = append(msu.Services, update)
+	}
+
+	if dryRun {
+		plan, err := msu.PlanWithContext(ctx)
+		exitDryRun(plan, err, notUpdatedResults(esu.Cluster, services, err))
+		return
+	}
+
+	results, err := msu.ApplyWithContext(ctx)
+	logResults("", results)
+	if report, ok := jsonReportOf(esu.EventSink); ok {
+		report.summarize(err, results)
+	}
+	flushMetrics(esu.EventSink, err)
+	exit(err)
+}
+
+// applyTrafficShift updates the idle one of the blue and green services and shifts the traffic to it
+func applyTrafficShift(ctx context.Context, shift awsecs.ECSTrafficShiftUpdate, dryRun bool) {
+	idle, err := shift.IdleServiceWithContext(ctx)
+	if err != nil {
+		exitNotUpdated(err, nil)
+	}
+	if dryRun {
+		plan, err := shift.PlanWithContext(ctx)
+		exitDryRun(plan, err, notUpdatedResults(shift.Update.Cluster, []string{idle.Service}, err))
+		return
+	}
+
+	err = shift.ApplyWithContext(ctx)
+	if report, ok := jsonReportOf(shift.Update.EventSink); ok {
+		report.summarize(err, []awsecs.ServiceResult{updatedResult(shift.Update.Cluster, idle.Service, err)})
+	}
+	flushMetrics(shift.Update.EventSink, err)
+	exit(err)
+}
+
+// applyDeploymentPlan deploys the waves of services, completed waves are rolled back if a later one fails
+func applyDeploymentPlan(ctx context.Context, plan awsecs.DeploymentPlan, sink awsecs.EventSink, dryRun bool) {
+	if dryRun {
+		output, err := plan.PlanWithContext(ctx)
+		var results []awsecs.ServiceResult
+		for _, wave := range plan.Waves {
+			for _, service := range wave.Services {
+				results = append(results, notUpdatedResults(service.Update.Cluster, []string{service.Update.Service}, err)...)
+			}
+		}
+		exitDryRun(output, err, results)
+		return
+	}
+
+	results, err := plan.ApplyWithContext(ctx)
+	var services []awsecs.ServiceResult
+	for _, wave := range results {
+		logResults(wave.Wave+"/", wave.Services)
+		services = append(services, wave.Services...)
+	}
+	if report, ok := jsonReportOf(sink); ok {
+		report.summarize(err, services)
+	}
+	flushMetrics(sink, err)
+	exit(err)
+}
+
+func logResults(prefix string, results []awsecs.ServiceResult) {
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("%s%s: %s: %v", prefix, result.Service, result.Outcome, result.Err)
 		} else {
-			os.Exit(1)
+			log.Printf("%s%s: %s", prefix, result.Service, result.Outcome)
 		}
 	}
 }
+
+// exit logs the chain of err and exits with its exit code, see awsecs.ExitCode, unless err is nil
+func exit(err error) {
+	if err != nil {
+		log.Print(strings.Join(errorChain(err), "\n\tcaused by: "))
+		os.Exit(awsecs.ExitCode(err))
+	}
+}
+
+// exitNotUpdated exits like exit once the update was not applied, because of err or a dry run. With -output json the
+// summary reports the results of the services left untouched
+func exitNotUpdated(err error, results []awsecs.ServiceResult) {
+	if summaryReport != nil {
+		summaryReport.writeSummary(awsecs.OutcomeNotUpdated, "", err, results)
+	}
+	exit(err)
+}
+
+// exitDryRun prints the plan of a dry run and exits like exitNotUpdated, with -output json the summary reports the plan
+// instead so stdout is left to the JSON records
+func exitDryRun(plan string, err error, results []awsecs.ServiceResult) {
+	if summaryReport != nil {
+		summaryReport.writeSummary(awsecs.OutcomeNotUpdated, plan, err, results)
+	} else {
+		fmt.Print(plan)
+	}
+	exit(err)
+}
+
+// fatalInput logs the invalid flag, file or value and exits with awsecs.ExitCodeInvalidInput, with -output json the
+// summary reports it
+func fatalInput(format string, v ...interface{}) {
+	err := fmt.Errorf(format, v...)
+	log.Print(err)
+	if summaryReport != nil {
+		summaryReport.writeSummary(awsecs.OutcomeNotUpdated, "", err, nil)
+	}
+	os.Exit(awsecs.ExitCodeInvalidInput)
+}
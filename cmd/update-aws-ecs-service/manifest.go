@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Autodesk/go-awsecs"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// manifest declares the deployment intent of a service, it mirrors the attributes of awsecs.ECSServiceUpdate
+type manifest struct {
+	Cluster          string                                  `json:"cluster" yaml:"cluster"`
+	Service          string                                  `json:"service" yaml:"service"`
+	Services         []string                                `json:"services" yaml:"services"`
+	Parallel         bool                                    `json:"parallel" yaml:"parallel"`
+	Images           map[string]string                       `json:"images" yaml:"images"`
+	Environment      map[string]map[string]string            `json:"environment" yaml:"environment"`
+	Secrets          map[string]map[string]string            `json:"secrets" yaml:"secrets"`
+	LogDriverOptions map[string]map[string]map[string]string `json:"logDriverOptions" yaml:"logDriverOptions"`
+	LogDriverSecrets map[string]map[string]map[string]string `json:"logDriverSecrets" yaml:"logDriverSecrets"`
+	TaskRole         string                                  `json:"taskRole" yaml:"taskRole"`
+	DesiredCount     *int64                                  `json:"desiredCount" yaml:"desiredCount"`
+	Taskdef          string                                  `json:"taskdef" yaml:"taskdef"`
+	WaitUntil        string                                  `json:"waitUntil" yaml:"waitUntil"`
+}
+
+// decodeFile decodes the JSON or YAML data of a kind of file, depending on the extension of its name, rejecting unknown
+// fields
+func decodeFile(kind, name string, data []byte, v interface{}) error {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(v); err != nil {
+			return err
+		}
+		if decoder.More() {
+			return fmt.Errorf("unexpected data after the %s object", kind)
+		}
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(data, v)
+	default:
+		return errors.New("unsupported extension, use .json, .yaml or .yml")
+	}
+	return nil
+}
+
+func parseManifest(name string, data []byte) (manifest, error) {
+	m := manifest{}
+	if err := decodeFile("manifest", name, data, &m); err != nil {
+		return manifest{}, fmt.Errorf("manifest %s: %w", name, err)
+	}
+	if err := m.validate(); err != nil {
+		return manifest{}, fmt.Errorf("manifest %s: %w", name, err)
+	}
+	return m, nil
+}
+
+func readManifest(name string) (manifest, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return manifest{}, err
+	}
+	return parseManifest(name, data)
+}
+
+func (m manifest) validate() error {
+	var problems []string
+	for container := range m.Images {
+		if container == "" {
+			problems = append(problems, "images: empty container name")
+		}
+	}
+	for attribute, containers := range map[string]map[string]map[string]string{"environment": m.Environment, "secrets": m.Secrets} {
+		for container, values := range containers {
+			if container == "" {
+				problems = append(problems, fmt.Sprintf("%s: empty container name", attribute))
+			}
+			for name := range values {
+				if name == "" {
+					problems = append(problems, fmt.Sprintf("%s: %s: empty name", attribute, container))
+				}
+			}
+		}
+	}
+	for attribute, containers := range map[string]map[string]map[string]map[string]string{"logDriverOptions": m.LogDriverOptions, "logDriverSecrets": m.LogDriverSecrets} {
+		for container, drivers := range containers {
+			if container == "" {
+				problems = append(problems, fmt.Sprintf("%s: empty container name", attribute))
+			}
+			for driver := range drivers {
+				if driver == "" {
+					problems = append(problems, fmt.Sprintf("%s: %s: empty log driver name", attribute, container))
+				}
+			}
+		}
+	}
+	if m.Service != "" && len(m.Services) > 0 {
+		problems = append(problems, "service and services are mutually exclusive")
+	}
+	for _, service := range m.Services {
+		if service == "" {
+			problems = append(problems, "services: empty service name")
+		}
+	}
+	if m.DesiredCount != nil && *m.DesiredCount < 0 {
+		problems = append(problems, fmt.Sprintf("desiredCount: must not be negative, got %d", *m.DesiredCount))
+	}
+	if m.WaitUntil != "" {
+		for _, waitUntil := range strings.Split(m.WaitUntil, ",") {
+			valid := false
+			for _, option := range awsecs.WaitUntilOptionList {
+				if strings.TrimSpace(waitUntil) == option {
+					valid = true
+				}
+			}
+			if !valid {
+				problems = append(problems, fmt.Sprintf("waitUntil: %q is not one of: %s", waitUntil, strings.Join(awsecs.WaitUntilOptionList, ", ")))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applyTo fills the attributes of the service update which were not set explicitly by command line flags
+func (m manifest) applyTo(esu *awsecs.ECSServiceUpdate, setFlags map[string]bool) {
+	if !setFlags["cluster"] && m.Cluster != "" {
+		esu.Cluster = m.Cluster
+	}
+	if !setFlags["service"] && m.Service != "" {
+		esu.Service = m.Service
+	}
+	if !setFlags["task-role"] && m.TaskRole != "" {
+		esu.TaskRole = m.TaskRole
+	}
+	if !setFlags["desired-count"] && m.DesiredCount != nil {
+		esu.DesiredCount = m.DesiredCount
+	}
+	if !setFlags["taskdef"] && m.Taskdef != "" {
+		esu.Taskdef = m.Taskdef
+	}
+	if !setFlags["wait-until"] && m.WaitUntil != "" {
+		esu.WaitUntil = &m.WaitUntil
+	}
+	for container, image := range m.Images {
+		if _, found := esu.Image[container]; !found {
+			esu.Image[container] = image
+		}
+	}
+	mergeMapMap(esu.Environment, m.Environment)
+	mergeMapMap(esu.Secrets, m.Secrets)
+	mergeMapMapMap(esu.LogDriverOptions, m.LogDriverOptions)
+	mergeMapMapMap(esu.LogDriverSecrets, m.LogDriverSecrets)
+}
+
+// applyServicesTo fills the services to update and whether to update them in parallel, unless set by command line flags
+func (m manifest) applyServicesTo(services *stringsFlag, parallel *bool, setFlags map[string]bool) {
+	if !setFlags["service"] && len(m.Services) > 0 {
+		*services = m.Services
+	}
+	if !setFlags["parallel"] && m.Parallel {
+		*parallel = true
+	}
+}
+
+func mergeMapMap(dst, src map[string]map[string]string) {
+	for key, values := range src {
+		if dst[key] == nil {
+			dst[key] = map[string]string{}
+		}
+		for valueKey, value := range values {
+			if _, found := dst[key][valueKey]; !found {
+				dst[key][valueKey] = value
+			}
+		}
+	}
+}
+
+func mergeMapMapMap(dst, src map[string]map[string]map[string]string) {
+	for key, values := range src {
+		if dst[key] == nil {
+			dst[key] = map[string]map[string]string{}
+		}
+		mergeMapMap(dst[key], values)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"github.com/Autodesk/go-awsecs"
+	"github.com/aws/aws-sdk-go/aws"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	want := manifest{
+		Cluster: "my-cluster",
+		Service: "my-service",
+		Images:  map[string]string{"app": "myrepo/myimg:newtag"},
+		Environment: map[string]map[string]string{
+			"app": {"PORT": "8080", "DEBUG": ""},
+		},
+		Secrets: map[string]map[string]string{
+			"app": {"TOKEN": "arn:aws:ssm:us-west-2:123456789012:parameter/token"},
+		},
+		LogDriverOptions: map[string]map[string]map[string]string{
+			"app": {"awslogs": {"awslogs-group": "/my/group"}},
+		},
+		TaskRole:     "None",
+		DesiredCount: aws.Int64(3),
+		WaitUntil:    awsecs.WaitUntilDrainingStarted,
+	}
+	yamlManifest := `
+cluster: my-cluster
+service: my-service
+images:
+  app: myrepo/myimg:newtag
+environment:
+  app:
+    PORT: 8080
+    DEBUG: ""
+secrets:
+  app:
+    TOKEN: arn:aws:ssm:us-west-2:123456789012:parameter/token
+logDriverOptions:
+  app:
+    awslogs:
+      awslogs-group: /my/group
+taskRole: None
+desiredCount: 3
+waitUntil: draining-started
+`
+	jsonManifest := `{
+  "cluster": "my-cluster",
+  "service": "my-service",
+  "images": {"app": "myrepo/myimg:newtag"},
+  "environment": {"app": {"PORT": "8080", "DEBUG": ""}},
+  "secrets": {"app": {"TOKEN": "arn:aws:ssm:us-west-2:123456789012:parameter/token"}},
+  "logDriverOptions": {"app": {"awslogs": {"awslogs-group": "/my/group"}}},
+  "taskRole": "None",
+  "desiredCount": 3,
+  "waitUntil": "draining-started"
+}`
+	for name, data := range map[string]string{"manifest.yaml": yamlManifest, "manifest.json": jsonManifest} {
+		got, err := parseManifest(name, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseManifest(%s) = %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		wantErr string
+	}{
+		{
+			name:    "unknown yaml field",
+			file:    "manifest.yml",
+			data:    "image:\n  app: myrepo/myimg:newtag\n",
+			wantErr: "field image not found",
+		},
+		{
+			name:    "unknown json field",
+			file:    "manifest.json",
+			data:    `{"image": {"app": "myrepo/myimg:newtag"}}`,
+			wantErr: `unknown field "image"`,
+		},
+		{
+			name:    "trailing json data",
+			file:    "manifest.json",
+			data:    `{} {}`,
+			wantErr: "unexpected data after the manifest object",
+		},
+		{
+			name:    "negative desired count",
+			file:    "manifest.yaml",
+			data:    "desiredCount: -1\n",
+			wantErr: "desiredCount: must not be negative",
+		},
+		{
+			name:    "invalid wait until",
+			file:    "manifest.yaml",
+			data:    "waitUntil: forever\n",
+			wantErr: `waitUntil: "forever" is not one of`,
+		},
+		{
+			name:    "empty container name",
+			file:    "manifest.yaml",
+			data:    "environment:\n  \"\":\n    PORT: 8080\n",
+			wantErr: "environment: empty container name",
+		},
+		{
+			name:    "service and services",
+			file:    "manifest.yaml",
+			data:    "service: api\nservices: [api, worker]\n",
+			wantErr: "service and services are mutually exclusive",
+		},
+		{
+			name:    "unsupported extension",
+			file:    "manifest.toml",
+			data:    "",
+			wantErr: "unsupported extension",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseManifest(tt.file, []byte(tt.data))
+			if err == nil {
+				t.Fatalf("parseManifest() expected error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) || !strings.HasPrefix(err.Error(), "manifest "+tt.file+": ") {
+				t.Errorf("parseManifest() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManifestApplyTo(t *testing.T) {
+	m := manifest{
+		Cluster: "manifest-cluster",
+		Service: "manifest-service",
+		Images:  map[string]string{"app": "manifest-image", "sidecar": "manifest-sidecar"},
+		Environment: map[string]map[string]string{
+			"app": {"PORT": "8080", "DEBUG": "1"},
+		},
+		LogDriverSecrets: map[string]map[string]map[string]string{
+			"app": {"splunk": {"splunk-token": "manifest-token"}},
+		},
+		DesiredCount: aws.Int64(3),
+		WaitUntil:    awsecs.WaitUntilDrainingStarted,
+	}
+	waitUntil := awsecs.WaitUntilPrimaryRolled
+	esu := awsecs.ECSServiceUpdate{
+		Cluster:          "flag-cluster",
+		Service:          "",
+		Image:            map[string]string{"app": "flag-image"},
+		Environment:      map[string]map[string]string{"app": {"DEBUG": ""}},
+		Secrets:          map[string]map[string]string{},
+		LogDriverOptions: map[string]map[string]map[string]string{},
+		LogDriverSecrets: map[string]map[string]map[string]string{},
+		DesiredCount:     aws.Int64(1),
+		WaitUntil:        &waitUntil,
+	}
+	m.applyTo(&esu, map[string]bool{"cluster": true, "desired-count": true})
+	want := awsecs.ECSServiceUpdate{
+		Cluster:          "flag-cluster",
+		Service:          "manifest-service",
+		Image:            map[string]string{"app": "flag-image", "sidecar": "manifest-sidecar"},
+		Environment:      map[string]map[string]string{"app": {"DEBUG": "", "PORT": "8080"}},
+		Secrets:          map[string]map[string]string{},
+		LogDriverOptions: map[string]map[string]map[string]string{},
+		LogDriverSecrets: map[string]map[string]map[string]string{"app": {"splunk": {"splunk-token": "manifest-token"}}},
+		DesiredCount:     aws.Int64(1),
+		WaitUntil:        aws.String(awsecs.WaitUntilDrainingStarted),
+	}
+	if !reflect.DeepEqual(esu, want) {
+		t.Errorf("applyTo() = %+v, want %+v", esu, want)
+	}
+}
+
+func TestManifestApplyServicesTo(t *testing.T) {
+	m := manifest{Services: []string{"api", "worker", "scheduler"}, Parallel: true}
+	var services stringsFlag
+	parallel := false
+	m.applyServicesTo(&services, &parallel, map[string]bool{})
+	if !reflect.DeepEqual(services, stringsFlag{"api", "worker", "scheduler"}) || !parallel {
+		t.Errorf("applyServicesTo() = %v, %v", services, parallel)
+	}
+	services, parallel = stringsFlag{"api"}, false
+	m.applyServicesTo(&services, &parallel, map[string]bool{"service": true, "parallel": true})
+	if !reflect.DeepEqual(services, stringsFlag{"api"}) || parallel {
+		t.Errorf("applyServicesTo() overrode the flags: %v, %v", services, parallel)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Autodesk/go-awsecs"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// serviceSummary the outcome of the update of a service in the summary of -output json
+type serviceSummary struct {
+	Cluster            string   `json:"cluster"`
+	Service            string   `json:"service"`
+	OldTaskDefinition  string   `json:"oldTaskDefinition,omitempty"`
+	NewTaskDefinition  string   `json:"newTaskDefinition,omitempty"`
+	DesiredCountBefore *int64   `json:"desiredCountBefore,omitempty"`
+	DesiredCountAfter  *int64   `json:"desiredCountAfter,omitempty"`
+	Outcome            string   `json:"outcome"`
+	Errors             []string `json:"errors,omitempty"` // The error chain, outermost first
+}
+
+// summary the last line of -output json
+type summary struct {
+	Type            string           `json:"type"` // Always "summary"
+	WaitUntil       string           `json:"waitUntil"`
+	DurationSeconds float64          `json:"durationSeconds"`
+	Outcome         string           `json:"outcome"`
+	Errors          []string         `json:"errors,omitempty"` // The error chain, outermost first
+	Plan            string           `json:"plan,omitempty"`   // The plan of -dry-run
+	Services        []serviceSummary `json:"services"`
+}
+
+// jsonReport writes the progress events as lines of JSON and keeps the updated services for the summary
+type jsonReport struct {
+	awsecs.JSONEventSink
+	waitUntil string
+	started   time.Time
+	mu        sync.Mutex
+	updates   map[string]awsecs.ServiceUpdated // Map of cluster/service and the update
+}
+
+func newJSONReport(w io.Writer, waitUntil string) *jsonReport {
+	return &jsonReport{
+		JSONEventSink: awsecs.JSONEventSink{Writer: w},
+		waitUntil:     waitUntil,
+		started:       time.Now(),
+		updates:       map[string]awsecs.ServiceUpdated{},
+	}
+}
+
+func (r *jsonReport) Emit(event awsecs.Event) {
+	if updated, ok := event.(awsecs.ServiceUpdated); ok {
+		r.mu.Lock()
+		r.updates[updated.Cluster+"/"+updated.Service] = updated
+		r.mu.Unlock()
+	}
+	r.JSONEventSink.Emit(event)
+}
+
+// summarize writes the summary of the results, err is the error of the whole update
+func (r *jsonReport) summarize(err error, results []awsecs.ServiceResult) {
+	r.writeSummary(outcome(err), "", err, results)
+}
+
+func (r *jsonReport) writeSummary(outcome, plan string, err error, results []awsecs.ServiceResult) {
+	s := summary{
+		Type:            "summary",
+		WaitUntil:       r.waitUntil,
+		DurationSeconds: time.Since(r.started).Seconds(),
+		Outcome:         outcome,
+		Errors:          errorChain(err),
+		Plan:            plan,
+		Services:        []serviceSummary{},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, result := range results {
+		service := serviceSummary{Cluster: result.Cluster, Service: result.Service, Outcome: result.Outcome, Errors: errorChain(result.Err)}
+		if updated, found := r.updates[result.Cluster+"/"+result.Service]; found {
+			service.OldTaskDefinition, service.NewTaskDefinition = updated.OldTaskDefinition, updated.TaskDefinition
+			service.DesiredCountBefore, service.DesiredCountAfter = &updated.OldDesiredCount, &updated.DesiredCount
+		}
+		s.Services = append(s.Services, service)
+	}
+	if err := json.NewEncoder(r.Writer).Encode(s); err != nil {
+		log.Printf("on JSON report while write summary: %v", err)
+	}
+}
+
+// updatedResult returns the result of an update of a single service
+func updatedResult(cluster, service string, err error) awsecs.ServiceResult {
+	return awsecs.ServiceResult{Cluster: cluster, Service: service, Outcome: outcome(err), Err: err}
+}
+
+// notUpdatedResults returns the results of the services of cluster left untouched, because of err or a dry run
+func notUpdatedResults(cluster string, services []string, err error) []awsecs.ServiceResult {
+	var results []awsecs.ServiceResult
+	for _, service := range services {
+		results = append(results, awsecs.ServiceResult{Cluster: cluster, Service: service, Outcome: awsecs.OutcomeNotUpdated, Err: err})
+	}
+	return results
+}
+
+// jsonReportOf returns the jsonReport of -output json receiving the events of sink, if any
+func jsonReportOf(sink awsecs.EventSink) (*jsonReport, bool) {
+	if collector, ok := sink.(*awsecs.MetricsCollector); ok {
+		sink = collector.Next
+	}
+	report, ok := sink.(*jsonReport)
+	return report, ok
+}
+
+// flushMetrics writes the metrics of -metrics collected by sink, if any, of an update which returned err. A failure to
+// write them is only logged
+func flushMetrics(sink awsecs.EventSink, err error) {
+	if collector, ok := sink.(*awsecs.MetricsCollector); ok {
+		if err := collector.Flush(outcome(err)); err != nil {
+			log.Printf("on metrics: %v", err)
+		}
+	}
+}
+
+// outcome returns the outcome of an update which returned err
+func outcome(err error) string {
+	switch {
+	case err == nil, errors.Is(err, awsecs.ErrPostSuccessHookFailed):
+		return awsecs.OutcomeSuccess
+	case errors.Is(err, awsecs.ErrFailedRollback):
+		return awsecs.OutcomeFailedRollback
+	case errors.Is(err, awsecs.ErrSuccessfulRollback):
+		return awsecs.OutcomeSuccessfulRollback
+	}
+	return awsecs.OutcomeNotUpdated
+}
+
+// errorChain returns the messages of err and of the errors it wraps, outermost first
+func errorChain(err error) []string {
+	var chain []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		chain = append(chain, err.Error())
+	}
+	return chain
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Autodesk/go-awsecs"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestJSONReport(t *testing.T) {
+	var buf bytes.Buffer
+	report := newJSONReport(&buf, "primary-rolled")
+	report.Emit(awsecs.ServiceUpdated{Cluster: "my-cluster", Service: "my-service", TaskDefinition: "my-family:2", DesiredCount: 3, OldTaskDefinition: "my-family:1", OldDesiredCount: 2})
+	report.Emit(awsecs.RollbackStarted{Service: "my-service", Cause: errors.New("not ready")})
+	report.summarize(awsecs.ErrSuccessfulRollback, []awsecs.ServiceResult{
+		updatedResult("my-cluster", "my-service", awsecs.ErrSuccessfulRollback),
+		{Cluster: "my-cluster", Service: "my-other-service", Outcome: awsecs.OutcomeNotUpdated, Err: fmt.Errorf("%w: not ready", awsecs.ErrOtherServiceFailed)},
+	})
+
+	scanner := bufio.NewScanner(&buf)
+	var types []string
+	var last []byte
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, record["type"].(string))
+		last = append([]byte{}, scanner.Bytes()...)
+	}
+	if want := []string{"ServiceUpdated", "RollbackStarted", "summary"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected records %v, got %v", want, types)
+	}
+	var s summary
+	if err := json.Unmarshal(last, &s); err != nil {
+		t.Fatal(err)
+	}
+	before, after := int64(2), int64(3)
+	want := summary{
+		Type:            "summary",
+		WaitUntil:       "primary-rolled",
+		DurationSeconds: s.DurationSeconds,
+		Outcome:         awsecs.OutcomeSuccessfulRollback,
+		Errors:          []string{awsecs.ErrSuccessfulRollback.Error()},
+		Services: []serviceSummary{
+			{Cluster: "my-cluster", Service: "my-service", OldTaskDefinition: "my-family:1", NewTaskDefinition: "my-family:2", DesiredCountBefore: &before, DesiredCountAfter: &after, Outcome: awsecs.OutcomeSuccessfulRollback, Errors: []string{awsecs.ErrSuccessfulRollback.Error()}},
+			{Cluster: "my-cluster", Service: "my-other-service", Outcome: awsecs.OutcomeNotUpdated, Errors: []string{awsecs.ErrOtherServiceFailed.Error() + ": not ready", awsecs.ErrOtherServiceFailed.Error()}},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("expected %+v, got %+v", want, s)
+	}
+}
+
+func TestJSONReportNotUpdated(t *testing.T) {
+	var buf bytes.Buffer
+	report := newJSONReport(&buf, "primary-rolled")
+	err := fmt.Errorf("metrics: %w", awsecs.ErrInvalidMetricsSink)
+	report.writeSummary(awsecs.OutcomeNotUpdated, "", err, notUpdatedResults("my-cluster", []string{"my-service"}, err))
+	var s summary
+	if err := json.Unmarshal(buf.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	chain := []string{"metrics: " + awsecs.ErrInvalidMetricsSink.Error(), awsecs.ErrInvalidMetricsSink.Error()}
+	want := []serviceSummary{{Cluster: "my-cluster", Service: "my-service", Outcome: awsecs.OutcomeNotUpdated, Errors: chain}}
+	if s.Outcome != awsecs.OutcomeNotUpdated || !reflect.DeepEqual(s.Errors, chain) || !reflect.DeepEqual(s.Services, want) {
+		t.Errorf("unexpected summary %+v", s)
+	}
+}
+
+func TestExitDryRunJSON(t *testing.T) {
+	defer func(report *jsonReport, stdout *os.File) {
+		summaryReport, os.Stdout = report, stdout
+	}(summaryReport, os.Stdout)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	summaryReport, os.Stdout = newJSONReport(&buf, "primary-rolled"), w
+	exitDryRun("--- my-family:1\n+++ my-family:2\n", nil, notUpdatedResults("my-cluster", []string{"my-service"}, nil))
+	w.Close()
+	stdout, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) != 0 {
+		t.Errorf("expected nothing printed besides the JSON records, got %q", stdout)
+	}
+	var s summary
+	if err := json.Unmarshal(buf.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Outcome != awsecs.OutcomeNotUpdated || s.Plan != "--- my-family:1\n+++ my-family:2\n" || len(s.Services) != 1 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, awsecs.OutcomeSuccess},
+		{fmt.Errorf("%w: exit status 1", awsecs.ErrPostSuccessHookFailed), awsecs.OutcomeSuccess},
+		{awsecs.ErrSuccessfulRollback, awsecs.OutcomeSuccessfulRollback},
+		{awsecs.ErrFailedRollback, awsecs.OutcomeFailedRollback},
+		{awsecs.ErrServiceNotFound, awsecs.OutcomeNotUpdated},
+	}
+	for _, tt := range tests {
+		if got := outcome(tt.err); got != tt.want {
+			t.Errorf("outcome(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFlushMetrics(t *testing.T) {
+	var events, metrics bytes.Buffer
+	report := newJSONReport(&events, "primary-rolled")
+	collector := awsecs.NewMetricsCollector(report, &awsecs.EMFSink{Writer: &metrics, Namespace: "go-awsecs"}, map[string]string{"service": "my-service"})
+	if got, ok := jsonReportOf(collector); !ok || got != report {
+		t.Fatalf("expected the JSON report behind the metrics collector, got %v", got)
+	}
+	collector.Emit(awsecs.RollbackStarted{Service: "my-service", Cause: errors.New("not ready")})
+	collector.Emit(awsecs.RollbackSucceeded{Service: "my-service"})
+	flushMetrics(collector, awsecs.ErrSuccessfulRollback)
+
+	if !bytes.Contains(events.Bytes(), []byte(`"type":"RollbackStarted"`)) {
+		t.Errorf("expected the event passed on, got %s", events.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(metrics.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["outcome"] != awsecs.OutcomeSuccessfulRollback || record["rollbacks"] != float64(1) {
+		t.Errorf("unexpected metrics %v", record)
+	}
+}
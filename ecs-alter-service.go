@@ -1,13 +1,16 @@
 package awsecs
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 	"github.com/cenkalti/backoff"
-	"log"
+	"strings"
+	"time"
 )
 
 var (
@@ -21,38 +24,186 @@ var (
 	ErrFailedRollback = errors.New("failed rollback")
 )
 
-type validateDeploymentFunc func(ecsiface.ECSAPI, elbv2iface.ELBV2API, ecs.Service, backoff.BackOff) error
+// RollbackError the deployment failed and the service was rolled back, errors.Is matches ErrSuccessfulRollback if the
+// rollback succeeded or ErrFailedRollback if it failed, and the errors wrapped by Cause and Err
+type RollbackError struct {
+	Cause      error       // Why the deployment failed
+	Err        error       // Why the rollback failed, nil if it succeeded
+	OldService ecs.Service // The service before the update, the rollback restores it
+	NewService ecs.Service // The service as updated
+}
 
-func alterServiceOrValidatedRollBack(ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, cluster, service string, imageMap map[string]string, envMaps map[string]map[string]string, secretMaps map[string]map[string]string, logopts map[string]map[string]map[string]string, logsecrets map[string]map[string]map[string]string, taskRole string, desiredCount *int64, taskdef string, bo backoff.BackOff, validateDeployment validateDeploymentFunc) error {
-	oldsvc, alterSvcErr := alterServiceValidateDeployment(ecsapi, elbv2api, cluster, service, imageMap, envMaps, secretMaps, logopts, logsecrets, taskRole, desiredCount, taskdef, bo, validateDeployment)
-	if alterSvcErr != nil {
-		operation := func() error {
-			if oldsvc.ServiceName == nil {
-				return ErrPermanentNothingToRollback
-			}
-			log.Printf("attempt rollback %v", alterSvcErr)
-			rollback, err := ecsapi.UpdateService(&ecs.UpdateServiceInput{Cluster: oldsvc.ClusterArn, Service: oldsvc.ServiceName, TaskDefinition: oldsvc.TaskDefinition, DesiredCount: oldsvc.DesiredCount, ForceNewDeployment: aws.Bool(true)})
+func (e *RollbackError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v: %v", ErrSuccessfulRollback, e.Cause)
+	}
+	return fmt.Sprintf("%v: %v, after: %v", ErrFailedRollback, e.Err, e.Cause)
+}
+
+// Is reports whether target is the sentinel of the outcome of the rollback or in the chain of Err
+func (e *RollbackError) Is(target error) bool {
+	if e.Err == nil {
+		return target == ErrSuccessfulRollback
+	}
+	return target == ErrFailedRollback || errors.Is(e.Err, target)
+}
+
+// Unwrap returns the cause of the rollback, Is and As look into Err as well
+func (e *RollbackError) Unwrap() error {
+	return e.Cause
+}
+
+// As finds the first error in the chain of Err matching target, if the rollback failed
+func (e *RollbackError) As(target interface{}) bool {
+	return e.Err != nil && errors.As(e.Err, target)
+}
+
+// errorList errors of independent operations, errors.Is and errors.As match any of them
+type errorList []error
+
+func (e errorList) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e errorList) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e errorList) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateDeploymentFunc validates a deployment of the service, returns nil once the deployment is considered
+// successful, a backoff.Permanent error to give up and roll back right away or any other error to be retried. The
+// service holds the PRIMARY deployment to validate, bo is the BackOff strategy of the update
+type ValidateDeploymentFunc func(context.Context, ecsiface.ECSAPI, elbv2iface.ELBV2API, ecs.Service, backoff.BackOff) error
+
+// detachedContext keeps the values of its parent but not the cancellation, so a rollback can complete even when the
+// deployment itself was cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+// rollBackService restores the task definition and desired count of oldsvc after cause, the failure of the deployment
+// of newsvc, and validates the rollback. CodeDeploy rolls back the services with the CODE_DEPLOY deployment controller.
+// Returns a *RollbackError or ErrNothingToRollback
+func rollBackService(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, codeDeploy *CodeDeploy, oldsvc, newsvc ecs.Service, cause error, bo backoff.BackOff, validateDeployment ValidateDeploymentFunc) error {
+	var err error
+	if isCodeDeployController(oldsvc) {
+		err = rollBackCodeDeploy(ctx, ecsapi, codeDeploy, oldsvc, newsvc, cause, bo)
+	} else {
+		err = rollBackECSService(ctx, ecsapi, elbv2api, oldsvc, cause, bo, validateDeployment)
+	}
+	if err == ErrNothingToRollback {
+		return err
+	}
+	if err != nil {
+		emit(ctx, RollbackFailed{Service: aws.StringValue(oldsvc.ServiceName)})
+	} else {
+		emit(ctx, RollbackSucceeded{Service: aws.StringValue(oldsvc.ServiceName)})
+	}
+	return &RollbackError{Cause: cause, Err: err, OldService: oldsvc, NewService: newsvc}
+}
+
+// rollBackECSService returns nil once the rollback passed the validation, ErrNothingToRollback or why it failed
+func rollBackECSService(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, oldsvc ecs.Service, cause error, bo backoff.BackOff, validateDeployment ValidateDeploymentFunc) error {
+	if oldsvc.ServiceName == nil {
+		return ErrNothingToRollback
+	}
+	// ECS owns a circuit breaker rollback, wait for it instead of deploying the old task definition again
+	awaited := errors.Is(cause, ErrCircuitBreakerRollback)
+	// emitted once, the operation below is retried
+	emit(ctx, RollbackStarted{Service: *oldsvc.ServiceName, Cause: cause, Awaited: awaited})
+	operation := func() error {
+		var rollback *ecs.Service
+		if awaited {
+			svc, err := describeCircuitBreakerRollback(ctx, ecsapi, oldsvc)
 			if err != nil {
 				return err
 			}
-			var prevErr error
-			operation := func() error {
-				err := validateDeployment(ecsapi, elbv2api, *rollback.Service, bo)
-				if err != prevErr && err != nil {
-					prevErr = err
-					log.Print(err)
-				}
+			rollback = svc
+		} else {
+			output, err := ecsapi.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{Cluster: oldsvc.ClusterArn, Service: oldsvc.ServiceName, TaskDefinition: oldsvc.TaskDefinition, DesiredCount: oldsvc.DesiredCount, ForceNewDeployment: aws.Bool(true)})
+			if err != nil {
 				return err
 			}
-			return backoff.Retry(operation, bo)
+			rollback = output.Service
 		}
-		if err := backoff.Retry(operation, bo); err != nil {
-			if err == ErrNothingToRollback {
-				return alterSvcErr
+		var prevErr error
+		attempt := 0
+		operation := func() error {
+			err := validateDeployment(ctx, ecsapi, elbv2api, *rollback, bo)
+			attempt++
+			emit(ctx, validationAttempt(*rollback, attempt, err, prevErr))
+			if err != nil {
+				prevErr = err
 			}
-			return ErrFailedRollback
+			return err
+		}
+		// backoff.Retry unwraps permanent errors, a validation failing permanently would attempt the rollback again
+		if err := backoff.Retry(operation, bo); err != nil {
+			return backoff.Permanent(err)
+		}
+		return nil
+	}
+	return backoff.Retry(operation, bo)
+}
+
+func alterServiceOrValidatedRollBack(ctx context.Context, e *ECSServiceUpdate, validateDeployment, validateRollback ValidateDeploymentFunc) error {
+	oldsvc, newsvc, alterSvcErr := alterServiceValidateDeployment(ctx, e, validateDeployment)
+	if alterSvcErr != nil {
+		rollbackCtx := detachedContext{parent: ctx}
+		rollbackErr := rollBackService(rollbackCtx, e.EcsApi, e.ElbApi, e.CodeDeploy, oldsvc, newsvc, alterSvcErr, e.BackOff, validateRollback)
+		if rollbackErr == ErrNothingToRollback {
+			return alterSvcErr
 		}
-		return ErrSuccessfulRollback
+		// the rollback outcome is what matters, a failing post-rollback hook is only emitted
+		outcome := rollbackOutcome(rollbackErr)
+		if err := runHooks(rollbackCtx, e.EcsApi, oldsvc, e.PostRollbackHooks, hookEnv(oldsvc, newsvc, outcome)); err != nil {
+			emit(rollbackCtx, PostRollbackHooksFailed{Service: e.Service, Outcome: outcome, Err: err})
+		}
+		return rollbackErr
+	}
+	// the deployment is validated, a failing post-success hook doesn't roll it back
+	if err := runHooks(ctx, e.EcsApi, newsvc, e.PostSuccessHooks, hookEnv(oldsvc, newsvc, OutcomeSuccess)); err != nil {
+		return fmt.Errorf("%w: %v", ErrPostSuccessHookFailed, err)
+	}
+	return nil
+}
+
+func rollbackOutcome(rollbackErr error) string {
+	if errors.Is(rollbackErr, ErrSuccessfulRollback) {
+		return OutcomeSuccessfulRollback
 	}
-	return alterSvcErr
+	return OutcomeFailedRollback
 }
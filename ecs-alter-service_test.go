@@ -0,0 +1,293 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"testing"
+)
+
+type mockDeployEcsClient struct {
+	ecsiface.ECSAPI
+	service       *ecs.Service
+	deployments   int
+	updateInputs  []*ecs.UpdateServiceInput
+	registerInput *ecs.RegisterTaskDefinitionInput
+	tasks         map[string][]*ecs.Task // Map of desired status and tasks
+	afterUpdate   func(svc *ecs.Service) // If non nil alters the service as seen after the update response
+	lostUpdates   int                    // Updates applied whose response is lost, the update fails nonetheless
+}
+
+func newMockDeployEcsClient() *mockDeployEcsClient {
+	return &mockDeployEcsClient{
+		service: &ecs.Service{
+			ClusterArn:     aws.String("arn:aws:ecs:us-west-2:123456789012:cluster/my-cluster"),
+			ServiceArn:     aws.String("arn:aws:ecs:us-west-2:123456789012:service/my-cluster/my-service"),
+			ServiceName:    aws.String("my-service"),
+			TaskDefinition: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1"),
+			DesiredCount:   aws.Int64(2),
+			RunningCount:   aws.Int64(2),
+			Deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/0"), Status: aws.String("PRIMARY")},
+			},
+		},
+	}
+}
+
+func (m *mockDeployEcsClient) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	obj := panicMarshal(m.service)
+	svc := ecs.Service{}
+	panicUnmarshal(obj, &svc)
+	return &ecs.DescribeServicesOutput{Services: []*ecs.Service{&svc}}, nil
+}
+
+func (m *mockDeployEcsClient) DescribeTaskDefinitionWithContext(ctx aws.Context, input *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{
+			TaskDefinitionArn: input.TaskDefinition,
+			Family:            aws.String("my-family"),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("my-container"), Image: aws.String("myrepo/myimg:oldtag")},
+			},
+		},
+	}, nil
+}
+
+func (m *mockDeployEcsClient) RegisterTaskDefinitionWithContext(ctx aws.Context, input *ecs.RegisterTaskDefinitionInput, opts ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.registerInput = input
+	return &ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{
+			TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"),
+		},
+	}, nil
+}
+
+func (m *mockDeployEcsClient) UpdateServiceWithContext(ctx aws.Context, input *ecs.UpdateServiceInput, opts ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.updateInputs = append(m.updateInputs, input)
+	m.deployments++
+	m.service.TaskDefinition = input.TaskDefinition
+	m.service.DesiredCount = input.DesiredCount
+	m.service.RunningCount = input.DesiredCount
+	m.service.Deployments = []*ecs.Deployment{
+		{Id: aws.String(fmt.Sprintf("ecs-svc/%d", m.deployments)), Status: aws.String("PRIMARY"), TaskDefinition: input.TaskDefinition, RolloutState: aws.String(ecs.DeploymentRolloutStateCompleted)},
+	}
+	output, err := m.DescribeServicesWithContext(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.afterUpdate != nil {
+		m.afterUpdate(m.service)
+	}
+	if m.lostUpdates > 0 {
+		m.lostUpdates--
+		return nil, context.DeadlineExceeded
+	}
+	return &ecs.UpdateServiceOutput{Service: output.Services[0]}, nil
+}
+
+func (m *mockDeployEcsClient) ListTasksPagesWithContext(ctx aws.Context, input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool, opts ...request.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	output := &ecs.ListTasksOutput{}
+	for _, task := range m.tasks[*input.DesiredStatus] {
+		if input.StartedBy == nil || *input.StartedBy == *task.StartedBy {
+			output.TaskArns = append(output.TaskArns, task.TaskArn)
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m *mockDeployEcsClient) DescribeTasksWithContext(ctx aws.Context, input *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	output := &ecs.DescribeTasksOutput{}
+	for _, taskArn := range input.Tasks {
+		for _, tasks := range m.tasks {
+			for _, task := range tasks {
+				if *task.TaskArn == *taskArn {
+					output.Tasks = append(output.Tasks, task)
+				}
+			}
+		}
+	}
+	return output, nil
+}
+
+func TestAlterServiceOrValidatedRollBack(t *testing.T) {
+	api := newMockDeployEcsClient()
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo}, validateDeployment, validateDeployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.updateInputs) != 1 {
+		t.Fatalf("expected 1 update, got %d", len(api.updateInputs))
+	}
+	if *api.updateInputs[0].TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+		t.Errorf("unexpected task definition %s", *api.updateInputs[0].TaskDefinition)
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackCancelled(t *testing.T) {
+	api := newMockDeployEcsClient()
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	validate := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		cancel()
+		return validateDeployment(ctx, ecsapi, elbv2api, svc, bo)
+	}
+	err := alterServiceOrValidatedRollBack(ctx, &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo}, validate, validate)
+	if !errors.Is(err, ErrSuccessfulRollback) {
+		t.Fatalf("expected %v, got %v", ErrSuccessfulRollback, err)
+	}
+	if len(api.updateInputs) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(api.updateInputs))
+	}
+	if *api.updateInputs[1].TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" {
+		t.Errorf("unexpected rollback task definition %s", *api.updateInputs[1].TaskDefinition)
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	cancel()
+	detached := detachedContext{parent: ctx}
+	if detached.Err() != nil {
+		t.Errorf("detached context must not be cancelled")
+	}
+	if detached.Value(key{}) != "value" {
+		t.Errorf("detached context must keep the parent values")
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackContainerNotFound(t *testing.T) {
+	api := newMockDeployEcsClient()
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-other-container": "myrepo/myimg:newtag"}, BackOff: bo}, validateDeployment, validateDeployment)
+	if !errors.Is(err, ErrContainerNotFound) {
+		t.Fatalf("expected %v, got %v", ErrContainerNotFound, err)
+	}
+	if len(api.updateInputs) != 0 || api.registerInput != nil {
+		t.Errorf("the service must be left untouched")
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackLostUpdate(t *testing.T) {
+	api := newMockDeployEcsClient()
+	api.lostUpdates = 1
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo}, validateDeployment, validateDeployment)
+	if !errors.Is(err, ErrSuccessfulRollback) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v after %v, got %v", ErrSuccessfulRollback, context.DeadlineExceeded, err)
+	}
+	if len(api.updateInputs) != 2 || *api.updateInputs[1].TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" {
+		t.Errorf("expected the update rolled back to the old task definition, got %v", api.updateInputs)
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackPermanentRollbackFailure(t *testing.T) {
+	api := newMockDeployEcsClient()
+	validate := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		return backoff.Permanent(errors.New("never valid"))
+	}
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo}, validate, validate)
+	if !errors.Is(err, ErrFailedRollback) {
+		t.Fatalf("expected %v, got %v", ErrFailedRollback, err)
+	}
+	// a permanent failure of the validation of the rollback must not attempt the rollback again
+	if len(api.updateInputs) != 2 {
+		t.Errorf("expected the update and a single rollback, got %d updates", len(api.updateInputs))
+	}
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || rollbackErr.Cause == nil || rollbackErr.Err == nil || rollbackErr.Err.Error() != "never valid" {
+		t.Fatalf("expected the deployment and the rollback failures, got %#v", err)
+	}
+	if aws.StringValue(rollbackErr.NewService.TaskDefinition) == aws.StringValue(rollbackErr.OldService.TaskDefinition) {
+		t.Errorf("expected the old and the new service, got %v", rollbackErr)
+	}
+}
+
+func TestRollbackError(t *testing.T) {
+	cause := fmt.Errorf("%w: not ready", ErrOtherServiceFailed)
+	tests := []struct {
+		name    string
+		err     *RollbackError
+		is      error
+		isNot   error
+		message string
+	}{
+		{
+			name:    "successful",
+			err:     &RollbackError{Cause: cause},
+			is:      ErrSuccessfulRollback,
+			isNot:   ErrFailedRollback,
+			message: "successful rollback: the deployment of another service failed: not ready",
+		},
+		{
+			name:    "failed",
+			err:     &RollbackError{Cause: cause, Err: errors.New("never valid")},
+			is:      ErrFailedRollback,
+			isNot:   ErrSuccessfulRollback,
+			message: "failed rollback: never valid, after: the deployment of another service failed: not ready",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error = fmt.Errorf("on deploy: %w", tt.err)
+			if !errors.Is(err, tt.is) || errors.Is(err, tt.isNot) {
+				t.Errorf("expected %v to be %v and not %v", err, tt.is, tt.isNot)
+			}
+			if !errors.Is(err, ErrOtherServiceFailed) {
+				t.Errorf("expected %v to wrap the cause", err)
+			}
+			var rollbackErr *RollbackError
+			if !errors.As(err, &rollbackErr) || rollbackErr != tt.err {
+				t.Errorf("expected %v as RollbackError", err)
+			}
+			if tt.err.Error() != tt.message {
+				t.Errorf("expected %q, got %q", tt.message, tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestRollbackErrorRollbackFailure(t *testing.T) {
+	failedTasks := &FailedTasksError{}
+	var err error = fmt.Errorf("on deploy: %w", &RollbackError{Cause: errNotReady, Err: fmt.Errorf("on validate rollback: %w", failedTasks)})
+	if !errors.Is(err, ErrFailedRollback) || !errors.Is(err, errNotReady) || !errors.Is(err, ErrTasksFailing) {
+		t.Errorf("expected %v to be the failed rollback, its cause and the rollback failure", err)
+	}
+	var got *FailedTasksError
+	if !errors.As(err, &got) || got != failedTasks {
+		t.Errorf("expected the rollback failure of %v as FailedTasksError", err)
+	}
+	if err := (&RollbackError{Cause: errNotReady, Err: context.DeadlineExceeded}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+	if err := (&RollbackError{Cause: errNotReady}); errors.As(err, &got) || errors.Is(err, ErrFailedRollback) {
+		t.Errorf("expected a successful rollback, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package awsecs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"github.com/cenkalti/backoff"
 	"log"
 	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -36,6 +38,10 @@ var (
 	ErrServiceDeletedAfterUpdate = backoff.Permanent(errors.New("the service was deleted after the update"))
 	// ErrContainerInstanceNotFound the container instance was removed from the cluster elsewhere
 	ErrContainerInstanceNotFound = backoff.Permanent(errors.New("container instance not found"))
+	// ErrASGNotFound trying to enforce the launch configuration of an auto scaling group that doesn't exist
+	ErrASGNotFound = errors.New("asg not found")
+	// ErrContainerNotFound the task definition doesn't have a container with the requested name
+	ErrContainerNotFound = errors.New("container not found in the task definition")
 	// ErrLoadBalancerNotConfigured the service doesn't have a load balancer configured
 	ErrLoadBalancerNotConfigured = backoff.Permanent(errors.New("the service was deleted after the update"))
 )
@@ -57,21 +63,19 @@ func copyTd(input ecs.TaskDefinition, tags []*ecs.Tag) ecs.RegisterTaskDefinitio
 	inputClone := ecs.TaskDefinition{}
 	panicUnmarshal(obj, &inputClone)
 	output := ecs.RegisterTaskDefinitionInput{}
-	// TODO: replace with reflection
-	output.ContainerDefinitions = inputClone.ContainerDefinitions
-	output.Cpu = inputClone.Cpu
-	output.ExecutionRoleArn = inputClone.ExecutionRoleArn
-	output.Family = inputClone.Family
-	output.InferenceAccelerators = inputClone.InferenceAccelerators
-	output.IpcMode = inputClone.IpcMode
-	output.Memory = inputClone.Memory
-	output.NetworkMode = inputClone.NetworkMode
-	output.PidMode = inputClone.PidMode
-	output.PlacementConstraints = inputClone.PlacementConstraints
-	output.ProxyConfiguration = inputClone.ProxyConfiguration
-	output.RequiresCompatibilities = inputClone.RequiresCompatibilities
-	output.TaskRoleArn = inputClone.TaskRoleArn
-	output.Volumes = inputClone.Volumes
+	source := reflect.ValueOf(inputClone)
+	target := reflect.ValueOf(&output).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		sourceField, found := source.Type().FieldByName(field.Name)
+		if !found || sourceField.Type != field.Type {
+			continue
+		}
+		target.Field(i).Set(source.FieldByIndex(sourceField.Index))
+	}
 	// can't be replaced with reflection
 	output.Tags = ifEmptyThenNil(tags)
 	return output
@@ -167,37 +171,87 @@ func alterSecret(copy ecs.ContainerDefinition, secretMap map[string]string) ecs.
 	return copy
 }
 
-func copyTaskDef(api ecsiface.ECSAPI, taskdef string, imageMap map[string]string, envMaps map[string]map[string]string, secretMaps map[string]map[string]string, logopts map[string]map[string]map[string]string, logsecrets map[string]map[string]map[string]string, taskRole string) (string, error) {
-	output, err := api.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(taskdef)})
-	if err != nil {
-		return "", fmt.Errorf("on copy task definition while describe existing task definition: %w", err)
-	}
-
-	asRegisterTaskDefinitionInput := copyTd(*output.TaskDefinition, output.Tags)
-	tdCopy := alterImages(asRegisterTaskDefinitionInput, imageMap)
+func alterTaskDefinition(copy ecs.RegisterTaskDefinitionInput, imageMap map[string]string, envMaps map[string]map[string]string, secretMaps map[string]map[string]string, logopts map[string]map[string]map[string]string, logsecrets map[string]map[string]map[string]string, taskRole string) ecs.RegisterTaskDefinitionInput {
+	tdCopy := alterImages(copy, imageMap)
 	tdCopy = alterEnvironments(tdCopy, envMaps)
 	tdCopy = alterSecrets(tdCopy, secretMaps)
 	tdCopy = alterLogConfigurations(tdCopy, logopts, logsecrets)
 	tdCopy = alterTaskRole(tdCopy, taskRole)
+	return tdCopy
+}
 
+func checkContainerNames(td ecs.RegisterTaskDefinitionInput, imageMap map[string]string) error {
+	var notFound []string
+	for name := range imageMap {
+		found := false
+		for _, containerDefinition := range td.ContainerDefinitions {
+			if containerDefinition.Name != nil && *containerDefinition.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			notFound = append(notFound, name)
+		}
+	}
+	if len(notFound) > 0 {
+		sort.Strings(notFound)
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, strings.Join(notFound, ", "))
+	}
+	return nil
+}
+
+// newTaskDefinitionInput describes taskdef and returns its ARN and its register input, as is and altered by the update.
+// The plan and the update of the service both build the new task definition with it
+func newTaskDefinitionInput(ctx context.Context, e *ECSServiceUpdate, taskdef string) (string, ecs.RegisterTaskDefinitionInput, ecs.RegisterTaskDefinitionInput, error) {
+	output, err := e.EcsApi.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(taskdef)})
+	if err != nil {
+		return "", ecs.RegisterTaskDefinitionInput{}, ecs.RegisterTaskDefinitionInput{}, fmt.Errorf("on new task definition while describe existing task definition: %w", err)
+	}
+
+	asRegisterTaskDefinitionInput := copyTd(*output.TaskDefinition, output.Tags)
+	if err := checkContainerNames(asRegisterTaskDefinitionInput, e.Image); err != nil {
+		return "", ecs.RegisterTaskDefinitionInput{}, ecs.RegisterTaskDefinitionInput{}, err
+	}
+	tdCopy := alterTaskDefinition(asRegisterTaskDefinitionInput, e.Image, e.Environment, e.Secrets, e.LogDriverOptions, e.LogDriverSecrets, e.TaskRole)
+	if e.ImageResolver != nil {
+		tdCopy, err = pinImageDigests(ctx, tdCopy, e.ImageResolver)
+		if err != nil {
+			return "", ecs.RegisterTaskDefinitionInput{}, ecs.RegisterTaskDefinitionInput{}, fmt.Errorf("on new task definition while pin image digests: %w", err)
+		}
+	}
+	return aws.StringValue(output.TaskDefinition.TaskDefinitionArn), asRegisterTaskDefinitionInput, tdCopy, nil
+}
+
+func copyTaskDef(ctx context.Context, e *ECSServiceUpdate, taskdef string) (string, error) {
+	taskDefinitionArn, asRegisterTaskDefinitionInput, tdCopy, err := newTaskDefinitionInput(ctx, e, taskdef)
+	if err != nil {
+		return "", err
+	}
 	if reflect.DeepEqual(asRegisterTaskDefinitionInput, tdCopy) {
-		return *output.TaskDefinition.TaskDefinitionArn, nil
+		return taskDefinitionArn, nil
 	}
-	tdNew, err := api.RegisterTaskDefinition(&tdCopy)
+	tdNew, err := e.EcsApi.RegisterTaskDefinitionWithContext(ctx, &tdCopy)
 	if err != nil {
 		return "", fmt.Errorf("on copy task definition while register new task definition: %w", err)
 	}
-	taskDefinitionArn := tdNew.TaskDefinition.TaskDefinitionArn
-	return *taskDefinitionArn, nil
+	newTaskDefinitionArn := tdNew.TaskDefinition.TaskDefinitionArn
+	emit(ctx, TaskDefinitionRegistered{SourceTaskDefinition: taskdef, TaskDefinition: *newTaskDefinitionArn})
+	return *newTaskDefinitionArn, nil
 }
 
-func alterService(api ecsiface.ECSAPI, cluster, service string, imageMap map[string]string, envMaps map[string]map[string]string, secretMaps map[string]map[string]string, logopts map[string]map[string]map[string]string, logsecrets map[string]map[string]map[string]string, taskRole string, desiredCount *int64, taskdef string) (ecs.Service, ecs.Service, error) {
-	output, err := api.DescribeServices(&ecs.DescribeServicesInput{Cluster: aws.String(cluster), Services: []*string{aws.String(service)}})
+func alterService(ctx context.Context, e *ECSServiceUpdate) (ecs.Service, ecs.Service, error) {
+	api, cluster, service := e.EcsApi, e.Cluster, e.Service
+	output, err := api.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(cluster), Services: []*string{aws.String(service)}})
 	if err != nil {
 		return ecs.Service{}, ecs.Service{}, fmt.Errorf("on alter service while describe service: %w", err)
 	}
 	copyTaskDefinitionAction := func(sourceTaskDefinition string) (string, error) {
-		return copyTaskDef(api, sourceTaskDefinition, imageMap, envMaps, secretMaps, logopts, logsecrets, taskRole)
+		newTaskDefinition, err := copyTaskDef(ctx, e, sourceTaskDefinition)
+		if err != nil || e.PreDeployTask == nil {
+			return newTaskDefinition, err
+		}
+		// only called once the service was found
+		return newTaskDefinition, runPreDeployTask(ctx, api, *output.Services[0], newTaskDefinition, *e.PreDeployTask)
 	}
 	updateAction := func(newTaskDefinition *string, desiredCount *int64) (*ecs.UpdateServiceOutput, error) {
 		updateServiceInput := &ecs.UpdateServiceInput{
@@ -207,9 +261,35 @@ func alterService(api ecsiface.ECSAPI, cluster, service string, imageMap map[str
 			DesiredCount:       desiredCount,
 			ForceNewDeployment: aws.Bool(true),
 		}
-		return api.UpdateService(updateServiceInput)
+		return api.UpdateServiceWithContext(ctx, updateServiceInput)
+	}
+	if len(output.Services) > 0 && isCodeDeployController(*output.Services[0]) {
+		// the task definition of a CODE_DEPLOY service can't be updated, CodeDeploy deploys it
+		if e.CodeDeploy == nil {
+			return ecs.Service{}, ecs.Service{}, ErrCodeDeployRequired
+		}
+		updateAction = func(newTaskDefinition *string, desiredCount *int64) (*ecs.UpdateServiceOutput, error) {
+			return createCodeDeployDeployment(ctx, api, e.CodeDeploy, cluster, service, *output.Services[0], *newTaskDefinition, desiredCount)
+		}
+	}
+	updateSent := false
+	sendUpdate := func(newTaskDefinition *string, desiredCount *int64) (*ecs.UpdateServiceOutput, error) {
+		updateSent = true
+		return updateAction(newTaskDefinition, desiredCount)
+	}
+	oldsvc, newsvc, err := findAndUpdateService(output, cluster, service, e.Taskdef, e.DesiredCount, copyTaskDefinitionAction, sendUpdate)
+	if err != nil && !updateSent {
+		// the service was not updated, there is nothing to roll back
+		return ecs.Service{}, ecs.Service{}, err
+	}
+	if err == nil {
+		event := ServiceUpdated{Cluster: cluster, Service: service, TaskDefinition: aws.StringValue(newsvc.TaskDefinition), DesiredCount: aws.Int64Value(newsvc.DesiredCount), OldTaskDefinition: aws.StringValue(oldsvc.TaskDefinition), OldDesiredCount: aws.Int64Value(oldsvc.DesiredCount)}
+		if deployment := primaryDeployment(newsvc); deployment != nil {
+			event.TaskDefinition, event.DeploymentId = aws.StringValue(deployment.TaskDefinition), aws.StringValue(deployment.Id)
+		}
+		emit(ctx, event)
 	}
-	return findAndUpdateService(output, cluster, service, taskdef, desiredCount, copyTaskDefinitionAction, updateAction)
+	return oldsvc, newsvc, err
 }
 
 func findAndUpdateService(output *ecs.DescribeServicesOutput, cluster, service, taskDefinition string, desiredCount *int64, copyTdAction func(string) (string, error), updateSvcAction func(*string, *int64) (*ecs.UpdateServiceOutput, error)) (ecs.Service, ecs.Service, error) {
@@ -225,10 +305,14 @@ func findAndUpdateService(output *ecs.DescribeServicesOutput, cluster, service,
 	return updateService(parsedClusterArn, svc, cluster, service, taskDefinition, desiredCount, copyTdAction, updateSvcAction)
 }
 
-func updateService(parsedClusterArn arn.ARN, svc *ecs.Service, cluster, service, td string, desiredCount *int64, copyTdAction func(string) (string, error), updateSvcAction func(*string, *int64) (*ecs.UpdateServiceOutput, error)) (ecs.Service, ecs.Service, error) {
+func matchService(parsedClusterArn arn.ARN, svc *ecs.Service, cluster, service string) bool {
 	clusterNameFound := strings.TrimPrefix(parsedClusterArn.Resource, "cluster/")
 	serviceNameFound := *svc.ServiceName
-	if clusterNameFound == cluster && serviceNameFound == service {
+	return clusterNameFound == cluster && serviceNameFound == service
+}
+
+func updateService(parsedClusterArn arn.ARN, svc *ecs.Service, cluster, service, td string, desiredCount *int64, copyTdAction func(string) (string, error), updateSvcAction func(*string, *int64) (*ecs.UpdateServiceOutput, error)) (ecs.Service, ecs.Service, error) {
+	if matchService(parsedClusterArn, svc, cluster, service) {
 		srcTaskDef := svc.TaskDefinition
 		if td != "" {
 			srcTaskDef = &td
@@ -256,8 +340,8 @@ func mapStringStringAsJson(input map[string]string) string {
 	return strings.TrimSpace(buf.String())
 }
 
-func getTargetStates(targetGroupArn string, elbv2api elbv2iface.ELBV2API) (map[string]string, error) {
-	describeLbOutput, err := elbv2api.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+func getTargetStates(ctx context.Context, targetGroupArn string, elbv2api elbv2iface.ELBV2API) (map[string]string, error) {
+	describeLbOutput, err := elbv2api.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
 		TargetGroupArn: aws.String(targetGroupArn),
 	})
 	if err != nil {
@@ -272,8 +356,41 @@ func getTargetStates(targetGroupArn string, elbv2api elbv2iface.ELBV2API) (map[s
 	return targetStates, nil
 }
 
-func validateDraining(ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
-	describeEcsOutput, err := ecsapi.DescribeServices(&ecs.DescribeServicesInput{Cluster: ecsService.ClusterArn, Services: []*string{ecsService.ServiceName}})
+// serviceTargetGroupArns returns the distinct target groups attached to the service, in configuration order
+func serviceTargetGroupArns(service ecs.Service) []string {
+	var targetGroupArns []string
+	found := map[string]bool{}
+	for _, loadBalancer := range service.LoadBalancers {
+		if loadBalancer.TargetGroupArn == nil || found[*loadBalancer.TargetGroupArn] {
+			continue
+		}
+		found[*loadBalancer.TargetGroupArn] = true
+		targetGroupArns = append(targetGroupArns, *loadBalancer.TargetGroupArn)
+	}
+	return targetGroupArns
+}
+
+func targetGroupDraining(ctx context.Context, targetGroupArn string, initialTargetIdState, newTargetIdState map[string]string) bool {
+	for targetId, initialTargetState := range initialTargetIdState {
+		newTargetState := newTargetIdState[targetId]
+		if initialTargetState != newTargetState && newTargetState == elbv2.TargetHealthStateEnumDraining {
+			emit(ctx, TargetStateChanged{TargetGroupArn: targetGroupArn, TargetId: targetId, State: newTargetState})
+			return true
+		}
+	}
+
+	for targetId := range initialTargetIdState {
+		if _, found := newTargetIdState[targetId]; found {
+			return false
+		}
+	}
+
+	emit(ctx, TargetStateChanged{TargetGroupArn: targetGroupArn, State: elbv2.TargetHealthStateEnumDraining})
+	return true
+}
+
+func validateDraining(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
+	describeEcsOutput, err := ecsapi.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: ecsService.ClusterArn, Services: []*string{ecsService.ServiceName}})
 
 	if err != nil {
 		return backoff.Permanent(fmt.Errorf("on validate draining while describe service: %w", err))
@@ -281,59 +398,54 @@ func validateDraining(ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsS
 	if len(describeEcsOutput.Services) == 0 {
 		return backoff.Permanent(ErrServiceNotFound)
 	}
-	service := describeEcsOutput.Services[0]
-	if len(service.LoadBalancers) == 0 {
+	targetGroupArns := serviceTargetGroupArns(*describeEcsOutput.Services[0])
+	if len(targetGroupArns) == 0 {
 		return ErrLoadBalancerNotConfigured
 	}
-	loadBalancer := service.LoadBalancers[0]
-	targetGroupArn := loadBalancer.TargetGroupArn
-
-	initialTargetIdState, err := getTargetStates(*targetGroupArn, elbv2api)
-	if err != nil {
-		return backoff.Permanent(err)
-	}
-
-	initTargetState := mapStringStringAsJson(initialTargetIdState)
-	log.Printf("Initial target states: '%s'", initTargetState)
-
-	operation := func() error {
-		newTargetIdState, err := getTargetStates(*targetGroupArn, elbv2api)
 
+	initialTargetIdStates := map[string]map[string]string{}
+	for _, targetGroupArn := range targetGroupArns {
+		initialTargetIdState, err := getTargetStates(ctx, targetGroupArn, elbv2api)
 		if err != nil {
-			log.Print(err)
-			return err
+			return backoff.Permanent(err)
 		}
+		initialTargetIdStates[targetGroupArn] = initialTargetIdState
+		emit(ctx, TargetStates{TargetGroupArn: targetGroupArn, States: initialTargetIdState, Initial: true})
+	}
 
-		newTargetState := mapStringStringAsJson(newTargetIdState)
-		log.Printf("Waiting for targets transitioning to draining state: '%s'", newTargetState)
+	drained := map[string]bool{}
+	operation := func() error {
+		var waiting []string
+		for _, targetGroupArn := range targetGroupArns {
+			if drained[targetGroupArn] {
+				continue
+			}
+			newTargetIdState, err := getTargetStates(ctx, targetGroupArn, elbv2api)
 
-		for targetId, initialTargetState := range initialTargetIdState {
-			newTargetState := newTargetIdState[targetId]
-			if initialTargetState != newTargetState && newTargetState == elbv2.TargetHealthStateEnumDraining {
-				log.Printf("The target '%s' transitioned to draining state", targetId)
-				return nil
+			if err != nil {
+				log.Print(err)
+				return err
 			}
-		}
 
-		allInitialTargetsGone := true
-		for targetId := range initialTargetIdState {
-			if _, found := newTargetIdState[targetId]; found {
-				allInitialTargetsGone = false
+			emit(ctx, TargetStates{TargetGroupArn: targetGroupArn, States: newTargetIdState})
+
+			if targetGroupDraining(ctx, targetGroupArn, initialTargetIdStates[targetGroupArn], newTargetIdState) {
+				drained[targetGroupArn] = true
+			} else {
+				waiting = append(waiting, targetGroupArn)
 			}
 		}
 
-		if allInitialTargetsGone {
-			log.Printf("Either there are no initial targets or all targets are new or the service desired count was set to 0")
-			return nil
+		if len(waiting) > 0 {
+			return fmt.Errorf("%w: %s", ErrWaitingForDrainingState, strings.Join(waiting, ", "))
 		}
-
-		return ErrWaitingForDrainingState
+		return nil
 	}
 
-	return backoff.Retry(operation, bo)
+	return backoff.Retry(operation, backoff.WithContext(bo, ctx))
 }
 
-func validateDeployment(api ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
+func validateDeployment(ctx context.Context, api ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
 	for _, ecsDeployment := range ecsService.Deployments {
 		if *ecsDeployment.Status == "PRIMARY" {
 
@@ -341,7 +453,7 @@ func validateDeployment(api ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService e
 			var err error
 
 			operation := func() error {
-				output, err = api.DescribeServices(&ecs.DescribeServicesInput{Cluster: ecsService.ClusterArn, Services: []*string{ecsService.ServiceName}})
+				output, err = api.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: ecsService.ClusterArn, Services: []*string{ecsService.ServiceName}})
 				if err != nil {
 					return fmt.Errorf("on validate deployment while describe service: %w", err)
 				}
@@ -355,7 +467,7 @@ func validateDeployment(api ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService e
 				return nil
 			}
 
-			err = backoff.Retry(operation, backoff.WithMaxRetries(bo, 5))
+			err = backoff.Retry(operation, backoff.WithMaxRetries(backoff.WithContext(bo, ctx), 5))
 			if err == ErrDeploymentChangedElsewhere {
 				return backoff.Permanent(err)
 			}
@@ -385,61 +497,115 @@ func validateDeployment(api ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService e
 	return errNoPrimaryDeployment
 }
 
-func alterServiceValidateDeployment(ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, cluster, service string, imageMap map[string]string, envMaps map[string]map[string]string, secretMaps map[string]map[string]string, logopts map[string]map[string]map[string]string, logsecrets map[string]map[string]map[string]string, taskRole string, desiredCount *int64, taskdef string, bo backoff.BackOff, validateDeployment validateDeploymentFunc) (ecs.Service, error) {
-	oldsvc, newsvc, err := alterService(ecsapi, cluster, service, imageMap, envMaps, secretMaps, logopts, logsecrets, taskRole, desiredCount, taskdef)
+func alterServiceValidateDeployment(ctx context.Context, e *ECSServiceUpdate, validateDeployment ValidateDeploymentFunc) (ecs.Service, ecs.Service, error) {
+	oldsvc, newsvc, err := alterService(ctx, e)
 	if err != nil {
-		return oldsvc, err
+		return oldsvc, newsvc, err
+	}
+	ecsapi, elbv2api, bo, failedTasksThreshold := e.EcsApi, e.ElbApi, e.BackOff, e.FailedTasksThreshold
+	if isCodeDeployController(oldsvc) {
+		// CodeDeploy runs the tasks and validates them with the lifecycle hooks and alarms of the deployment group
+		validateDeployment, failedTasksThreshold = e.CodeDeploy.validateDeployment, -1
+	}
+	if e.waitsUntil(WaitUntilRolloutCompleted) && circuitBreakerRollbackEnabled(newsvc) {
+		// the deployment circuit breaker rolls back the failing tasks, the rollout state reports it
+		failedTasksThreshold = -1
 	}
 	var prevErr error
+	attempt := 0
 	operation := func() error {
-		err := validateDeployment(ecsapi, elbv2api, newsvc, bo)
-		if err != prevErr && err != nil {
+		err := checkFailedTasks(ctx, ecsapi, newsvc, failedTasksThreshold)
+		if err == nil {
+			err = validateDeployment(ctx, ecsapi, elbv2api, newsvc, bo)
+		}
+		attempt++
+		emit(ctx, validationAttempt(newsvc, attempt, err, prevErr))
+		if err != nil {
 			prevErr = err
-			log.Print(err)
 		}
 		return err
 	}
-	return oldsvc, backoff.Retry(operation, bo)
+	return oldsvc, newsvc, backoff.Retry(operation, backoff.WithContext(bo, ctx))
 }
 
 const (
-	WaitUntilPrimaryRolled   = "primary-rolled"
-	WaitUntilDrainingStarted = "draining-started"
+	WaitUntilPrimaryRolled     = "primary-rolled"
+	WaitUntilDrainingStarted   = "draining-started"
+	WaitUntilRolloutCompleted  = "rollout-completed"
+	WaitUntilTargetsHealthy    = "targets-healthy"
+	WaitUntilContainersHealthy = "containers-healthy"
 )
 
-var WaitUntilOptionList = []string{WaitUntilPrimaryRolled, WaitUntilDrainingStarted}
+// WaitUntilOptionList the wait until options available, including those added with RegisterWaitUntil
+var WaitUntilOptionList = []string{WaitUntilPrimaryRolled, WaitUntilDrainingStarted, WaitUntilRolloutCompleted, WaitUntilTargetsHealthy, WaitUntilContainersHealthy}
 
 // ECSServiceUpdate encapsulates the attributes of an ECS service update
 type ECSServiceUpdate struct {
-	EcsApi           ecsiface.ECSAPI                         // ECS Api
-	ElbApi           elbv2iface.ELBV2API                     // ELBV2 Api
-	Cluster          string                                  // Cluster which the service is deployed to
-	Service          string                                  // Name of the service
-	Image            map[string]string                       // Map of container names and images
-	Environment      map[string]map[string]string            // Map of container names environment variable name and value
-	Secrets          map[string]map[string]string            // Map of container names environment variable name and valueFrom
-	LogDriverOptions map[string]map[string]map[string]string // Map of container names log driver name log driver option and value
-	LogDriverSecrets map[string]map[string]map[string]string // Map of container names log driver name log driver secret and valueFrom
-	TaskRole         string                                  // Task IAM Role if TaskRoleKnockoutValue used, it is cleared
-	DesiredCount     *int64                                  // If nil the service desired count is not altered
-	BackOff          backoff.BackOff                         // BackOff strategy to use when validating the update
-	Taskdef          string                                  // If non empty used as base task definition instead of the current task definition
-	WaitUntil        *string                                 // Decide wether to wait until the service "started-draining" (only valid for services with Load Balancers attached) or until the deployment "primary-rolled" (default)
+	EcsApi               ecsiface.ECSAPI                         // ECS Api
+	ElbApi               elbv2iface.ELBV2API                     // ELBV2 Api
+	Cluster              string                                  // Cluster which the service is deployed to
+	Service              string                                  // Name of the service
+	Image                map[string]string                       // Map of container names and images, ErrContainerNotFound is returned if a container isn't in the task definition
+	Environment          map[string]map[string]string            // Map of container names environment variable name and value
+	Secrets              map[string]map[string]string            // Map of container names environment variable name and valueFrom
+	LogDriverOptions     map[string]map[string]map[string]string // Map of container names log driver name log driver option and value
+	LogDriverSecrets     map[string]map[string]map[string]string // Map of container names log driver name log driver secret and valueFrom
+	TaskRole             string                                  // Task IAM Role if TaskRoleKnockoutValue used, it is cleared
+	DesiredCount         *int64                                  // If nil the service desired count is not altered
+	BackOff              backoff.BackOff                         // BackOff strategy to use when validating the update
+	Taskdef              string                                  // If non empty used as base task definition instead of the current task definition
+	ImageResolver        ImageResolver                           // If non nil, container images are pinned to their digests before registering the task definition
+	PreDeployTask        *PreDeployTask                          // If non nil, run with the new task definition before updating the service, the service is only updated if it succeeds
+	Canary               *Canary                                 // If non nil, the new task definition is validated in a canary service before updating the service
+	CodeDeploy           *CodeDeploy                             // Required to update services with the CODE_DEPLOY deployment controller
+	PostSuccessHooks     []Hook                                  // Run in order once the deployment is validated, if one fails the deployment is not rolled back and ErrPostSuccessHookFailed is returned
+	PostRollbackHooks    []Hook                                  // Run in order once the deployment was rolled back, successfully or not, failures are only logged
+	FailedTasksThreshold int                                     // Consecutive failed tasks of the deployment after which it is rolled back, if 0 or negative failed tasks are ignored
+	UnhealthyThreshold   int                                     // Consecutive unhealthy checks of a target of the deployment after which it is rolled back when waiting until "targets-healthy", if 0 DefaultUnhealthyThreshold is used
+	Validators           []ValidateDeploymentFunc                // Validators to run after the WaitUntil ones, every validator must pass
+	EventSink            EventSink                               // Receives the progress events, if nil LogEventSink is used
+	WaitUntil            *string                                 // Comma separated wait until options, decide wether to wait until the service "started-draining" (only valid for services with Load Balancers attached), until the deployment "primary-rolled" (default), until ECS reports the deployment "rollout-completed", until the tasks of the deployment are "targets-healthy" in every target group or until their container health checks report "containers-healthy"
 }
 
 // Apply the ECS Service Update
 func (e *ECSServiceUpdate) Apply() error {
-	var useValidateDeploymentFunc validateDeploymentFunc = validateDeployment
-
-	if e.WaitUntil != nil {
-		switch *e.WaitUntil {
-		case WaitUntilDrainingStarted:
-			useValidateDeploymentFunc = validateDraining
-		case WaitUntilPrimaryRolled:
-			useValidateDeploymentFunc = validateDeployment
-		default:
-			return ErrInvalidWaitUntil
+	return e.ApplyWithContext(context.Background())
+}
+
+// ApplyWithContext applies the ECS Service Update, if the context is cancelled the update is rolled back
+func (e *ECSServiceUpdate) ApplyWithContext(ctx context.Context) error {
+	ctx = withEventSink(ctx, e.EventSink)
+	useValidateDeploymentFunc, err := e.validator()
+	if err != nil {
+		return err
+	}
+	validateRollback, err := e.rollbackValidator()
+	if err != nil {
+		return err
+	}
+	if e.Canary != nil {
+		taskDefinition, err := e.deployCanary(ctx)
+		if err != nil {
+			return err
 		}
+		// the canary served its purpose whatever the outcome of the service
+		defer scaleDownCanary(detachedContext{parent: ctx}, e.EcsApi, e.Cluster, e.Service)
+		e = e.promoteCanary(taskDefinition)
+	}
+	return alterServiceOrValidatedRollBack(ctx, e, useValidateDeploymentFunc, validateRollback)
+}
+
+// Plan the ECS Service Update without registering the task definition nor updating the service, returns the service
+// changes and a unified diff of the task definition
+func (e *ECSServiceUpdate) Plan() (string, error) {
+	return e.PlanWithContext(context.Background())
+}
+
+// PlanWithContext plans the ECS Service Update using the provided context
+func (e *ECSServiceUpdate) PlanWithContext(ctx context.Context) (string, error) {
+	plan, err := planService(ctx, e)
+	if err != nil || e.Canary == nil {
+		return plan, err
 	}
-	return alterServiceOrValidatedRollBack(e.EcsApi, e.ElbApi, e.Cluster, e.Service, e.Image, e.Environment, e.Secrets, e.LogDriverOptions, e.LogDriverSecrets, e.TaskRole, e.DesiredCount, e.Taskdef, e.BackOff, useValidateDeploymentFunc)
+	return fmt.Sprintf("canary: %s, %d tasks, bake time %s\n%s", canaryServiceName(e.Service), e.Canary.count(), e.Canary.BakeTime, plan), nil
 }
@@ -0,0 +1,207 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"time"
+)
+
+// CanarySuffix appended to the name of the service to name its canary service
+const CanarySuffix = "-canary"
+
+// bakeCheckInterval time between the validations of a deployment while it bakes
+var bakeCheckInterval = 30 * time.Second
+
+var (
+	// ErrCanaryFailed the canary service failed its validation, the service was not updated
+	ErrCanaryFailed = errors.New("the canary failed")
+)
+
+// Canary runs the new task definition in a companion canary service, named after the service with CanarySuffix,
+// before the service is updated. The canary service is created, if needed, with the load balancers and network
+// configuration of the service so it receives a share of its traffic. It must pass the validation of the update and
+// keep passing it for BakeTime, then the service is updated and the canary service is scaled back to zero. If the
+// canary fails it is scaled back to zero and the service is left untouched
+type Canary struct {
+	Count    int64         // Tasks of the canary service, if 0 1 is used
+	BakeTime time.Duration // Time the canary service must keep passing the validation once it passed it the first time
+}
+
+func (c *Canary) count() int64 {
+	if c.Count == 0 {
+		return 1
+	}
+	return c.Count
+}
+
+func canaryServiceName(service string) string {
+	return service + CanarySuffix
+}
+
+// activeService returns the service named name of output, nil if it doesn't exist or was deleted
+func activeService(output *ecs.DescribeServicesOutput, name string) *ecs.Service {
+	for _, svc := range output.Services {
+		if aws.StringValue(svc.ServiceName) == name && aws.StringValue(svc.Status) != "INACTIVE" {
+			return svc
+		}
+	}
+	return nil
+}
+
+// deployCanary registers the new task definition, runs the pre-deploy task and deploys the task definition to the
+// canary service until it baked. Returns the new task definition, if the canary fails it is scaled back to zero
+func (e *ECSServiceUpdate) deployCanary(ctx context.Context) (string, error) {
+	canaryName := canaryServiceName(e.Service)
+	output, err := e.EcsApi.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(e.Cluster), Services: []*string{aws.String(e.Service), aws.String(canaryName)}})
+	if err != nil {
+		return "", fmt.Errorf("on deploy canary while describe services: %w", err)
+	}
+	svc := activeService(output, e.Service)
+	if svc == nil {
+		return "", ErrServiceNotFound
+	}
+	srcTaskDef := aws.StringValue(svc.TaskDefinition)
+	if e.Taskdef != "" {
+		srcTaskDef = e.Taskdef
+	}
+	taskDefinition, err := copyTaskDef(ctx, e, srcTaskDef)
+	if err != nil {
+		return "", err
+	}
+	if e.PreDeployTask != nil {
+		if err := runPreDeployTask(ctx, e.EcsApi, *svc, taskDefinition, *e.PreDeployTask); err != nil {
+			return "", err
+		}
+	}
+
+	count := e.Canary.count()
+	canarysvc, err := runCanary(ctx, e.EcsApi, *svc, activeService(output, canaryName), canaryName, taskDefinition, count)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCanaryFailed, err)
+	}
+	emit(ctx, CanaryStarted{Service: e.Service, Canary: canaryName, TaskDefinition: taskDefinition, Count: count})
+	if err := bakeDeployment(ctx, e.EcsApi, e.ElbApi, canarysvc, e.Canary.BakeTime, e.BackOff, e.validator, e.FailedTasksThreshold); err != nil {
+		// the canary must not keep serving traffic, even if the deployment was cancelled
+		scaleDownCanary(detachedContext{parent: ctx}, e.EcsApi, e.Cluster, e.Service)
+		return "", fmt.Errorf("%w: %v", ErrCanaryFailed, err)
+	}
+	return taskDefinition, nil
+}
+
+// runCanary updates the canary service, or creates it if canarysvc is nil, to run count tasks of the task definition
+// with the load balancers and network configuration of svc
+func runCanary(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, canarysvc *ecs.Service, canaryName, taskDefinition string, count int64) (ecs.Service, error) {
+	var loadBalancers []*ecs.LoadBalancer
+	if len(svc.LoadBalancers) > 0 {
+		loadBalancers = svc.LoadBalancers
+	}
+	if canarysvc != nil {
+		output, err := api.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+			Cluster:              svc.ClusterArn,
+			Service:              aws.String(canaryName),
+			TaskDefinition:       aws.String(taskDefinition),
+			DesiredCount:         aws.Int64(count),
+			LoadBalancers:        loadBalancers,
+			NetworkConfiguration: svc.NetworkConfiguration,
+			ForceNewDeployment:   aws.Bool(true),
+		})
+		if err != nil {
+			return ecs.Service{}, fmt.Errorf("on run canary while update service: %w", err)
+		}
+		return *output.Service, nil
+	}
+	input := &ecs.CreateServiceInput{
+		Cluster:                       svc.ClusterArn,
+		ServiceName:                   aws.String(canaryName),
+		TaskDefinition:                aws.String(taskDefinition),
+		DesiredCount:                  aws.Int64(count),
+		LoadBalancers:                 loadBalancers,
+		NetworkConfiguration:          svc.NetworkConfiguration,
+		PlatformVersion:               svc.PlatformVersion,
+		PlacementConstraints:          svc.PlacementConstraints,
+		PlacementStrategy:             svc.PlacementStrategy,
+		HealthCheckGracePeriodSeconds: svc.HealthCheckGracePeriodSeconds,
+		EnableExecuteCommand:          svc.EnableExecuteCommand,
+	}
+	if len(svc.CapacityProviderStrategy) > 0 {
+		input.CapacityProviderStrategy = svc.CapacityProviderStrategy
+	} else {
+		input.LaunchType = svc.LaunchType
+	}
+	output, err := api.CreateServiceWithContext(ctx, input)
+	if err != nil {
+		return ecs.Service{}, fmt.Errorf("on run canary while create service: %w", err)
+	}
+	return *output.Service, nil
+}
+
+// bakeDeployment waits until the deployment of svc passes the validation, then validates it again every
+// bakeCheckInterval until bakeTime elapsed. Each validation uses a new validator, a chain of validators only runs
+// each validator until it passes
+func bakeDeployment(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bakeTime time.Duration, bo backoff.BackOff, newValidator func() (ValidateDeploymentFunc, error), failedTasksThreshold int) error {
+	validate := func() error {
+		validateDeployment, err := newValidator()
+		if err != nil {
+			return err
+		}
+		var prevErr error
+		attempt := 0
+		operation := func() error {
+			err := checkFailedTasks(ctx, ecsapi, svc, failedTasksThreshold)
+			if err == nil {
+				err = validateDeployment(ctx, ecsapi, elbv2api, svc, bo)
+			}
+			attempt++
+			emit(ctx, validationAttempt(svc, attempt, err, prevErr))
+			if err != nil {
+				prevErr = err
+			}
+			return err
+		}
+		return backoff.Retry(operation, backoff.WithContext(bo, ctx))
+	}
+	if err := validate(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(bakeTime)
+	for wait := time.Until(deadline); wait > 0; wait = time.Until(deadline) {
+		if wait > bakeCheckInterval {
+			wait = bakeCheckInterval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleDownCanary sets the desired count of the canary service of service to zero, the canary service is kept so
+// the next canary reuses it. A failure is only emitted, the canary doesn't change the outcome of the service
+func scaleDownCanary(ctx context.Context, api ecsiface.ECSAPI, cluster, service string) {
+	canaryName := canaryServiceName(service)
+	_, err := api.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{Cluster: aws.String(cluster), Service: aws.String(canaryName), DesiredCount: aws.Int64(0)})
+	if err != nil {
+		emit(ctx, CanaryScaleDownFailed{Service: service, Canary: canaryName, Err: fmt.Errorf("on scale down canary '%s': %w", canaryName, err)})
+		return
+	}
+	emit(ctx, CanaryScaledDown{Service: service, Canary: canaryName})
+}
+
+// promoteCanary returns the update of the service to the task definition the canary service validated
+func (e ECSServiceUpdate) promoteCanary(taskDefinition string) *ECSServiceUpdate {
+	e.Image, e.Environment, e.Secrets, e.LogDriverOptions, e.LogDriverSecrets = nil, nil, nil, nil, nil
+	e.TaskRole, e.ImageResolver, e.PreDeployTask, e.Canary = "", nil, nil, nil
+	e.Taskdef = taskDefinition
+	return &e
+}
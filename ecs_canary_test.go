@@ -0,0 +1,198 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockCanaryEcsClient keeps the service and its canary service apart, the task definitions are the ones of
+// mockDeployEcsClient
+type mockCanaryEcsClient struct {
+	*mockDeployEcsClient
+	services     map[string]*ecs.Service
+	createInputs []*ecs.CreateServiceInput
+	updateInputs map[string][]*ecs.UpdateServiceInput
+}
+
+func newMockCanaryEcsClient() *mockCanaryEcsClient {
+	return &mockCanaryEcsClient{
+		mockDeployEcsClient: newMockDeployEcsClient(),
+		services: map[string]*ecs.Service{
+			"my-service": {
+				ClusterArn:           aws.String("arn:aws:ecs:us-west-2:123456789012:cluster/my-cluster"),
+				ServiceName:          aws.String("my-service"),
+				Status:               aws.String("ACTIVE"),
+				TaskDefinition:       aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1"),
+				DesiredCount:         aws.Int64(4),
+				RunningCount:         aws.Int64(4),
+				LaunchType:           aws.String(ecs.LaunchTypeFargate),
+				LoadBalancers:        []*ecs.LoadBalancer{{TargetGroupArn: aws.String("arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/my-tg/1"), ContainerName: aws.String("my-container"), ContainerPort: aws.Int64(8080)}},
+				NetworkConfiguration: &ecs.NetworkConfiguration{AwsvpcConfiguration: &ecs.AwsVpcConfiguration{Subnets: aws.StringSlice([]string{"subnet-1"})}},
+				Deployments:          []*ecs.Deployment{{Id: aws.String("ecs-svc/0"), Status: aws.String("PRIMARY")}},
+			},
+		},
+		updateInputs: map[string][]*ecs.UpdateServiceInput{},
+	}
+}
+
+func (m *mockCanaryEcsClient) deploy(svc *ecs.Service, taskDefinition *string, desiredCount *int64) *ecs.Service {
+	m.deployments++
+	if taskDefinition != nil {
+		svc.TaskDefinition = taskDefinition
+	}
+	svc.DesiredCount, svc.RunningCount = desiredCount, desiredCount
+	svc.Deployments = []*ecs.Deployment{{Id: aws.String(fmt.Sprintf("ecs-svc/%d", m.deployments)), Status: aws.String("PRIMARY"), TaskDefinition: svc.TaskDefinition}}
+	copied := ecs.Service{}
+	panicUnmarshal(panicMarshal(svc), &copied)
+	return &copied
+}
+
+func (m *mockCanaryEcsClient) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	output := &ecs.DescribeServicesOutput{}
+	for _, name := range input.Services {
+		if svc, found := m.services[*name]; found {
+			copied := ecs.Service{}
+			panicUnmarshal(panicMarshal(svc), &copied)
+			output.Services = append(output.Services, &copied)
+		}
+	}
+	return output, nil
+}
+
+func (m *mockCanaryEcsClient) CreateServiceWithContext(ctx aws.Context, input *ecs.CreateServiceInput, opts ...request.Option) (*ecs.CreateServiceOutput, error) {
+	m.createInputs = append(m.createInputs, input)
+	svc := &ecs.Service{ClusterArn: input.Cluster, ServiceName: input.ServiceName, Status: aws.String("ACTIVE")}
+	m.services[*input.ServiceName] = svc
+	return &ecs.CreateServiceOutput{Service: m.deploy(svc, input.TaskDefinition, input.DesiredCount)}, nil
+}
+
+func (m *mockCanaryEcsClient) UpdateServiceWithContext(ctx aws.Context, input *ecs.UpdateServiceInput, opts ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	name := strings.TrimPrefix(*input.Service, "arn:aws:ecs:us-west-2:123456789012:service/my-cluster/")
+	m.updateInputs[name] = append(m.updateInputs[name], input)
+	return &ecs.UpdateServiceOutput{Service: m.deploy(m.services[name], input.TaskDefinition, input.DesiredCount)}, nil
+}
+
+func TestECSServiceUpdateCanary(t *testing.T) {
+	defer func(interval time.Duration) {
+		bakeCheckInterval = interval
+	}(bakeCheckInterval)
+	bakeCheckInterval = time.Millisecond
+
+	failCanary := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		if *svc.ServiceName == "my-service-canary" {
+			return backoff.Permanent(errNotReady)
+		}
+		return nil
+	}
+	tests := []struct {
+		name           string
+		existing       bool
+		validate       ValidateDeploymentFunc
+		failBaking     bool // The canary passes its first validation, then fails while it bakes
+		wantErr        error
+		wantCreates    int
+		wantTaskDef    string
+		wantValidation int // Minimum validations of the canary service
+	}{
+		{name: "created", validate: validateDeployment, wantCreates: 1, wantTaskDef: "my-family:2", wantValidation: 1},
+		{name: "updated", existing: true, validate: validateDeployment, wantTaskDef: "my-family:2", wantValidation: 1},
+		{name: "failed", validate: failCanary, wantErr: ErrCanaryFailed, wantCreates: 1, wantTaskDef: "my-family:1", wantValidation: 1},
+		{name: "failed baking", validate: validateDeployment, failBaking: true, wantErr: ErrCanaryFailed, wantCreates: 1, wantTaskDef: "my-family:1", wantValidation: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockCanaryEcsClient()
+			if tt.existing {
+				api.services["my-service-canary"] = &ecs.Service{ServiceName: aws.String("my-service-canary"), Status: aws.String("ACTIVE"), DesiredCount: aws.Int64(0)}
+			}
+			validations := 0
+			validate := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+				if *svc.ServiceName == "my-service-canary" {
+					validations++
+					if tt.failBaking && validations > 1 {
+						return backoff.Permanent(errNotReady)
+					}
+				}
+				return tt.validate(ctx, ecsapi, elbv2api, svc, bo)
+			}
+			sink := &recordingEventSink{}
+			esu := ECSServiceUpdate{
+				EcsApi:               api,
+				Cluster:              "my-cluster",
+				Service:              "my-service",
+				Image:                map[string]string{"my-container": "myrepo/myimg:newtag"},
+				BackOff:              backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+				Canary:               &Canary{Count: 2, BakeTime: 5 * time.Millisecond},
+				FailedTasksThreshold: -1,
+				Validators:           []ValidateDeploymentFunc{validate},
+				EventSink:            sink,
+			}
+			err := esu.Apply()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if len(api.createInputs) != tt.wantCreates {
+				t.Fatalf("expected %d canary services created, got %d", tt.wantCreates, len(api.createInputs))
+			}
+			if tt.wantCreates > 0 {
+				create := api.createInputs[0]
+				if *create.DesiredCount != 2 || *create.LaunchType != ecs.LaunchTypeFargate || len(create.LoadBalancers) != 1 || create.NetworkConfiguration == nil {
+					t.Errorf("unexpected canary service %v", create)
+				}
+			}
+			if validations < tt.wantValidation {
+				t.Errorf("expected at least %d validations of the canary, got %d", tt.wantValidation, validations)
+			}
+			if !strings.HasSuffix(*api.services["my-service"].TaskDefinition, tt.wantTaskDef) {
+				t.Errorf("expected the service running %s, got %s", tt.wantTaskDef, *api.services["my-service"].TaskDefinition)
+			}
+			if tt.wantErr != nil && len(api.updateInputs["my-service"]) != 0 {
+				t.Errorf("expected the service untouched, got %v", api.updateInputs["my-service"])
+			}
+			if canary := api.services["my-service-canary"]; *canary.DesiredCount != 0 || !strings.HasSuffix(*canary.TaskDefinition, "my-family:2") {
+				t.Errorf("expected the canary scaled down, got %v", canary)
+			}
+			canaryAttempts, scaledDown := 0, 0
+			for _, event := range sink.events {
+				switch event := event.(type) {
+				case ValidationAttempt:
+					if event.Service == "my-service-canary" {
+						canaryAttempts++
+					}
+				case CanaryScaledDown:
+					scaledDown++
+				}
+			}
+			if canaryAttempts != validations || scaledDown != 1 {
+				t.Errorf("expected %d validation attempts of the canary and its scale down emitted, got %v", validations, sink.types())
+			}
+		})
+	}
+}
+
+func TestECSServiceUpdateCanaryPlan(t *testing.T) {
+	esu := ECSServiceUpdate{
+		EcsApi:  newMockDeployEcsClient(),
+		Cluster: "my-cluster",
+		Service: "my-service",
+		Image:   map[string]string{"my-container": "myrepo/myimg:newtag"},
+		Canary:  &Canary{BakeTime: 10 * time.Minute},
+	}
+	plan, err := esu.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plan, "canary: my-service-canary, 1 tasks, bake time 10m0s\nservice: ") {
+		t.Errorf("unexpected plan %q", plan)
+	}
+}
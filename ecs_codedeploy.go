@@ -0,0 +1,269 @@
+package awsecs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+)
+
+var (
+	// ErrCodeDeployRequired the service uses the CODE_DEPLOY deployment controller but no CodeDeploy was provided
+	ErrCodeDeployRequired = errors.New("the service uses the CODE_DEPLOY deployment controller, CodeDeploy is required")
+	// ErrCodeDeployDeploymentFailed the CodeDeploy deployment of the service failed
+	ErrCodeDeployDeploymentFailed = errors.New("the CodeDeploy deployment failed")
+)
+
+var (
+	errWaitingForCodeDeployDeployment = errors.New("waiting for the CodeDeploy deployment")
+)
+
+// CodeDeploy deploys the services with the CODE_DEPLOY deployment controller. The altered task definition is deployed
+// with a CodeDeploy blue/green deployment of a generated AppSpec, which is validated once CodeDeploy reports it
+// succeeded, the lifecycle hooks and alarms of the deployment group take the place of the wait until options and
+// validators. If the deployment fails it is rolled back by CodeDeploy
+type CodeDeploy struct {
+	Api             codedeployiface.CodeDeployAPI // CodeDeploy Api
+	Application     string                        // If empty AppECS-<cluster>-<service> is used, the name the ECS console uses
+	DeploymentGroup string                        // If empty DgpECS-<cluster>-<service> is used, the name the ECS console uses
+}
+
+func (c *CodeDeploy) application(cluster, service string) string {
+	if c.Application != "" {
+		return c.Application
+	}
+	return fmt.Sprintf("AppECS-%s-%s", cluster, service)
+}
+
+func (c *CodeDeploy) deploymentGroup(cluster, service string) string {
+	if c.DeploymentGroup != "" {
+		return c.DeploymentGroup
+	}
+	return fmt.Sprintf("DgpECS-%s-%s", cluster, service)
+}
+
+func isCodeDeployController(svc ecs.Service) bool {
+	return svc.DeploymentController != nil && aws.StringValue(svc.DeploymentController.Type) == ecs.DeploymentControllerTypeCodeDeploy
+}
+
+type appSpec struct {
+	Version   json.Number                  `json:"version"`
+	Resources []map[string]appSpecResource `json:"Resources"`
+}
+
+type appSpecResource struct {
+	Type       string
+	Properties appSpecProperties
+}
+
+type appSpecProperties struct {
+	TaskDefinition           string
+	LoadBalancerInfo         *appSpecLoadBalancerInfo     `json:",omitempty"`
+	PlatformVersion          string                       `json:",omitempty"`
+	NetworkConfiguration     *appSpecNetworkConfiguration `json:",omitempty"`
+	CapacityProviderStrategy []appSpecCapacityProvider    `json:",omitempty"`
+}
+
+type appSpecLoadBalancerInfo struct {
+	ContainerName string
+	ContainerPort int64
+}
+
+type appSpecNetworkConfiguration struct {
+	AwsvpcConfiguration appSpecAwsvpcConfiguration
+}
+
+type appSpecAwsvpcConfiguration struct {
+	Subnets        []string
+	SecurityGroups []string `json:",omitempty"`
+	AssignPublicIp string   `json:",omitempty"`
+}
+
+type appSpecCapacityProvider struct {
+	CapacityProvider string
+	Base             int64
+	Weight           int64
+}
+
+// codeDeployAppSpec returns the AppSpec deploying the task definition to svc, with its load balancer container,
+// platform version, network configuration and capacity provider strategy
+func codeDeployAppSpec(svc ecs.Service, taskDefinition string) string {
+	properties := appSpecProperties{
+		TaskDefinition:  taskDefinition,
+		PlatformVersion: aws.StringValue(svc.PlatformVersion),
+	}
+	if len(svc.LoadBalancers) > 0 {
+		properties.LoadBalancerInfo = &appSpecLoadBalancerInfo{
+			ContainerName: aws.StringValue(svc.LoadBalancers[0].ContainerName),
+			ContainerPort: aws.Int64Value(svc.LoadBalancers[0].ContainerPort),
+		}
+	}
+	if svc.NetworkConfiguration != nil && svc.NetworkConfiguration.AwsvpcConfiguration != nil {
+		awsvpc := svc.NetworkConfiguration.AwsvpcConfiguration
+		properties.NetworkConfiguration = &appSpecNetworkConfiguration{AwsvpcConfiguration: appSpecAwsvpcConfiguration{
+			Subnets:        aws.StringValueSlice(awsvpc.Subnets),
+			SecurityGroups: aws.StringValueSlice(awsvpc.SecurityGroups),
+			AssignPublicIp: aws.StringValue(awsvpc.AssignPublicIp),
+		}}
+	}
+	for _, strategy := range svc.CapacityProviderStrategy {
+		properties.CapacityProviderStrategy = append(properties.CapacityProviderStrategy, appSpecCapacityProvider{
+			CapacityProvider: aws.StringValue(strategy.CapacityProvider),
+			Base:             aws.Int64Value(strategy.Base),
+			Weight:           aws.Int64Value(strategy.Weight),
+		})
+	}
+	spec := appSpec{
+		Version:   "0.0",
+		Resources: []map[string]appSpecResource{{"TargetService": {Type: "AWS::ECS::Service", Properties: properties}}},
+	}
+	content, err := json.Marshal(spec)
+	if err != nil {
+		panic(err)
+	}
+	return string(content)
+}
+
+// createCodeDeployDeployment deploys the task definition to svc with a CodeDeploy deployment, the desired count is
+// updated first. The PRIMARY deployment of the returned service is the CodeDeploy deployment
+func createCodeDeployDeployment(ctx context.Context, ecsapi ecsiface.ECSAPI, codeDeploy *CodeDeploy, cluster, service string, svc ecs.Service, taskDefinition string, desiredCount *int64) (*ecs.UpdateServiceOutput, error) {
+	if desiredCount != nil && *desiredCount != aws.Int64Value(svc.DesiredCount) {
+		output, err := ecsapi.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{Cluster: aws.String(cluster), Service: aws.String(service), DesiredCount: desiredCount})
+		if err != nil {
+			return nil, err
+		}
+		svc = *output.Service
+	}
+	output, err := codeDeploy.Api.CreateDeploymentWithContext(ctx, &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String(codeDeploy.application(cluster, service)),
+		DeploymentGroupName: aws.String(codeDeploy.deploymentGroup(cluster, service)),
+		Revision: &codedeploy.RevisionLocation{
+			RevisionType:   aws.String(codedeploy.RevisionLocationTypeAppSpecContent),
+			AppSpecContent: &codedeploy.AppSpecContent{Content: aws.String(codeDeployAppSpec(svc, taskDefinition))},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("on create CodeDeploy deployment: %w", err)
+	}
+	emit(ctx, CodeDeployDeploymentCreated{Service: service, DeploymentId: aws.StringValue(output.DeploymentId), TaskDefinition: taskDefinition})
+	svc.TaskDefinition = aws.String(taskDefinition)
+	svc.Deployments = []*ecs.Deployment{{Id: output.DeploymentId, Status: aws.String("PRIMARY"), TaskDefinition: aws.String(taskDefinition)}}
+	return &ecs.UpdateServiceOutput{Service: &svc}, nil
+}
+
+// validateDeployment validates the CodeDeploy deployment of the service, the PRIMARY deployment
+func (c *CodeDeploy) validateDeployment(ctx context.Context, _ ecsiface.ECSAPI, _ elbv2iface.ELBV2API, svc ecs.Service, _ backoff.BackOff) error {
+	deployment := primaryDeployment(svc)
+	if deployment == nil {
+		return errNoPrimaryDeployment
+	}
+	output, err := c.Api.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{DeploymentId: deployment.Id})
+	if err != nil {
+		return fmt.Errorf("on validate CodeDeploy deployment: %w", err)
+	}
+	info := output.DeploymentInfo
+	switch aws.StringValue(info.Status) {
+	case codedeploy.DeploymentStatusSucceeded:
+		return nil
+	case codedeploy.DeploymentStatusFailed:
+		return backoff.Permanent(fmt.Errorf("%w: %s", ErrCodeDeployDeploymentFailed, codeDeployErrorMessage(info)))
+	case codedeploy.DeploymentStatusStopped:
+		// only stopped by someone else, a deployment which failed validation is stopped on rollback
+		return backoff.Permanent(ErrDeploymentChangedElsewhere)
+	}
+	return fmt.Errorf("%w: %s %s", errWaitingForCodeDeployDeployment, aws.StringValue(deployment.Id), aws.StringValue(info.Status))
+}
+
+func codeDeployErrorMessage(info *codedeploy.DeploymentInfo) string {
+	if info.ErrorInformation == nil {
+		return aws.StringValue(info.DeploymentId)
+	}
+	return fmt.Sprintf("%s: %s: %s", aws.StringValue(info.DeploymentId), aws.StringValue(info.ErrorInformation.Code), aws.StringValue(info.ErrorInformation.Message))
+}
+
+// waitCodeDeployDeployment returns the deployment once done returns true
+func waitCodeDeployDeployment(ctx context.Context, api codedeployiface.CodeDeployAPI, deploymentId *string, bo backoff.BackOff, done func(*codedeploy.DeploymentInfo) bool) (*codedeploy.DeploymentInfo, error) {
+	var info *codedeploy.DeploymentInfo
+	operation := func() error {
+		output, err := api.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{DeploymentId: deploymentId})
+		if err != nil {
+			return fmt.Errorf("on wait CodeDeploy deployment: %w", err)
+		}
+		info = output.DeploymentInfo
+		if !done(info) {
+			return fmt.Errorf("%w: %s %s", errWaitingForCodeDeployDeployment, aws.StringValue(deploymentId), aws.StringValue(info.Status))
+		}
+		return nil
+	}
+	return info, backoff.Retry(operation, backoff.WithContext(bo, ctx))
+}
+
+func codeDeployCompleted(info *codedeploy.DeploymentInfo) bool {
+	switch aws.StringValue(info.Status) {
+	case codedeploy.DeploymentStatusSucceeded, codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+		return true
+	}
+	return false
+}
+
+// rollBackCodeDeploy stops the CodeDeploy deployment of newsvc, if it is still in progress, with the automatic
+// rollback enabled and waits for the rollback deployment. A deployment which already succeeded is rolled back with a
+// new deployment of the task definition of oldsvc. Returns nil once the rollback deployment succeeded,
+// ErrNothingToRollback or why the rollback failed
+func rollBackCodeDeploy(ctx context.Context, ecsapi ecsiface.ECSAPI, codeDeploy *CodeDeploy, oldsvc, newsvc ecs.Service, cause error, bo backoff.BackOff) error {
+	deployment := primaryDeployment(newsvc)
+	if deployment == nil {
+		return ErrNothingToRollback
+	}
+	output, err := codeDeploy.Api.GetDeploymentWithContext(ctx, &codedeploy.GetDeploymentInput{DeploymentId: deployment.Id})
+	if err != nil {
+		return fmt.Errorf("on roll back CodeDeploy deployment: %w", err)
+	}
+	info := output.DeploymentInfo
+	switch {
+	case aws.StringValue(info.Status) == codedeploy.DeploymentStatusSucceeded:
+		// CodeDeploy doesn't roll back a succeeded deployment, e.g. when another service failed
+		emit(ctx, RollbackStarted{Service: aws.StringValue(newsvc.ServiceName), Cause: cause})
+		redeploy := &CodeDeploy{Api: codeDeploy.Api, Application: aws.StringValue(info.ApplicationName), DeploymentGroup: aws.StringValue(info.DeploymentGroupName)}
+		output, err := createCodeDeployDeployment(ctx, ecsapi, redeploy, aws.StringValue(oldsvc.ClusterArn), aws.StringValue(oldsvc.ServiceName), newsvc, aws.StringValue(oldsvc.TaskDefinition), oldsvc.DesiredCount)
+		if err != nil {
+			return fmt.Errorf("on roll back CodeDeploy deployment: %w", err)
+		}
+		return waitCodeDeployRollback(ctx, codeDeploy.Api, primaryDeployment(*output.Service).Id, bo)
+	case codeDeployCompleted(info):
+		emit(ctx, RollbackStarted{Service: aws.StringValue(newsvc.ServiceName), Cause: cause, Awaited: true})
+	default:
+		emit(ctx, RollbackStarted{Service: aws.StringValue(newsvc.ServiceName), Cause: cause})
+		_, err := codeDeploy.Api.StopDeploymentWithContext(ctx, &codedeploy.StopDeploymentInput{DeploymentId: deployment.Id, AutoRollbackEnabled: aws.Bool(true)})
+		if err != nil {
+			return fmt.Errorf("on roll back CodeDeploy deployment while stop deployment: %w", err)
+		}
+	}
+	// without automatic rollback there is no rollback deployment, the wait runs out and the rollback fails
+	info, err = waitCodeDeployDeployment(ctx, codeDeploy.Api, deployment.Id, bo, func(info *codedeploy.DeploymentInfo) bool {
+		return codeDeployCompleted(info) && info.RollbackInfo != nil && info.RollbackInfo.RollbackDeploymentId != nil
+	})
+	if err != nil {
+		return err
+	}
+	return waitCodeDeployRollback(ctx, codeDeploy.Api, info.RollbackInfo.RollbackDeploymentId, bo)
+}
+
+// waitCodeDeployRollback returns nil once the rollback deployment succeeded or why it failed
+func waitCodeDeployRollback(ctx context.Context, api codedeployiface.CodeDeployAPI, deploymentId *string, bo backoff.BackOff) error {
+	rollback, err := waitCodeDeployDeployment(ctx, api, deploymentId, bo, codeDeployCompleted)
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(rollback.Status) != codedeploy.DeploymentStatusSucceeded {
+		return fmt.Errorf("%w: %s", ErrCodeDeployDeploymentFailed, codeDeployErrorMessage(rollback))
+	}
+	return nil
+}
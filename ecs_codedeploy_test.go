@@ -0,0 +1,217 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"strings"
+	"testing"
+)
+
+// mockCodeDeployClient reports the statuses of each deployment in order, the last one is repeated
+type mockCodeDeployClient struct {
+	codedeployiface.CodeDeployAPI
+	statuses     map[string][]*codedeploy.DeploymentInfo
+	stopped      []*codedeploy.DeploymentInfo // Statuses of the deployment once stopped
+	createInputs []*codedeploy.CreateDeploymentInput
+	stopInputs   []*codedeploy.StopDeploymentInput
+}
+
+// CreateDeploymentWithContext returns the deployment ids d-1, d-2, ... in order
+func (m *mockCodeDeployClient) CreateDeploymentWithContext(ctx aws.Context, input *codedeploy.CreateDeploymentInput, opts ...request.Option) (*codedeploy.CreateDeploymentOutput, error) {
+	m.createInputs = append(m.createInputs, input)
+	return &codedeploy.CreateDeploymentOutput{DeploymentId: aws.String(fmt.Sprintf("d-%d", len(m.createInputs)))}, nil
+}
+
+func (m *mockCodeDeployClient) GetDeploymentWithContext(ctx aws.Context, input *codedeploy.GetDeploymentInput, opts ...request.Option) (*codedeploy.GetDeploymentOutput, error) {
+	statuses := m.statuses[*input.DeploymentId]
+	info := statuses[0]
+	if len(statuses) > 1 {
+		m.statuses[*input.DeploymentId] = statuses[1:]
+	}
+	info.DeploymentId = input.DeploymentId
+	for i, create := range m.createInputs {
+		if *input.DeploymentId == fmt.Sprintf("d-%d", i+1) {
+			info.ApplicationName, info.DeploymentGroupName = create.ApplicationName, create.DeploymentGroupName
+		}
+	}
+	return &codedeploy.GetDeploymentOutput{DeploymentInfo: info}, nil
+}
+
+func (m *mockCodeDeployClient) StopDeploymentWithContext(ctx aws.Context, input *codedeploy.StopDeploymentInput, opts ...request.Option) (*codedeploy.StopDeploymentOutput, error) {
+	m.stopInputs = append(m.stopInputs, input)
+	m.statuses[*input.DeploymentId] = m.stopped
+	return &codedeploy.StopDeploymentOutput{}, nil
+}
+
+func deploymentInfo(status string, rollbackDeploymentId string) *codedeploy.DeploymentInfo {
+	info := &codedeploy.DeploymentInfo{Status: aws.String(status)}
+	if rollbackDeploymentId != "" {
+		info.RollbackInfo = &codedeploy.RollbackInfo{RollbackDeploymentId: aws.String(rollbackDeploymentId)}
+	}
+	return info
+}
+
+func TestECSServiceUpdateCodeDeploy(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   map[string][]*codedeploy.DeploymentInfo
+		stopped    []*codedeploy.DeploymentInfo
+		noDeploy   bool
+		wantErr    error
+		wantStops  int
+		wantCreate bool
+	}{
+		{
+			name:       "succeeded",
+			statuses:   map[string][]*codedeploy.DeploymentInfo{"d-1": {deploymentInfo("InProgress", ""), deploymentInfo("Succeeded", "")}},
+			wantCreate: true,
+		},
+		{
+			name: "failed",
+			statuses: map[string][]*codedeploy.DeploymentInfo{
+				"d-1": {deploymentInfo("InProgress", ""), deploymentInfo("Failed", ""), deploymentInfo("Failed", "d-2")},
+				"d-2": {deploymentInfo("InProgress", ""), deploymentInfo("Succeeded", "")},
+			},
+			wantErr:    ErrSuccessfulRollback,
+			wantCreate: true,
+		},
+		{
+			name: "rollback failed",
+			statuses: map[string][]*codedeploy.DeploymentInfo{
+				"d-1": {deploymentInfo("Failed", "d-2")},
+				"d-2": {deploymentInfo("Failed", "")},
+			},
+			wantErr:    ErrFailedRollback,
+			wantCreate: true,
+		},
+		{
+			name: "timed out",
+			statuses: map[string][]*codedeploy.DeploymentInfo{
+				"d-1": {deploymentInfo("InProgress", "")},
+				"d-2": {deploymentInfo("Succeeded", "")},
+			},
+			stopped:    []*codedeploy.DeploymentInfo{deploymentInfo("Stopped", "d-2")},
+			wantErr:    ErrSuccessfulRollback,
+			wantStops:  1,
+			wantCreate: true,
+		},
+		{name: "no CodeDeploy", noDeploy: true, wantErr: ErrCodeDeployRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockDeployEcsClient()
+			api.service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+			api.service.LoadBalancers = []*ecs.LoadBalancer{{ContainerName: aws.String("my-container"), ContainerPort: aws.Int64(8080)}}
+			codeDeployApi := &mockCodeDeployClient{statuses: tt.statuses, stopped: tt.stopped}
+			esu := ECSServiceUpdate{
+				EcsApi:     api,
+				Cluster:    "my-cluster",
+				Service:    "my-service",
+				Image:      map[string]string{"my-container": "myrepo/myimg:newtag"},
+				BackOff:    backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+				CodeDeploy: &CodeDeploy{Api: codeDeployApi},
+			}
+			if tt.noDeploy {
+				esu.CodeDeploy = nil
+			}
+			err := esu.Apply()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if len(api.updateInputs) != 0 {
+				t.Errorf("expected no ECS service update, got %v", api.updateInputs)
+			}
+			if len(codeDeployApi.stopInputs) != tt.wantStops {
+				t.Errorf("expected %d stops, got %d", tt.wantStops, len(codeDeployApi.stopInputs))
+			}
+			if tt.wantStops > 0 && !*codeDeployApi.stopInputs[0].AutoRollbackEnabled {
+				t.Errorf("expected the deployment stopped with the automatic rollback")
+			}
+			if !tt.wantCreate {
+				return
+			}
+			if len(codeDeployApi.createInputs) != 1 {
+				t.Fatalf("expected a CodeDeploy deployment, got %v", codeDeployApi.createInputs)
+			}
+			create := codeDeployApi.createInputs[0]
+			if *create.ApplicationName != "AppECS-my-cluster-my-service" || *create.DeploymentGroupName != "DgpECS-my-cluster-my-service" {
+				t.Errorf("unexpected application or deployment group %s, %s", *create.ApplicationName, *create.DeploymentGroupName)
+			}
+			if !strings.Contains(*create.Revision.AppSpecContent.Content, "task-definition/my-family:2") {
+				t.Errorf("expected the new task definition in the AppSpec, got %s", *create.Revision.AppSpecContent.Content)
+			}
+		})
+	}
+}
+
+func TestECSMultiServiceUpdateCodeDeployRollback(t *testing.T) {
+	failWorker := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		if *svc.ServiceName == "worker" && strings.HasSuffix(*svc.TaskDefinition, "my-family:2") {
+			return backoff.Permanent(errNotReady)
+		}
+		return nil
+	}
+	api := newMockDeployEcsClient()
+	api.service.ServiceName = aws.String("api")
+	api.service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	codeDeployApi := &mockCodeDeployClient{statuses: map[string][]*codedeploy.DeploymentInfo{
+		"d-1": {deploymentInfo("InProgress", ""), deploymentInfo("Succeeded", "")},
+		"d-2": {deploymentInfo("InProgress", ""), deploymentInfo("Succeeded", "")},
+	}}
+	worker := newMockDeployEcsClient()
+	worker.service.ServiceName = aws.String("worker")
+	update := ECSMultiServiceUpdate{}
+	for _, ecsapi := range []*mockDeployEcsClient{api, worker} {
+		update.Services = append(update.Services, ECSServiceUpdate{
+			EcsApi:     ecsapi,
+			Cluster:    "my-cluster",
+			Service:    *ecsapi.service.ServiceName,
+			Image:      map[string]string{"my-container": "myrepo/myimg:newtag"},
+			BackOff:    backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+			CodeDeploy: &CodeDeploy{Api: codeDeployApi},
+			Validators: []ValidateDeploymentFunc{failWorker},
+		})
+	}
+	results, err := update.Apply()
+	if !errors.Is(err, ErrSuccessfulRollback) {
+		t.Fatalf("expected %v, got %v", ErrSuccessfulRollback, err)
+	}
+	if results[0].Outcome != OutcomeSuccessfulRollback || !errors.Is(results[0].Err, ErrOtherServiceFailed) {
+		t.Errorf("expected the CodeDeploy service rolled back after the worker failed, got %s: %v", results[0].Outcome, results[0].Err)
+	}
+	// the succeeded deployment is rolled back with a new deployment of the old task definition
+	if len(codeDeployApi.createInputs) != 2 {
+		t.Fatalf("expected 2 CodeDeploy deployments, got %d", len(codeDeployApi.createInputs))
+	}
+	rollback := codeDeployApi.createInputs[1]
+	if *rollback.ApplicationName != "AppECS-my-cluster-api" || !strings.Contains(*rollback.Revision.AppSpecContent.Content, "task-definition/my-family:1") {
+		t.Errorf("expected the old task definition deployed to the application, got %s: %s", *rollback.ApplicationName, *rollback.Revision.AppSpecContent.Content)
+	}
+}
+
+func TestCodeDeployAppSpec(t *testing.T) {
+	svc := ecs.Service{
+		LoadBalancers:   []*ecs.LoadBalancer{{ContainerName: aws.String("app"), ContainerPort: aws.Int64(8080)}},
+		PlatformVersion: aws.String("LATEST"),
+		NetworkConfiguration: &ecs.NetworkConfiguration{AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+			Subnets:        aws.StringSlice([]string{"subnet-1", "subnet-2"}),
+			SecurityGroups: aws.StringSlice([]string{"sg-1"}),
+			AssignPublicIp: aws.String("DISABLED"),
+		}},
+	}
+	want := `{"version":0.0,"Resources":[{"TargetService":{"Type":"AWS::ECS::Service","Properties":{"TaskDefinition":"arn:td:2",` +
+		`"LoadBalancerInfo":{"ContainerName":"app","ContainerPort":8080},"PlatformVersion":"LATEST",` +
+		`"NetworkConfiguration":{"AwsvpcConfiguration":{"Subnets":["subnet-1","subnet-2"],"SecurityGroups":["sg-1"],"AssignPublicIp":"DISABLED"}}}}}]}`
+	if got := codeDeployAppSpec(svc, "arn:td:2"); got != want {
+		t.Errorf("codeDeployAppSpec() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrWaitingForHealthyContainers the container health checks of the deployment tasks didn't report HEALTHY yet
+	ErrWaitingForHealthyContainers = errors.New("waiting for the deployment containers to be healthy")
+	// ErrContainersUnhealthy the container health checks of a deployment task reported UNHEALTHY
+	ErrContainersUnhealthy = errors.New("the deployment containers are unhealthy")
+)
+
+// healthCheckedContainers returns the names of the essential containers of the task definition declaring a health
+// check
+func healthCheckedContainers(ctx context.Context, api ecsiface.ECSAPI, taskDefinition *string) (map[string]bool, error) {
+	output, err := api.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: taskDefinition})
+	if err != nil {
+		return nil, fmt.Errorf("on health checked containers while describe task definition: %w", err)
+	}
+	names := map[string]bool{}
+	for _, containerDefinition := range output.TaskDefinition.ContainerDefinitions {
+		essential := containerDefinition.Essential == nil || *containerDefinition.Essential
+		if essential && containerDefinition.HealthCheck != nil {
+			names[aws.StringValue(containerDefinition.Name)] = true
+		}
+	}
+	return names, nil
+}
+
+// validateContainersHealthy waits until the RUNNING tasks of the PRIMARY deployment and their essential containers
+// declaring a health check report HEALTHY, a task or container reporting UNHEALTHY fails the deployment
+func validateContainersHealthy(ctx context.Context, api ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService ecs.Service, _ backoff.BackOff) error {
+	deployment := primaryDeployment(ecsService)
+	if deployment == nil {
+		return errNoPrimaryDeployment
+	}
+	checked, err := healthCheckedContainers(ctx, api, deployment.TaskDefinition)
+	if err != nil {
+		return err
+	}
+	tasks, err := describeDeploymentTasks(ctx, api, ecsService.ClusterArn, *deployment, ecs.DesiredStatusRunning)
+	if err != nil {
+		return err
+	}
+	if int64(len(tasks)) < aws.Int64Value(deployment.DesiredCount) {
+		return fmt.Errorf("%w: %d of %d tasks running", ErrNotRunningDesiredCount, len(tasks), aws.Int64Value(deployment.DesiredCount))
+	}
+	if len(checked) == 0 {
+		emit(ctx, HealthCheckMissing{Service: aws.StringValue(ecsService.ServiceName), DeploymentId: aws.StringValue(deployment.Id), TaskDefinition: aws.StringValue(deployment.TaskDefinition)})
+		return nil
+	}
+	var waiting, unhealthy []string
+	for _, task := range tasks {
+		taskArn := aws.StringValue(task.TaskArn)
+		var taskWaiting, taskUnhealthy []string
+		for _, container := range task.Containers {
+			name := aws.StringValue(container.Name)
+			if !checked[name] {
+				continue
+			}
+			switch aws.StringValue(container.HealthStatus) {
+			case ecs.HealthStatusHealthy:
+			case ecs.HealthStatusUnhealthy:
+				taskUnhealthy = append(taskUnhealthy, name)
+			default:
+				taskWaiting = append(taskWaiting, fmt.Sprintf("%s %s", name, aws.StringValue(container.HealthStatus)))
+			}
+		}
+		taskHealth := aws.StringValue(task.HealthStatus)
+		switch {
+		case len(taskUnhealthy) > 0:
+			sort.Strings(taskUnhealthy)
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", taskArn, strings.Join(taskUnhealthy, ", ")))
+		case taskHealth == ecs.HealthStatusUnhealthy:
+			unhealthy = append(unhealthy, taskArn)
+		case len(taskWaiting) > 0:
+			sort.Strings(taskWaiting)
+			waiting = append(waiting, fmt.Sprintf("%s (%s)", taskArn, strings.Join(taskWaiting, ", ")))
+		case taskHealth != ecs.HealthStatusHealthy:
+			waiting = append(waiting, fmt.Sprintf("%s %s", taskArn, taskHealth))
+		}
+	}
+	if len(unhealthy) > 0 {
+		return backoff.Permanent(fmt.Errorf("%w: %s", ErrContainersUnhealthy, strings.Join(unhealthy, ", ")))
+	}
+	if len(waiting) > 0 {
+		return fmt.Errorf("%w: %s", ErrWaitingForHealthyContainers, strings.Join(waiting, ", "))
+	}
+	return nil
+}
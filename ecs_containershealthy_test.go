@@ -0,0 +1,93 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/cenkalti/backoff"
+	"testing"
+)
+
+type mockHealthCheckEcsClient struct {
+	*mockDeployEcsClient
+}
+
+func (m *mockHealthCheckEcsClient) DescribeTaskDefinitionWithContext(ctx aws.Context, input *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	healthCheck := &ecs.HealthCheck{Command: aws.StringSlice([]string{"CMD-SHELL", "curl -f http://localhost/ || exit 1"})}
+	return &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{
+			TaskDefinitionArn: input.TaskDefinition,
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("my-container"), HealthCheck: healthCheck},
+				{Name: aws.String("my-sidecar"), Essential: aws.Bool(false), HealthCheck: healthCheck},
+				{Name: aws.String("my-logger")},
+			},
+		},
+	}, nil
+}
+
+func healthTask(arn, taskHealth, containerHealth, sidecarHealth string) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:           aws.String(arn),
+		StartedBy:         aws.String("ecs-svc/1"),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"),
+		HealthStatus:      aws.String(taskHealth),
+		Containers: []*ecs.Container{
+			{Name: aws.String("my-container"), HealthStatus: aws.String(containerHealth)},
+			{Name: aws.String("my-sidecar"), HealthStatus: aws.String(sidecarHealth)},
+			{Name: aws.String("my-logger"), HealthStatus: aws.String(ecs.HealthStatusUnknown)},
+		},
+	}
+}
+
+func TestValidateContainersHealthy(t *testing.T) {
+	healthy, unhealthy, unknown := ecs.HealthStatusHealthy, ecs.HealthStatusUnhealthy, ecs.HealthStatusUnknown
+	tests := []struct {
+		name      string
+		tasks     []*ecs.Task
+		want      error
+		permanent bool
+	}{
+		{
+			name:  "healthy",
+			tasks: []*ecs.Task{healthTask("task1", healthy, healthy, unhealthy), healthTask("task2", healthy, healthy, unknown)},
+		},
+		{
+			name:  "health checks pending",
+			tasks: []*ecs.Task{healthTask("task1", healthy, healthy, healthy), healthTask("task2", unknown, unknown, healthy)},
+			want:  ErrWaitingForHealthyContainers,
+		},
+		{
+			name:  "not running the desired count",
+			tasks: []*ecs.Task{healthTask("task1", healthy, healthy, healthy)},
+			want:  ErrNotRunningDesiredCount,
+		},
+		{
+			name:      "unhealthy essential container",
+			tasks:     []*ecs.Task{healthTask("task1", healthy, healthy, healthy), healthTask("task2", unhealthy, unhealthy, healthy)},
+			want:      ErrContainersUnhealthy,
+			permanent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &mockHealthCheckEcsClient{mockDeployEcsClient: newMockDeployEcsClient()}
+			api.tasks = map[string][]*ecs.Task{ecs.DesiredStatusRunning: tt.tasks}
+			svc := ecs.Service{
+				ClusterArn: api.service.ClusterArn,
+				Deployments: []*ecs.Deployment{
+					{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), TaskDefinition: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"), DesiredCount: aws.Int64(2)},
+				},
+			}
+			err := validateContainersHealthy(context.Background(), api, nil, svc, &backoff.ZeroBackOff{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+			if permanent := errors.Is(err, &backoff.PermanentError{}); permanent != tt.permanent {
+				t.Errorf("expected permanent %v, got %v", tt.permanent, permanent)
+			}
+		})
+	}
+}
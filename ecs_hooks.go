@@ -0,0 +1,143 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+)
+
+// DefaultHookTimeout time a hook may run when its Timeout is 0
+const DefaultHookTimeout = 10 * time.Minute
+
+// hookTaskStartedBy identifies the hook tasks in the cluster
+const hookTaskStartedBy = "awsecs-hook"
+
+// Environment variables received by the hooks
+const (
+	HookEnvOldTaskDefinition = "AWSECS_OLD_TASK_DEFINITION" // Task definition ARN of the service before the deployment
+	HookEnvNewTaskDefinition = "AWSECS_NEW_TASK_DEFINITION" // Task definition ARN deployed
+	HookEnvOutcome           = "AWSECS_OUTCOME"             // One of the Outcome values
+)
+
+// Outcome values of the HookEnvOutcome environment variable
+const (
+	OutcomeSuccess            = "success"
+	OutcomeSuccessfulRollback = "successful-rollback"
+	OutcomeFailedRollback     = "failed-rollback"
+)
+
+var (
+	// ErrHookFailed a post-success or post-rollback hook failed
+	ErrHookFailed = errors.New("the hook failed")
+	// ErrPostSuccessHookFailed the deployment succeeded, it is not rolled back, but a post-success hook failed
+	ErrPostSuccessHookFailed = errors.New("the deployment succeeded but a post-success hook failed")
+)
+
+// Hook runs after the deployment, env holds the HookEnv environment variables
+type Hook interface {
+	RunHook(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, env map[string]string) error
+}
+
+// CommandHook runs a local command with the HookEnv environment variables added to the environment
+type CommandHook struct {
+	Command []string      // Name and arguments of the command
+	Output  io.Writer     // Receives the stdout and stderr of the command, if nil os.Stderr is used
+	Timeout time.Duration // If 0 DefaultHookTimeout is used
+}
+
+// RunHook runs the command, a non-zero exit code fails the hook
+func (h *CommandHook) RunHook(ctx context.Context, _ ecsiface.ECSAPI, _ ecs.Service, env map[string]string) error {
+	if len(h.Command) == 0 {
+		return fmt.Errorf("%w: empty command", ErrHookFailed)
+	}
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(cmdCtx, h.Command[0], h.Command[1:]...)
+	cmd.Env = os.Environ()
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, env[name]))
+	}
+	cmd.Stdout, cmd.Stderr = h.Output, h.Output
+	if h.Output == nil {
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrHookFailed, h.Command[0], err)
+	}
+	return nil
+}
+
+// TaskHook runs a one-off task in the cluster of the service, with its launch type or capacity provider strategy and
+// network configuration, the HookEnv environment variables are added to the Container
+type TaskHook struct {
+	TaskDefinition string        // If empty the task definition the service runs after the deployment, the new one on success and the old one after a rollback
+	Container      string        // Required, container receiving the environment variables and the command override, its exit code must be zero
+	Command        []string      // If non empty overrides the command of the Container
+	Timeout        time.Duration // If 0 DefaultHookTimeout is used
+}
+
+// RunHook runs the task and waits for it to stop
+func (h *TaskHook) RunHook(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, env map[string]string) error {
+	if h.Container == "" {
+		return fmt.Errorf("%w: the container receiving the environment variables is required", ErrHookFailed)
+	}
+	taskDefinition := h.TaskDefinition
+	if taskDefinition == "" {
+		taskDefinition = env[HookEnvOldTaskDefinition]
+		if env[HookEnvOutcome] == OutcomeSuccess {
+			taskDefinition = env[HookEnvNewTaskDefinition]
+		}
+	}
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	return runOneOffTask(ctx, api, svc, taskDefinition, oneOffTask{
+		name:        "hook",
+		startedBy:   hookTaskStartedBy,
+		container:   h.Container,
+		command:     h.Command,
+		environment: env,
+		timeout:     timeout,
+		errFailed:   ErrHookFailed,
+		errTimeout:  ErrHookFailed,
+	})
+}
+
+func hookEnv(oldsvc, newsvc ecs.Service, outcome string) map[string]string {
+	return map[string]string{
+		HookEnvOldTaskDefinition: aws.StringValue(oldsvc.TaskDefinition),
+		HookEnvNewTaskDefinition: aws.StringValue(newsvc.TaskDefinition),
+		HookEnvOutcome:           outcome,
+	}
+}
+
+// runHooks runs the hooks in order, the first failing hook stops the others
+func runHooks(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, hooks []Hook, env map[string]string) error {
+	for _, hook := range hooks {
+		if err := hook.RunHook(ctx, api, svc, env); err != nil {
+			return err
+		}
+	}
+	if len(hooks) > 0 {
+		emit(ctx, HooksSucceeded{Service: aws.StringValue(svc.ServiceName), Outcome: env[HookEnvOutcome]})
+	}
+	return nil
+}
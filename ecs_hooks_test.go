@@ -0,0 +1,120 @@
+package awsecs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordingHook struct {
+	envs []map[string]string
+	err  error
+}
+
+func (h *recordingHook) RunHook(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, env map[string]string) error {
+	h.envs = append(h.envs, env)
+	return h.err
+}
+
+func TestCommandHook(t *testing.T) {
+	output := &bytes.Buffer{}
+	hook := &CommandHook{Command: []string{"sh", "-c", `echo "$AWSECS_OUTCOME $AWSECS_NEW_TASK_DEFINITION"`}, Output: output}
+	if err := hook.RunHook(context.Background(), nil, ecs.Service{}, map[string]string{HookEnvOutcome: OutcomeSuccess, HookEnvNewTaskDefinition: "my-family:2"}); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "success my-family:2\n" {
+		t.Errorf("unexpected command output %q", output.String())
+	}
+	hook = &CommandHook{Command: []string{"sh", "-c", "exit 3"}, Output: output}
+	if err := hook.RunHook(context.Background(), nil, ecs.Service{}, nil); !errors.Is(err, ErrHookFailed) {
+		t.Errorf("expected %v, got %v", ErrHookFailed, err)
+	}
+}
+
+func TestTaskHook(t *testing.T) {
+	defer func(interval time.Duration) { oneOffTaskPollInterval = interval }(oneOffTaskPollInterval)
+	oneOffTaskPollInterval = time.Millisecond
+	api := &mockPreDeployEcsClient{mockDeployEcsClient: newMockDeployEcsClient(), exitCode: aws.Int64(0)}
+	hook := &TaskHook{Container: "my-container", Command: []string{"./announce.sh"}}
+	env := map[string]string{HookEnvOldTaskDefinition: "my-family:1", HookEnvNewTaskDefinition: "my-family:2", HookEnvOutcome: OutcomeSuccessfulRollback}
+	if err := hook.RunHook(context.Background(), api, *api.service, env); err != nil {
+		t.Fatal(err)
+	}
+	if *api.runInput.TaskDefinition != "my-family:1" || *api.runInput.StartedBy != hookTaskStartedBy {
+		t.Errorf("expected the old task definition to run after a rollback, got %v", api.runInput)
+	}
+	want := []*ecs.KeyValuePair{
+		{Name: aws.String(HookEnvNewTaskDefinition), Value: aws.String("my-family:2")},
+		{Name: aws.String(HookEnvOldTaskDefinition), Value: aws.String("my-family:1")},
+		{Name: aws.String(HookEnvOutcome), Value: aws.String(OutcomeSuccessfulRollback)},
+	}
+	if got := api.runInput.Overrides.ContainerOverrides[0].Environment; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected environment overrides %v", got)
+	}
+
+	api.runInput = nil
+	hook = &TaskHook{Command: []string{"./announce.sh"}}
+	if err := hook.RunHook(context.Background(), api, *api.service, env); !errors.Is(err, ErrHookFailed) {
+		t.Errorf("expected %v without a container, got %v", ErrHookFailed, err)
+	}
+	if api.runInput != nil {
+		t.Errorf("expected no task to run without a container, got %v", api.runInput)
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackHooks(t *testing.T) {
+	failing := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		if *svc.TaskDefinition == "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+			return backoff.Permanent(errNotReady)
+		}
+		return nil
+	}
+	hookErr := errors.New("hook failed")
+	tests := []struct {
+		name         string
+		validate     ValidateDeploymentFunc
+		hookErr      error
+		wantErr      error
+		wantUpdates  int
+		wantSuccess  int
+		wantRollback string
+	}{
+		{name: "success", validate: validateDeployment, wantUpdates: 1, wantSuccess: 1},
+		{name: "failing post-success hook", validate: validateDeployment, hookErr: hookErr, wantErr: ErrPostSuccessHookFailed, wantUpdates: 1, wantSuccess: 1},
+		{name: "rollback", validate: failing, wantErr: ErrSuccessfulRollback, wantUpdates: 2, wantRollback: OutcomeSuccessfulRollback},
+		{name: "failing post-rollback hook", validate: failing, hookErr: hookErr, wantErr: ErrSuccessfulRollback, wantUpdates: 2, wantRollback: OutcomeSuccessfulRollback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockDeployEcsClient()
+			success, rollback := &recordingHook{err: tt.hookErr}, &recordingHook{err: tt.hookErr}
+			bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+			err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, PostSuccessHooks: []Hook{success}, PostRollbackHooks: []Hook{rollback}, BackOff: bo}, tt.validate, tt.validate)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if len(api.updateInputs) != tt.wantUpdates {
+				t.Errorf("expected %d updates, got %d", tt.wantUpdates, len(api.updateInputs))
+			}
+			if len(success.envs) != tt.wantSuccess {
+				t.Errorf("expected %d post-success hook runs, got %d", tt.wantSuccess, len(success.envs))
+			}
+			if tt.wantRollback == "" && len(rollback.envs) != 0 || tt.wantRollback != "" && (len(rollback.envs) != 1 || rollback.envs[0][HookEnvOutcome] != tt.wantRollback) {
+				t.Errorf("expected post-rollback hook outcome %q, got %v", tt.wantRollback, rollback.envs)
+			}
+			for _, env := range append(success.envs, rollback.envs...) {
+				if env[HookEnvOldTaskDefinition] != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" || env[HookEnvNewTaskDefinition] != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+					t.Errorf("unexpected hook environment %v", env)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package awsecs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrImageDigestNotFound the image could not be resolved to a digest
+	ErrImageDigestNotFound = errors.New("image digest not found")
+	// ErrECRAPIRequired the ECRImageResolver has no NewECRAPI to resolve Amazon ECR images with
+	ErrECRAPIRequired = errors.New("ECR API required to resolve Amazon ECR images")
+)
+
+var (
+	ecrDomainRegexp      = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+	challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// manifestMediaTypes accepted when resolving a tag, the digest of a multi-platform image is the digest of its index
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// ImageResolver resolves a container image to its immutable repo@sha256:... form
+type ImageResolver interface {
+	ResolveImage(ctx context.Context, image string) (string, error)
+}
+
+// HTTPClient the subset of *http.Client used by this package
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type imageReference struct {
+	name       string // as referenced, without tag nor digest
+	domain     string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseImageReference(image string) imageReference {
+	ref := imageReference{name: image, tag: "latest"}
+	if i := strings.Index(ref.name, "@"); i >= 0 {
+		ref.name, ref.digest = ref.name[:i], ref.name[i+1:]
+	}
+	if i := strings.LastIndex(ref.name, ":"); i > strings.LastIndex(ref.name, "/") {
+		ref.name, ref.tag = ref.name[:i], ref.name[i+1:]
+	}
+	parts := strings.SplitN(ref.name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.domain, ref.repository = parts[0], parts[1]
+	} else {
+		ref.domain, ref.repository = "docker.io", ref.name
+	}
+	if ref.domain == "index.docker.io" {
+		ref.domain = "docker.io"
+	}
+	// the official Docker Hub images live in the library namespace
+	if ref.domain == "docker.io" && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	return ref
+}
+
+func (ref imageReference) pinned(digest string) string {
+	return ref.name + "@" + digest
+}
+
+// ECRImageResolver resolves Amazon ECR images with the DescribeImages API
+type ECRImageResolver struct {
+	NewECRAPI func(region string) ecriface.ECRAPI // ECR Api for the region of the registry
+	Fallback  ImageResolver                       // If non nil used to resolve images not hosted in Amazon ECR
+}
+
+// ResolveImage resolves an Amazon ECR image to its digest
+func (r *ECRImageResolver) ResolveImage(ctx context.Context, image string) (string, error) {
+	ref := parseImageReference(image)
+	if ref.digest != "" {
+		return image, nil
+	}
+	match := ecrDomainRegexp.FindStringSubmatch(ref.domain)
+	if match == nil {
+		if r.Fallback != nil {
+			return r.Fallback.ResolveImage(ctx, image)
+		}
+		return "", fmt.Errorf("%w: %s is not an Amazon ECR image", ErrImageDigestNotFound, image)
+	}
+	if r.NewECRAPI == nil {
+		return "", fmt.Errorf("%w: %s", ErrECRAPIRequired, image)
+	}
+	output, err := r.NewECRAPI(match[2]).DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(match[1]),
+		RepositoryName: aws.String(ref.repository),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(ref.tag)}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("on resolve image %s while describe images: %w", image, err)
+	}
+	for _, detail := range output.ImageDetails {
+		if detail.ImageDigest != nil {
+			return ref.pinned(*detail.ImageDigest), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrImageDigestNotFound, image)
+}
+
+// RegistryImageResolver resolves images with a Docker Registry HTTP API V2 manifest HEAD request, registries
+// requiring a bearer token are accessed anonymously
+type RegistryImageResolver struct {
+	Client HTTPClient // If nil http.DefaultClient is used
+}
+
+func (r *RegistryImageResolver) client() HTTPClient {
+	if r.Client == nil {
+		return http.DefaultClient
+	}
+	return r.Client
+}
+
+func (r *RegistryImageResolver) headManifest(ctx context.Context, manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func parseBearerChallenge(challenge string) (map[string]string, bool) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, false
+	}
+	params := map[string]string{}
+	for _, param := range challengeParamRegexp.FindAllStringSubmatch(challenge[len("bearer "):], -1) {
+		params[strings.ToLower(param[1])] = param[2]
+	}
+	return params, params["realm"] != ""
+}
+
+func (r *RegistryImageResolver) token(ctx context.Context, challenge string) (string, error) {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	for _, name := range []string{"service", "scope"} {
+		if params[name] != "" {
+			query.Set(name, params[name])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with status %s", resp.Status)
+	}
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// ResolveImage resolves an image to its digest using the registry API
+func (r *RegistryImageResolver) ResolveImage(ctx context.Context, image string) (string, error) {
+	ref := parseImageReference(image)
+	if ref.digest != "" {
+		return image, nil
+	}
+	host := ref.domain
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, ref.repository, ref.tag)
+	resp, err := r.headManifest(ctx, manifestURL, "")
+	if err != nil {
+		return "", fmt.Errorf("on resolve image %s: %w", image, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := r.token(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", fmt.Errorf("on resolve image %s while authenticate: %w", image, err)
+		}
+		resp, err = r.headManifest(ctx, manifestURL, token)
+		if err != nil {
+			return "", fmt.Errorf("on resolve image %s: %w", image, err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s manifest request failed with status %s", ErrImageDigestNotFound, image, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("%w: %s registry did not return Docker-Content-Digest", ErrImageDigestNotFound, image)
+	}
+	return ref.pinned(digest), nil
+}
+
+func pinImageDigests(ctx context.Context, copy ecs.RegisterTaskDefinitionInput, resolver ImageResolver) (ecs.RegisterTaskDefinitionInput, error) {
+	obj := panicMarshal(copy)
+	copyClone := ecs.RegisterTaskDefinitionInput{}
+	panicUnmarshal(obj, &copyClone)
+	resolved := map[string]string{}
+	for _, containerDefinition := range copyClone.ContainerDefinitions {
+		if containerDefinition.Image == nil {
+			continue
+		}
+		image := *containerDefinition.Image
+		if _, found := resolved[image]; !found {
+			pinned, err := resolver.ResolveImage(ctx, image)
+			if err != nil {
+				return ecs.RegisterTaskDefinitionInput{}, err
+			}
+			resolved[image] = pinned
+		}
+		containerDefinition.Image = aws.String(resolved[image])
+	}
+	return copyClone, nil
+}
@@ -0,0 +1,188 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/cenkalti/backoff"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type stubImageResolver map[string]string
+
+func (s stubImageResolver) ResolveImage(ctx context.Context, image string) (string, error) {
+	if pinned, found := s[image]; found {
+		return pinned, nil
+	}
+	return "", ErrImageDigestNotFound
+}
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  imageReference
+	}{
+		{
+			image: "nginx",
+			want:  imageReference{name: "nginx", domain: "docker.io", repository: "library/nginx", tag: "latest"},
+		},
+		{
+			image: "docker.io/nginx:1.25",
+			want:  imageReference{name: "docker.io/nginx", domain: "docker.io", repository: "library/nginx", tag: "1.25"},
+		},
+		{
+			image: "index.docker.io/library/nginx",
+			want:  imageReference{name: "index.docker.io/library/nginx", domain: "docker.io", repository: "library/nginx", tag: "latest"},
+		},
+		{
+			image: "myrepo/myimg:newtag",
+			want:  imageReference{name: "myrepo/myimg", domain: "docker.io", repository: "myrepo/myimg", tag: "newtag"},
+		},
+		{
+			image: "localhost:5000/myimg:newtag",
+			want:  imageReference{name: "localhost:5000/myimg", domain: "localhost:5000", repository: "myimg", tag: "newtag"},
+		},
+		{
+			image: "123456789012.dkr.ecr.us-west-2.amazonaws.com/team/myimg@sha256:0123",
+			want:  imageReference{name: "123456789012.dkr.ecr.us-west-2.amazonaws.com/team/myimg", domain: "123456789012.dkr.ecr.us-west-2.amazonaws.com", repository: "team/myimg", tag: "latest", digest: "sha256:0123"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := parseImageReference(tt.image); got != tt.want {
+				t.Errorf("parseImageReference() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type mockEcrClient struct {
+	ecriface.ECRAPI
+	region string
+	input  *ecr.DescribeImagesInput
+}
+
+func (m *mockEcrClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	m.input = input
+	return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{ImageDigest: aws.String("sha256:0123")}}}, nil
+}
+
+func TestECRImageResolver(t *testing.T) {
+	api := &mockEcrClient{}
+	resolver := &ECRImageResolver{
+		NewECRAPI: func(region string) ecriface.ECRAPI {
+			api.region = region
+			return api
+		},
+		Fallback: stubImageResolver{"nginx:latest": "nginx@sha256:4567"},
+	}
+	got, err := resolver.ResolveImage(context.Background(), "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/myimg:newtag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/myimg@sha256:0123" {
+		t.Errorf("unexpected resolved image %s", got)
+	}
+	if api.region != "eu-west-1" || *api.input.RegistryId != "123456789012" || *api.input.RepositoryName != "team/myimg" || *api.input.ImageIds[0].ImageTag != "newtag" {
+		t.Errorf("unexpected describe images request %v in %s", api.input, api.region)
+	}
+	got, err = resolver.ResolveImage(context.Background(), "nginx:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "nginx@sha256:4567" {
+		t.Errorf("unexpected fallback resolved image %s", got)
+	}
+	if _, err := (&ECRImageResolver{}).ResolveImage(context.Background(), "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/myimg:newtag"); !errors.Is(err, ErrECRAPIRequired) {
+		t.Errorf("expected %v, got %v", ErrECRAPIRequired, err)
+	}
+}
+
+func TestRegistryImageResolver(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.URL.Query().Get("scope") != "repository:myimg:pull" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token": "mytoken"}`))
+		case "/v2/myimg/manifests/newtag":
+			if r.Method != http.MethodHead || !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer mytoken" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:myimg:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:89ab")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	resolver := &RegistryImageResolver{Client: server.Client()}
+	got, err := resolver.ResolveImage(context.Background(), host+"/myimg:newtag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != host+"/myimg@sha256:89ab" {
+		t.Errorf("unexpected resolved image %s", got)
+	}
+	if _, err := resolver.ResolveImage(context.Background(), host+"/myimg:othertag"); !errors.Is(err, ErrImageDigestNotFound) {
+		t.Errorf("expected %v, got %v", ErrImageDigestNotFound, err)
+	}
+}
+
+func TestPinImageDigests(t *testing.T) {
+	input := ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("app"), Image: aws.String("myrepo/myimg:newtag")},
+			{Name: aws.String("sidecar"), Image: aws.String("myrepo/sidecar@sha256:0123")},
+		},
+	}
+	resolver := stubImageResolver{
+		"myrepo/myimg:newtag":        "myrepo/myimg@sha256:4567",
+		"myrepo/sidecar@sha256:0123": "myrepo/sidecar@sha256:0123",
+	}
+	got, err := pinImageDigests(context.Background(), input, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("app"), Image: aws.String("myrepo/myimg@sha256:4567")},
+			{Name: aws.String("sidecar"), Image: aws.String("myrepo/sidecar@sha256:0123")},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pinImageDigests() = %v, want %v", got, want)
+	}
+	if *input.ContainerDefinitions[0].Image != "myrepo/myimg:newtag" {
+		t.Errorf("pinImageDigests() must not alter its input")
+	}
+}
+
+func TestPinImageDigestsFailureAbortsBeforeRegister(t *testing.T) {
+	api := newMockDeployEcsClient()
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, ImageResolver: stubImageResolver{}, BackOff: bo}, validateDeployment, validateDeployment)
+	if !errors.Is(err, ErrImageDigestNotFound) {
+		t.Fatalf("expected %v, got %v", ErrImageDigestNotFound, err)
+	}
+	if api.registerInput != nil || len(api.updateInputs) != 0 {
+		t.Errorf("nothing must be registered nor updated")
+	}
+}
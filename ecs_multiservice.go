@@ -0,0 +1,310 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"strings"
+	"sync"
+)
+
+// OutcomeNotUpdated the service was left untouched, because the deployment failed before updating it or it was never
+// reached after another service failed
+const OutcomeNotUpdated = "not-updated"
+
+var (
+	// ErrOtherServiceFailed the service was rolled back because the deployment of another service failed
+	ErrOtherServiceFailed = errors.New("the deployment of another service failed")
+	// ErrNoServices no services to update
+	ErrNoServices = errors.New("no services to update")
+)
+
+// ECSMultiServiceUpdate updates several services as a single rollback unit, if the deployment of any service fails
+// every service already updated is rolled back to its previous task definition and desired count
+type ECSMultiServiceUpdate struct {
+	Services      []ECSServiceUpdate // Updates of each service, each one needs its own BackOff
+	Parallel      bool               // If true the services are updated at the same time, otherwise in order, each once the previous one is validated
+	PreDeployTask *PreDeployTask     // If non nil, run once with the new task definition of the first service before any service is updated, the services are only updated if it succeeds
+}
+
+// ServiceResult outcome of the update of one of the services of an ECSMultiServiceUpdate
+type ServiceResult struct {
+	Cluster string // Cluster which the service is deployed to
+	Service string // Name of the service
+	Outcome string // One of OutcomeSuccess, OutcomeSuccessfulRollback, OutcomeFailedRollback or OutcomeNotUpdated
+	Err     error  // Why the service was rolled back or not updated, or why its post-success hooks failed
+}
+
+// serviceDeployment state of the update of one service
+type serviceDeployment struct {
+	update           *ECSServiceUpdate
+	validate         ValidateDeploymentFunc
+	validateRollback ValidateDeploymentFunc
+	oldsvc           ecs.Service
+	newsvc           ecs.Service
+	err              error
+	stopped          bool // The deployment was stopped because another one failed
+	result           ServiceResult
+}
+
+func newServiceDeployment(update *ECSServiceUpdate) (*serviceDeployment, error) {
+	validate, err := update.validator()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", update.Service, err)
+	}
+	validateRollback, err := update.rollbackValidator()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", update.Service, err)
+	}
+	return &serviceDeployment{
+		update:           update,
+		validate:         validate,
+		validateRollback: validateRollback,
+		result:           ServiceResult{Cluster: update.Cluster, Service: update.Service, Outcome: OutcomeNotUpdated},
+	}, nil
+}
+
+func (d *serviceDeployment) deploy(ctx context.Context) error {
+	e := d.update
+	ctx = withEventSink(ctx, e.EventSink)
+	if e.Canary != nil {
+		taskDefinition, err := e.deployCanary(ctx)
+		if err != nil {
+			d.err = err
+			return err
+		}
+		// the canary served its purpose whatever the outcome of the service
+		defer scaleDownCanary(detachedContext{parent: ctx}, e.EcsApi, e.Cluster, e.Service)
+		e = e.promoteCanary(taskDefinition)
+	}
+	d.oldsvc, d.newsvc, d.err = alterServiceValidateDeployment(ctx, e, d.validate)
+	return d.err
+}
+
+// rollBack rolls the service back if it was updated, cause is the failure of the deployment which stopped the others
+func (d *serviceDeployment) rollBack(ctx context.Context, cause error) {
+	reason := d.err
+	if reason == nil || d.stopped {
+		reason = fmt.Errorf("%w: %v", ErrOtherServiceFailed, cause)
+	}
+	d.result.Err = reason
+	e := d.update
+	ctx = withEventSink(ctx, e.EventSink)
+	rollbackErr := rollBackService(ctx, e.EcsApi, e.ElbApi, e.CodeDeploy, d.oldsvc, d.newsvc, reason, e.BackOff, d.validateRollback)
+	if rollbackErr == ErrNothingToRollback {
+		return
+	}
+	d.result.Outcome, d.result.Err = rollbackOutcome(rollbackErr), rollbackErr
+	emit(ctx, ServiceRolledBack{Service: e.Service, Outcome: d.result.Outcome, Err: rollbackErr})
+	// the rollback outcome is what matters, a failing post-rollback hook is only emitted
+	if err := runHooks(ctx, e.EcsApi, d.oldsvc, e.PostRollbackHooks, hookEnv(d.oldsvc, d.newsvc, d.result.Outcome)); err != nil {
+		emit(ctx, PostRollbackHooksFailed{Service: e.Service, Outcome: d.result.Outcome, Err: err})
+	}
+}
+
+// succeed runs the post-success hooks of the validated service, a failing hook doesn't roll it back
+func (d *serviceDeployment) succeed(ctx context.Context) error {
+	d.result.Outcome = OutcomeSuccess
+	if err := runHooks(ctx, d.update.EcsApi, d.newsvc, d.update.PostSuccessHooks, hookEnv(d.oldsvc, d.newsvc, OutcomeSuccess)); err != nil {
+		d.result.Err = fmt.Errorf("%w: %v", ErrPostSuccessHookFailed, err)
+	}
+	return d.result.Err
+}
+
+// schedule calls run for every item once the items it comes after returned true, at most maxParallel at the same
+// time, if 0 without limit. Once run returns false no other item starts, schedule returns when the running ones return
+func schedule(after [][]int, maxParallel int, run func(i int) bool) {
+	done := make(chan int)
+	started, succeeded := make([]bool, len(after)), make([]bool, len(after))
+	running, failed := 0, false
+	for {
+		for i := range after {
+			if failed || maxParallel > 0 && running >= maxParallel {
+				break
+			}
+			ready := !started[i]
+			for _, j := range after[i] {
+				ready = ready && succeeded[j]
+			}
+			if ready {
+				started[i] = true
+				running++
+				go func(i int) {
+					if run(i) {
+						done <- i
+					} else {
+						done <- -1 - i
+					}
+				}(i)
+			}
+		}
+		if running == 0 {
+			return
+		}
+		i := <-done
+		running--
+		if i < 0 {
+			failed = true
+		} else {
+			succeeded[i] = true
+		}
+	}
+}
+
+// reverseEdges returns the dependencies of the rollback, an item is rolled back once the items coming after it were
+func reverseEdges(after [][]int) [][]int {
+	before := make([][]int, len(after))
+	for i, dependencies := range after {
+		for _, j := range dependencies {
+			before[j] = append(before[j], i)
+		}
+	}
+	return before
+}
+
+// deployServices deploys the services following the dependencies, the first failure stops the deployments still in
+// progress and is returned
+func deployServices(ctx context.Context, deployments []*serviceDeployment, after [][]int, maxParallel int) error {
+	deployCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var cause error
+	var once sync.Once
+	schedule(after, maxParallel, func(i int) bool {
+		d := deployments[i]
+		if err := d.deploy(deployCtx); err != nil {
+			d.stopped = deployCtx.Err() != nil && ctx.Err() == nil
+			once.Do(func() {
+				emit(withEventSink(ctx, d.update.EventSink), ServiceDeploymentFailed{Service: d.update.Service, Err: err})
+				cause = err
+				cancel()
+			})
+			return false
+		}
+		return true
+	})
+	return cause
+}
+
+// rollBackServices rolls the services back in the reverse order of the dependencies
+func rollBackServices(ctx context.Context, deployments []*serviceDeployment, after [][]int, maxParallel int, cause error) {
+	schedule(reverseEdges(after), maxParallel, func(i int) bool {
+		deployments[i].rollBack(ctx, cause)
+		// every updated service must be rolled back, even when the rollback of another one failed
+		return true
+	})
+}
+
+// rollbackResult returns a *RollbackError of cause, without the old and new service, its Err lists why services
+// failed to roll back, if any. Returns cause if no service was rolled back
+func rollbackResult(deployments []*serviceDeployment, cause error) error {
+	rolledBack := false
+	var failures errorList
+	for _, d := range deployments {
+		switch d.result.Outcome {
+		case OutcomeFailedRollback:
+			var rollbackErr *RollbackError
+			if errors.As(d.result.Err, &rollbackErr) {
+				failures = append(failures, fmt.Errorf("%s: %w", d.update.Service, rollbackErr.Err))
+			}
+			rolledBack = true
+		case OutcomeSuccessfulRollback:
+			rolledBack = true
+		}
+	}
+	if !rolledBack {
+		return cause
+	}
+	rollbackErr := &RollbackError{Cause: cause}
+	if len(failures) > 0 {
+		rollbackErr.Err = failures
+	}
+	return rollbackErr
+}
+
+// Apply the ECS Multi Service Update
+func (m *ECSMultiServiceUpdate) Apply() ([]ServiceResult, error) {
+	return m.ApplyWithContext(context.Background())
+}
+
+// ApplyWithContext applies the ECS Multi Service Update and returns the outcome of every service, in the order of
+// Services. Returns nil if every service was validated, ErrSuccessfulRollback or ErrFailedRollback if services were
+// rolled back, ErrPostSuccessHookFailed if a post-success hook failed or the error of the deployment if no service was
+// updated. If the context is cancelled the update is rolled back
+func (m *ECSMultiServiceUpdate) ApplyWithContext(ctx context.Context) ([]ServiceResult, error) {
+	if len(m.Services) == 0 {
+		return nil, ErrNoServices
+	}
+	deployments := make([]*serviceDeployment, len(m.Services))
+	after := make([][]int, len(m.Services))
+	for i := range m.Services {
+		d, err := newServiceDeployment(&m.Services[i])
+		if err != nil {
+			return nil, err
+		}
+		deployments[i] = d
+		if !m.Parallel && i > 0 {
+			after[i] = []int{i - 1}
+		}
+	}
+
+	if m.PreDeployTask != nil {
+		update, err := m.Services[0].preDeploy(withEventSink(ctx, m.Services[0].EventSink), *m.PreDeployTask)
+		if err != nil {
+			return serviceResults(leftNotUpdated(deployments, err)), err
+		}
+		deployments[0].update = update
+	}
+
+	var err error
+	if cause := deployServices(ctx, deployments, after, 0); cause != nil {
+		rollBackServices(detachedContext{parent: ctx}, deployments, after, 0, cause)
+		err = rollbackResult(deployments, cause)
+	} else {
+		for _, d := range deployments {
+			if hookErr := d.succeed(ctx); hookErr != nil {
+				err = hookErr
+			}
+		}
+	}
+	return serviceResults(deployments), err
+}
+
+func serviceResults(deployments []*serviceDeployment) []ServiceResult {
+	results := make([]ServiceResult, len(deployments))
+	for i, d := range deployments {
+		results[i] = d.result
+	}
+	return results
+}
+
+// leftNotUpdated records err as the reason the services of the deployments were not updated
+func leftNotUpdated(deployments []*serviceDeployment, err error) []*serviceDeployment {
+	for _, d := range deployments {
+		d.result.Err = err
+	}
+	return deployments
+}
+
+// Plan the ECS Multi Service Update without registering the task definitions nor updating the services
+func (m *ECSMultiServiceUpdate) Plan() (string, error) {
+	return m.PlanWithContext(context.Background())
+}
+
+// PlanWithContext plans the ECS Multi Service Update using the provided context, the plans of the services are
+// separated by an empty line
+func (m *ECSMultiServiceUpdate) PlanWithContext(ctx context.Context) (string, error) {
+	return planServices(ctx, m.Services)
+}
+
+func planServices(ctx context.Context, updates []ECSServiceUpdate) (string, error) {
+	var plans []string
+	for i := range updates {
+		plan, err := updates[i].PlanWithContext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", updates[i].Service, err)
+		}
+		plans = append(plans, plan)
+	}
+	return strings.Join(plans, "\n"), nil
+}
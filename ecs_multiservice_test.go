@@ -0,0 +1,151 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestECSMultiServiceUpdate(t *testing.T) {
+	failWorker := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		if *svc.ServiceName == "worker" && *svc.TaskDefinition == "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+			return backoff.Permanent(errNotReady)
+		}
+		return nil
+	}
+	pass := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		return nil
+	}
+	tests := []struct {
+		name         string
+		parallel     bool
+		validate     ValidateDeploymentFunc
+		wantErr      error
+		wantOutcomes []string // If nil any outcome is accepted, as long as no service is left updated
+		wantUpdates  []int
+	}{
+		{name: "in order", validate: pass, wantOutcomes: []string{OutcomeSuccess, OutcomeSuccess, OutcomeSuccess}, wantUpdates: []int{1, 1, 1}},
+		{name: "in order failed", validate: failWorker, wantErr: ErrSuccessfulRollback, wantOutcomes: []string{OutcomeSuccessfulRollback, OutcomeSuccessfulRollback, OutcomeNotUpdated}, wantUpdates: []int{2, 2, 0}},
+		{name: "parallel", parallel: true, validate: pass, wantOutcomes: []string{OutcomeSuccess, OutcomeSuccess, OutcomeSuccess}, wantUpdates: []int{1, 1, 1}},
+		{name: "parallel failed", parallel: true, validate: failWorker, wantErr: ErrSuccessfulRollback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var apis []*mockDeployEcsClient
+			update := ECSMultiServiceUpdate{Parallel: tt.parallel}
+			for _, service := range []string{"api", "worker", "scheduler"} {
+				api := newMockDeployEcsClient()
+				api.service.ServiceName = aws.String(service)
+				apis = append(apis, api)
+				update.Services = append(update.Services, ECSServiceUpdate{
+					EcsApi:     api,
+					Cluster:    "my-cluster",
+					Service:    service,
+					Image:      map[string]string{"my-container": "myrepo/myimg:newtag"},
+					BackOff:    backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+					Validators: []ValidateDeploymentFunc{tt.validate},
+				})
+			}
+			results, err := update.Apply()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			var outcomes []string
+			for _, result := range results {
+				outcomes = append(outcomes, result.Outcome)
+			}
+			if tt.wantOutcomes != nil && !reflect.DeepEqual(outcomes, tt.wantOutcomes) {
+				t.Errorf("expected outcomes %v, got %v", tt.wantOutcomes, outcomes)
+			}
+			for i, api := range apis {
+				if tt.wantUpdates != nil && len(api.updateInputs) != tt.wantUpdates[i] {
+					t.Errorf("%s: expected %d updates, got %d", results[i].Service, tt.wantUpdates[i], len(api.updateInputs))
+				}
+				if tt.wantErr != nil && *api.service.TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" {
+					t.Errorf("%s: expected the service rolled back, got %s", results[i].Service, *api.service.TaskDefinition)
+				}
+			}
+			if tt.wantErr != nil && (!errors.Is(results[1].Err, errNotReady) || !errors.Is(results[0].Err, ErrOtherServiceFailed) && results[0].Outcome != OutcomeNotUpdated) {
+				t.Errorf("unexpected service errors %v, %v", results[0].Err, results[1].Err)
+			}
+			var rollbackErr *RollbackError
+			if tt.wantErr != nil && (!errors.As(err, &rollbackErr) || !errors.Is(rollbackErr.Cause, errNotReady) || rollbackErr.Err != nil) {
+				t.Errorf("expected a successful RollbackError caused by the worker, got %#v", err)
+			}
+		})
+	}
+}
+
+func TestECSMultiServiceUpdatePreDeployTask(t *testing.T) {
+	defer func(interval time.Duration) { oneOffTaskPollInterval = interval }(oneOffTaskPollInterval)
+	oneOffTaskPollInterval = time.Millisecond
+	tests := []struct {
+		name        string
+		exitCode    int64
+		wantErr     error
+		wantOutcome string
+		wantUpdates int
+	}{
+		{name: "succeeded", exitCode: 0, wantOutcome: OutcomeSuccess, wantUpdates: 1},
+		{name: "failed", exitCode: 1, wantErr: ErrPreDeployTaskFailed, wantOutcome: OutcomeNotUpdated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preDeployApi := &mockPreDeployEcsClient{mockDeployEcsClient: newMockDeployEcsClient(), exitCode: aws.Int64(tt.exitCode)}
+			preDeployApi.service.ServiceName = aws.String("api")
+			apis := []*mockDeployEcsClient{preDeployApi.mockDeployEcsClient}
+			update := ECSMultiServiceUpdate{Parallel: true, PreDeployTask: &PreDeployTask{Container: "my-container"}}
+			update.Services = append(update.Services, ECSServiceUpdate{EcsApi: preDeployApi, Cluster: "my-cluster", Service: "api", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)})
+			for _, service := range []string{"worker", "scheduler"} {
+				api := newMockDeployEcsClient()
+				api.service.ServiceName = aws.String(service)
+				apis = append(apis, api)
+				update.Services = append(update.Services, ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: service, Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)})
+			}
+			results, err := update.Apply()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			// the pre-deploy task runs once, before any service is updated
+			if preDeployApi.describes == 0 || *preDeployApi.runInput.TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+				t.Errorf("expected the pre-deploy task to run the new task definition, got %v", preDeployApi.runInput)
+			}
+			for i, api := range apis {
+				if results[i].Outcome != tt.wantOutcome || len(api.updateInputs) != tt.wantUpdates {
+					t.Errorf("%s: expected %s and %d updates, got %s and %d", results[i].Service, tt.wantOutcome, tt.wantUpdates, results[i].Outcome, len(api.updateInputs))
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackResult(t *testing.T) {
+	failedTasks := &FailedTasksError{}
+	deployments := []*serviceDeployment{
+		{update: &ECSServiceUpdate{Service: "api"}, result: ServiceResult{Outcome: OutcomeFailedRollback, Err: &RollbackError{Cause: errNotReady, Err: context.DeadlineExceeded}}},
+		{update: &ECSServiceUpdate{Service: "worker"}, result: ServiceResult{Outcome: OutcomeFailedRollback, Err: &RollbackError{Cause: errNotReady, Err: failedTasks}}},
+		{update: &ECSServiceUpdate{Service: "web"}, result: ServiceResult{Outcome: OutcomeNotUpdated}},
+	}
+	err := rollbackResult(deployments, errNotReady)
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || !errors.Is(rollbackErr.Cause, errNotReady) || !errors.Is(err, ErrFailedRollback) {
+		t.Fatalf("expected a failed RollbackError caused by %v, got %v", errNotReady, err)
+	}
+	var got *FailedTasksError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &got) || got != failedTasks {
+		t.Errorf("expected the rollback failures of every service, got %v", err)
+	}
+	if want := "api: " + context.DeadlineExceeded.Error() + "; worker: " + failedTasks.Error(); rollbackErr.Err.Error() != want {
+		t.Errorf("expected %q, got %q", want, rollbackErr.Err.Error())
+	}
+	if err := rollbackResult(deployments[2:], errNotReady); err != errNotReady {
+		t.Errorf("expected the cause without any rollback, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/cenkalti/backoff"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPreDeployTaskTimeout time the pre-deploy task may run when PreDeployTask.Timeout is 0
+const DefaultPreDeployTaskTimeout = 30 * time.Minute
+
+// preDeployTaskStartedBy identifies the pre-deploy tasks in the cluster
+const preDeployTaskStartedBy = "awsecs-pre-deploy"
+
+// oneOffTaskPollInterval time between the checks of the one-off task status
+var oneOffTaskPollInterval = 6 * time.Second
+
+var (
+	// ErrPreDeployTaskFailed the pre-deploy task didn't exit with a zero exit code
+	ErrPreDeployTaskFailed = errors.New("the pre-deploy task failed")
+	// ErrPreDeployTaskTimeout the pre-deploy task didn't stop in time and was stopped
+	ErrPreDeployTaskTimeout = errors.New("the pre-deploy task timed out")
+)
+
+var (
+	errWaitingForOneOffTask = errors.New("waiting for the one-off task to stop")
+)
+
+// PreDeployTask one-off task run with the new task definition before the service is updated, e.g. database migrations.
+// It is started with the launch type or capacity provider strategy, platform version and network configuration of
+// the service
+type PreDeployTask struct {
+	Container string        // Container to override the command of, if empty every essential container must exit with a zero exit code
+	Command   []string      // If non empty overrides the command of the Container
+	Timeout   time.Duration // If 0 DefaultPreDeployTaskTimeout is used
+}
+
+// oneOffTask describes a task run once with a task definition of the service, e.g. the pre-deploy task
+type oneOffTask struct {
+	name        string            // Used in the log and the errors
+	startedBy   string            // Identifies the task in the cluster
+	container   string            // Container to override and to check the exit code of, if empty every essential container
+	command     []string          // If non empty overrides the command of the container
+	environment map[string]string // Environment variables added to the container
+	timeout     time.Duration
+	errFailed   error // Wrapped when the task fails
+	errTimeout  error // Wrapped when the task times out
+}
+
+func oneOffRunTaskInput(svc ecs.Service, taskDefinition string, task oneOffTask) *ecs.RunTaskInput {
+	input := &ecs.RunTaskInput{
+		Cluster:              svc.ClusterArn,
+		TaskDefinition:       aws.String(taskDefinition),
+		Count:                aws.Int64(1),
+		StartedBy:            aws.String(task.startedBy),
+		NetworkConfiguration: svc.NetworkConfiguration,
+		PlatformVersion:      svc.PlatformVersion,
+	}
+	if len(svc.CapacityProviderStrategy) > 0 {
+		input.CapacityProviderStrategy = svc.CapacityProviderStrategy
+	} else {
+		input.LaunchType = svc.LaunchType
+	}
+	if len(task.command) > 0 || len(task.environment) > 0 {
+		containerOverride := &ecs.ContainerOverride{Name: aws.String(task.container)}
+		if len(task.command) > 0 {
+			containerOverride.Command = aws.StringSlice(task.command)
+		}
+		var names []string
+		for name := range task.environment {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			containerOverride.Environment = append(containerOverride.Environment, &ecs.KeyValuePair{Name: aws.String(name), Value: aws.String(task.environment[name])})
+		}
+		input.Overrides = &ecs.TaskOverride{ContainerOverrides: []*ecs.ContainerOverride{containerOverride}}
+	}
+	return input
+}
+
+func stopOneOffTask(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, taskArn *string, task oneOffTask) {
+	reason := fmt.Sprintf("update-aws-ecs-service %s task cancelled or timed out", task.name)
+	_, err := api.StopTaskWithContext(ctx, &ecs.StopTaskInput{Cluster: svc.ClusterArn, Task: taskArn, Reason: aws.String(reason)})
+	if err != nil {
+		emit(ctx, OneOffTaskStopFailed{Service: aws.StringValue(svc.ServiceName), Task: task.name, TaskArn: aws.StringValue(taskArn), Err: err})
+	}
+}
+
+// oneOffTaskExited checks the exit codes of the stopped one-off task, of the task container or else of every container
+// but the nonEssential ones
+func oneOffTaskExited(stoppedTask *ecs.Task, task oneOffTask, nonEssential map[string]bool) error {
+	stopped, _ := stoppedTaskFailed(stoppedTask, nonEssential)
+	checked := 0
+	for _, c := range stoppedTask.Containers {
+		name := aws.StringValue(c.Name)
+		if task.container != "" && name != task.container || task.container == "" && nonEssential[name] {
+			continue
+		}
+		checked++
+		if c.ExitCode == nil || *c.ExitCode != 0 {
+			return fmt.Errorf("%w: %s", task.errFailed, stopped)
+		}
+	}
+	if checked == 0 {
+		return fmt.Errorf("%w: %s: %s", task.errFailed, stopped, ErrContainerNotFound)
+	}
+	return nil
+}
+
+func runOneOffTask(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, taskDefinition string, task oneOffTask) error {
+	if (len(task.command) > 0 || len(task.environment) > 0) && task.container == "" {
+		return fmt.Errorf("%w: the container overrides require the container name", task.errFailed)
+	}
+	output, err := api.RunTaskWithContext(ctx, oneOffRunTaskInput(svc, taskDefinition, task))
+	if err != nil {
+		return fmt.Errorf("on %s task while run task: %w", task.name, err)
+	}
+	if len(output.Tasks) == 0 {
+		var failures []string
+		for _, failure := range output.Failures {
+			failures = append(failures, fmt.Sprintf("%s %s", aws.StringValue(failure.Reason), aws.StringValue(failure.Detail)))
+		}
+		return fmt.Errorf("%w: %s", task.errFailed, strings.Join(failures, ", "))
+	}
+	taskArn := output.Tasks[0].TaskArn
+	emit(ctx, OneOffTaskStarted{Service: aws.StringValue(svc.ServiceName), Task: task.name, TaskArn: aws.StringValue(taskArn)})
+
+	waitCtx, cancel := context.WithTimeout(ctx, task.timeout)
+	defer cancel()
+	var stoppedTask *ecs.Task
+	operation := func() error {
+		output, err := api.DescribeTasksWithContext(waitCtx, &ecs.DescribeTasksInput{Cluster: svc.ClusterArn, Tasks: []*string{taskArn}})
+		if err != nil {
+			return fmt.Errorf("on %s task while describe tasks: %w", task.name, err)
+		}
+		if len(output.Tasks) == 0 {
+			return errWaitingForOneOffTask
+		}
+		if aws.StringValue(output.Tasks[0].LastStatus) != ecs.DesiredStatusStopped {
+			return errWaitingForOneOffTask
+		}
+		stoppedTask = output.Tasks[0]
+		return nil
+	}
+	if err := backoff.Retry(operation, backoff.WithContext(backoff.NewConstantBackOff(oneOffTaskPollInterval), waitCtx)); err != nil {
+		// the task must not outlive the deployment, even when it was cancelled
+		stopOneOffTask(detachedContext{parent: ctx}, api, svc, taskArn, task)
+		// the retry may give up slightly before the deadline, when the next poll wouldn't happen in time
+		if ctx.Err() == nil && (errors.Is(err, errWaitingForOneOffTask) || errors.Is(err, context.DeadlineExceeded)) {
+			return fmt.Errorf("%w after %v: %s", task.errTimeout, task.timeout, aws.StringValue(taskArn))
+		}
+		return err
+	}
+	var nonEssential map[string]bool
+	if task.container == "" {
+		nonEssential, err = nonEssentialContainers(ctx, api, aws.String(taskDefinition))
+		if err != nil {
+			return fmt.Errorf("on %s task: %w", task.name, err)
+		}
+	}
+	if err := oneOffTaskExited(stoppedTask, task, nonEssential); err != nil {
+		return err
+	}
+	emit(ctx, OneOffTaskSucceeded{Service: aws.StringValue(svc.ServiceName), Task: task.name, TaskArn: aws.StringValue(taskArn)})
+	return nil
+}
+
+func runPreDeployTask(ctx context.Context, api ecsiface.ECSAPI, svc ecs.Service, taskDefinition string, preDeployTask PreDeployTask) error {
+	timeout := preDeployTask.Timeout
+	if timeout == 0 {
+		timeout = DefaultPreDeployTaskTimeout
+	}
+	return runOneOffTask(ctx, api, svc, taskDefinition, oneOffTask{
+		name:       "pre-deploy",
+		startedBy:  preDeployTaskStartedBy,
+		container:  preDeployTask.Container,
+		command:    preDeployTask.Command,
+		timeout:    timeout,
+		errFailed:  ErrPreDeployTaskFailed,
+		errTimeout: ErrPreDeployTaskTimeout,
+	})
+}
+
+// preDeploy registers the new task definition and runs the pre-deploy task with it, returns the update of the service
+// to the task definition. Used when the pre-deploy task must run once before several services are updated
+func (e ECSServiceUpdate) preDeploy(ctx context.Context, preDeployTask PreDeployTask) (*ECSServiceUpdate, error) {
+	output, err := e.EcsApi.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(e.Cluster), Services: []*string{aws.String(e.Service)}})
+	if err != nil {
+		return nil, fmt.Errorf("on pre-deploy task while describe services: %w", err)
+	}
+	svc := activeService(output, e.Service)
+	if svc == nil {
+		return nil, ErrServiceNotFound
+	}
+	srcTaskDef := aws.StringValue(svc.TaskDefinition)
+	if e.Taskdef != "" {
+		srcTaskDef = e.Taskdef
+	}
+	taskDefinition, err := copyTaskDef(ctx, &e, srcTaskDef)
+	if err != nil {
+		return nil, err
+	}
+	if err := runPreDeployTask(ctx, e.EcsApi, *svc, taskDefinition, preDeployTask); err != nil {
+		return nil, err
+	}
+	// the canary, if any, still runs the task definition first
+	canary := e.Canary
+	update := e.promoteCanary(taskDefinition)
+	update.Canary = canary
+	return update, nil
+}
@@ -0,0 +1,151 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/cenkalti/backoff"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockPreDeployEcsClient struct {
+	*mockDeployEcsClient
+	runInput     *ecs.RunTaskInput
+	exitCode     *int64 // If nil the pre-deploy task never stops
+	describes    int
+	stoppedTasks []string
+}
+
+func (m *mockPreDeployEcsClient) RunTaskWithContext(ctx aws.Context, input *ecs.RunTaskInput, opts ...request.Option) (*ecs.RunTaskOutput, error) {
+	m.runInput = input
+	return &ecs.RunTaskOutput{Tasks: []*ecs.Task{{TaskArn: aws.String("pre-deploy-task")}}}, nil
+}
+
+func (m *mockPreDeployEcsClient) DescribeTasksWithContext(ctx aws.Context, input *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	if *input.Tasks[0] != "pre-deploy-task" {
+		return m.mockDeployEcsClient.DescribeTasksWithContext(ctx, input, opts...)
+	}
+	m.describes++
+	task := &ecs.Task{
+		TaskArn:    aws.String("pre-deploy-task"),
+		LastStatus: aws.String("RUNNING"),
+		Containers: []*ecs.Container{{Name: aws.String("my-container")}},
+	}
+	if m.exitCode != nil && m.describes > 1 {
+		task.LastStatus = aws.String(ecs.DesiredStatusStopped)
+		task.StopCode = aws.String(ecs.TaskStopCodeEssentialContainerExited)
+		task.StoppedReason = aws.String("Essential container in task exited")
+		task.Containers[0].ExitCode = m.exitCode
+	}
+	return &ecs.DescribeTasksOutput{Tasks: []*ecs.Task{task}}, nil
+}
+
+func (m *mockPreDeployEcsClient) StopTaskWithContext(ctx aws.Context, input *ecs.StopTaskInput, opts ...request.Option) (*ecs.StopTaskOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.stoppedTasks = append(m.stoppedTasks, *input.Task)
+	return &ecs.StopTaskOutput{}, nil
+}
+
+func TestOneOffRunTaskInput(t *testing.T) {
+	networkConfiguration := &ecs.NetworkConfiguration{AwsvpcConfiguration: &ecs.AwsVpcConfiguration{Subnets: aws.StringSlice([]string{"subnet-1"})}}
+	svc := ecs.Service{
+		ClusterArn:           aws.String("my-cluster-arn"),
+		LaunchType:           aws.String(ecs.LaunchTypeFargate),
+		PlatformVersion:      aws.String("LATEST"),
+		NetworkConfiguration: networkConfiguration,
+	}
+	got := oneOffRunTaskInput(svc, "my-family:2", oneOffTask{startedBy: preDeployTaskStartedBy, container: "my-container", command: []string{"./manage.py", "migrate"}})
+	want := &ecs.RunTaskInput{
+		Cluster:              aws.String("my-cluster-arn"),
+		TaskDefinition:       aws.String("my-family:2"),
+		Count:                aws.Int64(1),
+		StartedBy:            aws.String(preDeployTaskStartedBy),
+		LaunchType:           aws.String(ecs.LaunchTypeFargate),
+		PlatformVersion:      aws.String("LATEST"),
+		NetworkConfiguration: networkConfiguration,
+		Overrides: &ecs.TaskOverride{
+			ContainerOverrides: []*ecs.ContainerOverride{{Name: aws.String("my-container"), Command: aws.StringSlice([]string{"./manage.py", "migrate"})}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("oneOffRunTaskInput() = %v, want %v", got, want)
+	}
+	svc.CapacityProviderStrategy = []*ecs.CapacityProviderStrategyItem{{CapacityProvider: aws.String("FARGATE_SPOT")}}
+	if got := oneOffRunTaskInput(svc, "my-family:2", oneOffTask{startedBy: preDeployTaskStartedBy}); got.LaunchType != nil || got.CapacityProviderStrategy == nil || got.Overrides != nil {
+		t.Errorf("expected the capacity provider strategy instead of the launch type, got %v", got)
+	}
+}
+
+func TestOneOffTaskExited(t *testing.T) {
+	stopped := &ecs.Task{
+		TaskArn:  aws.String("one-off-task"),
+		StopCode: aws.String(ecs.TaskStopCodeEssentialContainerExited),
+		Containers: []*ecs.Container{
+			{Name: aws.String("my-container"), ExitCode: aws.Int64(0)},
+			{Name: aws.String("my-sidecar"), ExitCode: aws.Int64(137)},
+		},
+	}
+	tests := []struct {
+		name         string
+		container    string
+		nonEssential map[string]bool
+		wantErr      error
+	}{
+		{name: "task container", container: "my-container"},
+		{name: "non-essential sidecar", nonEssential: map[string]bool{"my-sidecar": true}},
+		{name: "essential sidecar", wantErr: ErrPreDeployTaskFailed},
+		{name: "missing container", container: "other-container", wantErr: ErrContainerNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := oneOffTaskExited(stopped, oneOffTask{container: tt.container, errFailed: ErrPreDeployTaskFailed}, tt.nonEssential)
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !strings.Contains(err.Error(), tt.wantErr.Error()) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackPreDeployTask(t *testing.T) {
+	defer func(interval time.Duration) { oneOffTaskPollInterval = interval }(oneOffTaskPollInterval)
+	oneOffTaskPollInterval = time.Millisecond
+	tests := []struct {
+		name        string
+		exitCode    *int64
+		timeout     time.Duration
+		wantErr     error
+		wantUpdates int
+		wantStopped int
+	}{
+		{name: "succeeded", exitCode: aws.Int64(0), wantUpdates: 1},
+		{name: "failed", exitCode: aws.Int64(1), wantErr: ErrPreDeployTaskFailed},
+		{name: "timed out", timeout: 20 * time.Millisecond, wantErr: ErrPreDeployTaskTimeout, wantStopped: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &mockPreDeployEcsClient{mockDeployEcsClient: newMockDeployEcsClient(), exitCode: tt.exitCode}
+			preDeployTask := &PreDeployTask{Container: "my-container", Command: []string{"./manage.py", "migrate"}, Timeout: tt.timeout}
+			bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+			err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, PreDeployTask: preDeployTask, BackOff: bo}, validateDeployment, validateDeployment)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if *api.runInput.TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+				t.Errorf("expected the new task definition to run, got %s", *api.runInput.TaskDefinition)
+			}
+			if len(api.updateInputs) != tt.wantUpdates {
+				t.Errorf("expected %d updates, got %d", tt.wantUpdates, len(api.updateInputs))
+			}
+			if len(api.stoppedTasks) != tt.wantStopped {
+				t.Errorf("expected %d stopped tasks, got %v", tt.wantStopped, api.stoppedTasks)
+			}
+		})
+	}
+}
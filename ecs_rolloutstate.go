@@ -0,0 +1,94 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+)
+
+var (
+	// ErrRolloutInProgress the rollout of the deployment didn't complete yet
+	ErrRolloutInProgress = errors.New("the deployment rollout is in progress")
+	// ErrRolloutFailed ECS reported the rollout of the deployment as failed
+	ErrRolloutFailed = errors.New("the deployment rollout failed")
+	// ErrCircuitBreakerRollback the rollout of the deployment failed and the deployment circuit breaker rolls the
+	// service back
+	ErrCircuitBreakerRollback = errors.New("the deployment circuit breaker rolled back the service")
+)
+
+var (
+	errWaitingForCircuitBreakerRollback = errors.New("waiting for the deployment circuit breaker rollback")
+)
+
+func circuitBreakerRollbackEnabled(svc ecs.Service) bool {
+	if svc.DeploymentConfiguration == nil || svc.DeploymentConfiguration.DeploymentCircuitBreaker == nil {
+		return false
+	}
+	circuitBreaker := svc.DeploymentConfiguration.DeploymentCircuitBreaker
+	return aws.BoolValue(circuitBreaker.Enable) && aws.BoolValue(circuitBreaker.Rollback)
+}
+
+// validateRolloutState waits until ECS reports the rollout of the PRIMARY deployment as COMPLETED, services not
+// reporting a rollout state (e.g. using a Classic Load Balancer) are validated as with validateDeployment
+func validateRolloutState(ctx context.Context, api ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
+	ecsDeployment := primaryDeployment(ecsService)
+	if ecsDeployment == nil {
+		return errNoPrimaryDeployment
+	}
+	output, err := api.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: ecsService.ClusterArn, Services: []*string{ecsService.ServiceName}})
+	if err != nil {
+		return fmt.Errorf("on validate rollout state while describe service: %w", err)
+	}
+	if len(output.Services) == 0 {
+		return ErrServiceDeletedAfterUpdate
+	}
+	svc := output.Services[0]
+	var deployment *ecs.Deployment
+	for _, candidate := range svc.Deployments {
+		if aws.StringValue(candidate.Id) == *ecsDeployment.Id {
+			deployment = candidate
+		}
+	}
+	if deployment == nil {
+		return backoff.Permanent(ErrDeploymentChangedElsewhere)
+	}
+	if deployment.RolloutState == nil {
+		return validateDeployment(ctx, api, elbv2api, ecsService, bo)
+	}
+	// a failed deployment is no longer PRIMARY once the circuit breaker started rolling back
+	if *deployment.RolloutState == ecs.DeploymentRolloutStateFailed {
+		if circuitBreakerRollbackEnabled(*svc) {
+			return backoff.Permanent(fmt.Errorf("%w: %s", ErrCircuitBreakerRollback, aws.StringValue(deployment.RolloutStateReason)))
+		}
+		return backoff.Permanent(fmt.Errorf("%w: %s", ErrRolloutFailed, aws.StringValue(deployment.RolloutStateReason)))
+	}
+	if primary := primaryDeployment(*svc); primary == nil || *primary.Id != *ecsDeployment.Id {
+		return backoff.Permanent(ErrDeploymentChangedElsewhere)
+	}
+	if *deployment.RolloutState == ecs.DeploymentRolloutStateCompleted {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrRolloutInProgress, aws.StringValue(deployment.RolloutStateReason))
+}
+
+// describeCircuitBreakerRollback returns the service once the deployment circuit breaker started the rollback
+// deployment
+func describeCircuitBreakerRollback(ctx context.Context, api ecsiface.ECSAPI, oldsvc ecs.Service) (*ecs.Service, error) {
+	output, err := api.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: oldsvc.ClusterArn, Services: []*string{oldsvc.ServiceName}})
+	if err != nil {
+		return nil, fmt.Errorf("on circuit breaker rollback while describe service: %w", err)
+	}
+	if len(output.Services) == 0 {
+		return nil, ErrServiceDeletedAfterUpdate
+	}
+	primary := primaryDeployment(*output.Services[0])
+	if primary == nil || aws.StringValue(primary.RolloutState) == ecs.DeploymentRolloutStateFailed {
+		return nil, errWaitingForCircuitBreakerRollback
+	}
+	return output.Services[0], nil
+}
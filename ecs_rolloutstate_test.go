@@ -0,0 +1,159 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"testing"
+	"time"
+)
+
+func TestValidateRolloutState(t *testing.T) {
+	circuitBreaker := &ecs.DeploymentConfiguration{DeploymentCircuitBreaker: &ecs.DeploymentCircuitBreaker{Enable: aws.Bool(true), Rollback: aws.Bool(true)}}
+	tests := []struct {
+		name          string
+		configuration *ecs.DeploymentConfiguration
+		deployments   []*ecs.Deployment
+		want          error
+		permanent     bool
+	}{
+		{
+			name: "completed",
+			deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), RolloutState: aws.String(ecs.DeploymentRolloutStateCompleted)},
+			},
+		},
+		{
+			name: "in progress",
+			deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), RolloutState: aws.String(ecs.DeploymentRolloutStateInProgress)},
+				{Id: aws.String("ecs-svc/0"), Status: aws.String("ACTIVE"), RolloutState: aws.String(ecs.DeploymentRolloutStateCompleted)},
+			},
+			want: ErrRolloutInProgress,
+		},
+		{
+			name: "failed",
+			deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), RolloutState: aws.String(ecs.DeploymentRolloutStateFailed), RolloutStateReason: aws.String("tasks failed to start")},
+			},
+			want:      ErrRolloutFailed,
+			permanent: true,
+		},
+		{
+			name:          "failed and rolled back by the circuit breaker",
+			configuration: circuitBreaker,
+			deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/2"), Status: aws.String("PRIMARY"), RolloutState: aws.String(ecs.DeploymentRolloutStateInProgress)},
+				{Id: aws.String("ecs-svc/1"), Status: aws.String("ACTIVE"), RolloutState: aws.String(ecs.DeploymentRolloutStateFailed), RolloutStateReason: aws.String("tasks failed to start")},
+			},
+			want:      ErrCircuitBreakerRollback,
+			permanent: true,
+		},
+		{
+			name: "changed elsewhere",
+			deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/2"), Status: aws.String("PRIMARY"), RolloutState: aws.String(ecs.DeploymentRolloutStateInProgress)},
+				{Id: aws.String("ecs-svc/1"), Status: aws.String("ACTIVE"), RolloutState: aws.String(ecs.DeploymentRolloutStateInProgress)},
+			},
+			want:      ErrDeploymentChangedElsewhere,
+			permanent: true,
+		},
+		{
+			name: "without rollout state",
+			deployments: []*ecs.Deployment{
+				{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY")},
+				{Id: aws.String("ecs-svc/0"), Status: aws.String("ACTIVE")},
+			},
+			want: ErrOtherThanPrimaryDeploymentFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockDeployEcsClient()
+			api.service.DeploymentConfiguration = tt.configuration
+			api.service.Deployments = tt.deployments
+			svc := ecs.Service{
+				ClusterArn:  api.service.ClusterArn,
+				ServiceName: api.service.ServiceName,
+				Deployments: []*ecs.Deployment{{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY")}},
+			}
+			err := validateRolloutState(context.Background(), api, nil, svc, &backoff.ZeroBackOff{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+			if permanent := errors.Is(err, &backoff.PermanentError{}); permanent != tt.permanent {
+				t.Errorf("expected permanent %v, got %v", tt.permanent, permanent)
+			}
+		})
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackCircuitBreaker(t *testing.T) {
+	api := newMockDeployEcsClient()
+	api.service.DeploymentConfiguration = &ecs.DeploymentConfiguration{DeploymentCircuitBreaker: &ecs.DeploymentCircuitBreaker{Enable: aws.Bool(true), Rollback: aws.Bool(true)}}
+	api.afterUpdate = func(svc *ecs.Service) {
+		failed := svc.Deployments[0]
+		failed.Status = aws.String("ACTIVE")
+		failed.RolloutState = aws.String(ecs.DeploymentRolloutStateFailed)
+		failed.RolloutStateReason = aws.String("ECS deployment circuit breaker: tasks failed to start.")
+		svc.TaskDefinition = aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1")
+		svc.Deployments = []*ecs.Deployment{
+			{Id: aws.String("ecs-svc/rollback"), Status: aws.String("PRIMARY"), TaskDefinition: svc.TaskDefinition, RolloutState: aws.String(ecs.DeploymentRolloutStateCompleted)},
+			failed,
+		}
+	}
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo, FailedTasksThreshold: -1}, validateRolloutState, validateRolloutState)
+	if !errors.Is(err, ErrSuccessfulRollback) {
+		t.Fatalf("expected %v, got %v", ErrSuccessfulRollback, err)
+	}
+	if len(api.updateInputs) != 1 {
+		t.Errorf("the circuit breaker owns the rollback, expected only the deployment update, got %d updates", len(api.updateInputs))
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackCircuitBreakerFailedTasks(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitUntil   string
+		wantErr     error
+		wantUpdates int
+	}{
+		{name: "the circuit breaker decides", waitUntil: WaitUntilRolloutCompleted, wantUpdates: 1},
+		{name: "failed tasks roll back", waitUntil: WaitUntilPrimaryRolled, wantErr: ErrSuccessfulRollback, wantUpdates: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockDeployEcsClient()
+			api.service.DeploymentConfiguration = &ecs.DeploymentConfiguration{DeploymentCircuitBreaker: &ecs.DeploymentCircuitBreaker{Enable: aws.Bool(true), Rollback: aws.Bool(true)}}
+			api.tasks = map[string][]*ecs.Task{
+				ecs.DesiredStatusStopped: {
+					stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", time.Now(), aws.Int64(1)),
+				},
+			}
+			api.afterUpdate = func(svc *ecs.Service) {
+				svc.Deployments[0].RolloutState = aws.String(ecs.DeploymentRolloutStateInProgress)
+			}
+			validations := 0
+			validate := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+				// ECS replaces the failed task and the rollout completes below the circuit breaker threshold
+				if validations++; validations > 1 {
+					api.service.Deployments[0].RolloutState = aws.String(ecs.DeploymentRolloutStateCompleted)
+				}
+				return validateRolloutState(ctx, ecsapi, elbv2api, svc, bo)
+			}
+			bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+			err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo, FailedTasksThreshold: 1, WaitUntil: aws.String(tt.waitUntil)}, validate, validate)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if len(api.updateInputs) != tt.wantUpdates {
+				t.Errorf("expected %d updates, got %d", tt.wantUpdates, len(api.updateInputs))
+			}
+		})
+	}
+}
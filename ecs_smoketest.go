@@ -0,0 +1,115 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// smokeTestBodyLimit maximum number of bytes of the response body matched against the BodyRegexp
+const smokeTestBodyLimit = 1 << 20
+
+var (
+	// ErrSmokeTestFailed the smoke test probe didn't get the expected response
+	ErrSmokeTestFailed = errors.New("the smoke test failed")
+)
+
+// SmokeTest probes an HTTP endpoint until it responds as expected, use its Validate method as a ValidateDeploymentFunc
+type SmokeTest struct {
+	Client         HTTPClient     // If nil http.DefaultClient is used
+	URL            string         // URL to GET
+	ExpectedStatus int            // If 0 http.StatusOK is expected
+	BodyRegexp     *regexp.Regexp // If non nil the response body must match
+	Timeout        time.Duration  // Time the probes of a deployment may fail before it is considered failed, if 0 the probes are retried as long as the BackOff allows
+	RequestTimeout time.Duration  // Timeout of each probe, if 0 a probe may take what is left of the Timeout
+
+	mu      sync.Mutex
+	started map[string]time.Time // Map of deployment ids and first probe time
+}
+
+func (s *SmokeTest) client() HTTPClient {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *SmokeTest) deadline(deploymentId string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started == nil {
+		s.started = map[string]time.Time{}
+	}
+	if _, found := s.started[deploymentId]; !found {
+		s.started[deploymentId] = time.Now()
+	}
+	return s.started[deploymentId].Add(s.Timeout)
+}
+
+func (s *SmokeTest) probe(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("on smoke test while create request: %w", err))
+	}
+	resp, err := s.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSmokeTestFailed, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, smokeTestBodyLimit))
+	if err != nil {
+		return fmt.Errorf("%w: reading the response body: %v", ErrSmokeTestFailed, err)
+	}
+	expectedStatus := s.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("%w: GET %s responded %s, expected %d", ErrSmokeTestFailed, s.URL, resp.Status, expectedStatus)
+	}
+	if s.BodyRegexp != nil && !s.BodyRegexp.Match(body) {
+		return fmt.Errorf("%w: GET %s response body doesn't match %s", ErrSmokeTestFailed, s.URL, s.BodyRegexp)
+	}
+	return nil
+}
+
+// Validate probes the URL once, a failing probe is retried until the Timeout elapsed for the deployment
+func (s *SmokeTest) Validate(ctx context.Context, _ ecsiface.ECSAPI, _ elbv2iface.ELBV2API, ecsService ecs.Service, _ backoff.BackOff) error {
+	deploymentId := ""
+	if deployment := primaryDeployment(ecsService); deployment != nil {
+		deploymentId = aws.StringValue(deployment.Id)
+	}
+	probeCtx := ctx
+	var deadline time.Time
+	if s.Timeout > 0 {
+		deadline = s.deadline(deploymentId)
+		var cancel context.CancelFunc
+		probeCtx, cancel = context.WithDeadline(probeCtx, deadline)
+		defer cancel()
+	}
+	if s.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		probeCtx, cancel = context.WithTimeout(probeCtx, s.RequestTimeout)
+		defer cancel()
+	}
+	err := s.probe(probeCtx)
+	if err == nil {
+		emit(ctx, SmokeTestPassed{Service: aws.StringValue(ecsService.ServiceName), DeploymentId: deploymentId, URL: s.URL})
+		return nil
+	}
+	if s.Timeout > 0 && !time.Now().Before(deadline) {
+		return backoff.Permanent(fmt.Errorf("%w after %v", err, s.Timeout))
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/cenkalti/backoff"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmokeTestValidate(t *testing.T) {
+	responses := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusServiceUnavailable, "starting"},
+		{http.StatusOK, "version 1"},
+		{http.StatusOK, "version 2"},
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[requests]
+		requests++
+		w.WriteHeader(response.status)
+		_, _ = w.Write([]byte(response.body))
+	}))
+	defer server.Close()
+	smokeTest := &SmokeTest{Client: server.Client(), URL: server.URL + "/health", BodyRegexp: regexp.MustCompile(`version 2`)}
+	svc := ecs.Service{ServiceName: aws.String("my-service"), Deployments: []*ecs.Deployment{{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY")}}}
+	sink := &recordingEventSink{}
+	for i, want := range []string{"503 Service Unavailable", "doesn't match version 2", ""} {
+		err := smokeTest.Validate(withEventSink(context.Background(), sink), nil, nil, svc, nil)
+		if want == "" && err != nil {
+			t.Fatalf("probe %d: unexpected error %v", i, err)
+		}
+		if want != "" && (!errors.Is(err, ErrSmokeTestFailed) || !strings.Contains(err.Error(), want) || errors.Is(err, &backoff.PermanentError{})) {
+			t.Fatalf("probe %d: expected retryable %v with %q, got %v", i, ErrSmokeTestFailed, want, err)
+		}
+	}
+	want := SmokeTestPassed{Service: "my-service", DeploymentId: "ecs-svc/1", URL: server.URL + "/health"}
+	if len(sink.events) != 1 || sink.events[0] != want {
+		t.Errorf("expected %v emitted, got %v", want, sink.events)
+	}
+}
+
+func TestSmokeTestValidateTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	smokeTest := &SmokeTest{Client: server.Client(), URL: server.URL, Timeout: 50 * time.Millisecond}
+	svc := ecs.Service{Deployments: []*ecs.Deployment{{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY")}}}
+	err := smokeTest.Validate(context.Background(), nil, nil, svc, nil)
+	if !errors.Is(err, ErrSmokeTestFailed) || errors.Is(err, &backoff.PermanentError{}) {
+		t.Fatalf("expected retryable %v before the timeout, got %v", ErrSmokeTestFailed, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	err = smokeTest.Validate(context.Background(), nil, nil, svc, nil)
+	if !errors.Is(err, ErrSmokeTestFailed) || !errors.Is(err, &backoff.PermanentError{}) {
+		t.Errorf("expected permanent %v, got %v", ErrSmokeTestFailed, err)
+	}
+}
+
+func TestSmokeTestValidateRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+	smokeTest := &SmokeTest{Client: server.Client(), URL: server.URL, Timeout: time.Hour, RequestTimeout: 10 * time.Millisecond}
+	svc := ecs.Service{Deployments: []*ecs.Deployment{{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY")}}}
+	err := smokeTest.Validate(context.Background(), nil, nil, svc, nil)
+	if !errors.Is(err, ErrSmokeTestFailed) || errors.Is(err, &backoff.PermanentError{}) {
+		t.Errorf("expected retryable %v for a request slower than the request timeout, got %v", ErrSmokeTestFailed, err)
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackSmokeTest(t *testing.T) {
+	api := newMockDeployEcsClient()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(*api.service.TaskDefinition, "my-family:2") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+	smokeTest := &SmokeTest{Client: server.Client(), URL: server.URL}
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo}, ChainValidators(validateDeployment, smokeTest.Validate), validateDeployment)
+	if !errors.Is(err, ErrSuccessfulRollback) {
+		t.Fatalf("expected %v, got %v", ErrSuccessfulRollback, err)
+	}
+	if *api.service.TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" {
+		t.Errorf("expected the service rolled back, got %s", *api.service.TaskDefinition)
+	}
+}
@@ -0,0 +1,188 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/cenkalti/backoff"
+	"sort"
+	"strings"
+)
+
+// DefaultFailedTasksThreshold number of consecutive failed tasks after which a deployment is considered failed, the
+// default of the -failed-tasks-threshold flag
+const DefaultFailedTasksThreshold = 3
+
+var (
+	// ErrTasksFailing the tasks of the deployment are failing
+	ErrTasksFailing = errors.New("the deployment tasks are failing")
+)
+
+// StoppedTask describes why a task of the deployment stopped
+type StoppedTask struct {
+	TaskArn       string
+	StopCode      string
+	StoppedReason string
+	ExitCodes     map[string]int64 // Map of container names and exit codes
+}
+
+func (s StoppedTask) String() string {
+	var exitCodes []string
+	for name, exitCode := range s.ExitCodes {
+		exitCodes = append(exitCodes, fmt.Sprintf("%s exit code %d", name, exitCode))
+	}
+	sort.Strings(exitCodes)
+	description := fmt.Sprintf("%s %s: %s", s.TaskArn, s.StopCode, s.StoppedReason)
+	if len(exitCodes) > 0 {
+		description = fmt.Sprintf("%s (%s)", description, strings.Join(exitCodes, ", "))
+	}
+	return description
+}
+
+// FailedTasksError the deployment was considered failed because of its stopped tasks
+type FailedTasksError struct {
+	Tasks []StoppedTask // Most recently stopped first
+}
+
+func (e *FailedTasksError) Error() string {
+	var tasks []string
+	for _, task := range e.Tasks {
+		tasks = append(tasks, task.String())
+	}
+	return fmt.Sprintf("%v, %d consecutive tasks stopped: %s", ErrTasksFailing, len(e.Tasks), strings.Join(tasks, "; "))
+}
+
+// Unwrap allows errors.Is(err, ErrTasksFailing)
+func (e *FailedTasksError) Unwrap() error {
+	return ErrTasksFailing
+}
+
+func primaryDeployment(svc ecs.Service) *ecs.Deployment {
+	for _, deployment := range svc.Deployments {
+		if deployment.Status != nil && *deployment.Status == "PRIMARY" {
+			return deployment
+		}
+	}
+	return nil
+}
+
+func describeDeploymentTasks(ctx context.Context, api ecsiface.ECSAPI, cluster *string, deployment ecs.Deployment, desiredStatus string) ([]*ecs.Task, error) {
+	var taskArns []*string
+	err := api.ListTasksPagesWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       cluster,
+		StartedBy:     deployment.Id,
+		DesiredStatus: aws.String(desiredStatus),
+	}, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		taskArns = append(taskArns, page.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("on describe deployment tasks while list tasks: %w", err)
+	}
+	var tasks []*ecs.Task
+	for len(taskArns) > 0 {
+		batch := taskArns
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		taskArns = taskArns[len(batch):]
+		output, err := api.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{Cluster: cluster, Tasks: batch})
+		if err != nil {
+			return nil, fmt.Errorf("on describe deployment tasks while describe tasks: %w", err)
+		}
+		for _, task := range output.Tasks {
+			if deployment.TaskDefinition == nil || aws.StringValue(task.TaskDefinitionArn) == *deployment.TaskDefinition {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// nonEssentialContainers returns the names of the containers of the task definition which are not essential
+func nonEssentialContainers(ctx context.Context, api ecsiface.ECSAPI, taskDefinition *string) (map[string]bool, error) {
+	output, err := api.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: taskDefinition})
+	if err != nil {
+		return nil, fmt.Errorf("on describe task definition %s: %w", aws.StringValue(taskDefinition), err)
+	}
+	nonEssential := map[string]bool{}
+	for _, containerDefinition := range output.TaskDefinition.ContainerDefinitions {
+		// containers are essential unless stated otherwise
+		if containerDefinition.Essential != nil && !*containerDefinition.Essential {
+			nonEssential[aws.StringValue(containerDefinition.Name)] = true
+		}
+	}
+	return nonEssential, nil
+}
+
+// stoppedTaskFailed tells whether the task failed, the exit codes of the nonEssential containers don't matter. Tasks
+// stopped by the scheduler or a user didn't fail, unless the scheduler stopped them for failing their health checks
+func stoppedTaskFailed(task *ecs.Task, nonEssential map[string]bool) (StoppedTask, bool) {
+	stopped := StoppedTask{
+		TaskArn:       aws.StringValue(task.TaskArn),
+		StopCode:      aws.StringValue(task.StopCode),
+		StoppedReason: aws.StringValue(task.StoppedReason),
+		ExitCodes:     map[string]int64{},
+	}
+	for _, container := range task.Containers {
+		if container.ExitCode != nil {
+			stopped.ExitCodes[aws.StringValue(container.Name)] = *container.ExitCode
+		}
+	}
+	if strings.Contains(strings.ToLower(stopped.StoppedReason), "health check") {
+		return stopped, true
+	}
+	switch stopped.StopCode {
+	case ecs.TaskStopCodeTaskFailedToStart, ecs.TaskStopCodeEssentialContainerExited:
+		return stopped, true
+	case ecs.TaskStopCodeServiceSchedulerInitiated, ecs.TaskStopCodeUserInitiated:
+		// stopped containers exit 137 or 143
+		return stopped, false
+	}
+	for name, exitCode := range stopped.ExitCodes {
+		if exitCode != 0 && !nonEssential[name] {
+			return stopped, true
+		}
+	}
+	return stopped, false
+}
+
+func checkFailedTasks(ctx context.Context, api ecsiface.ECSAPI, ecsService ecs.Service, threshold int) error {
+	if threshold <= 0 {
+		return nil
+	}
+	deployment := primaryDeployment(ecsService)
+	if deployment == nil {
+		return nil
+	}
+	tasks, err := describeDeploymentTasks(ctx, api, ecsService.ClusterArn, *deployment, ecs.DesiredStatusStopped)
+	if err != nil || len(tasks) == 0 {
+		return err
+	}
+	taskDefinition := deployment.TaskDefinition
+	if taskDefinition == nil {
+		taskDefinition = tasks[0].TaskDefinitionArn
+	}
+	nonEssential, err := nonEssentialContainers(ctx, api, taskDefinition)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return aws.TimeValue(tasks[i].StoppedAt).After(aws.TimeValue(tasks[j].StoppedAt))
+	})
+	var consecutive []StoppedTask
+	for _, task := range tasks {
+		stopped, failed := stoppedTaskFailed(task, nonEssential)
+		if !failed {
+			break
+		}
+		consecutive = append(consecutive, stopped)
+	}
+	if len(consecutive) >= threshold {
+		return backoff.Permanent(&FailedTasksError{Tasks: consecutive})
+	}
+	return nil
+}
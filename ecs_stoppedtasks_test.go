@@ -0,0 +1,148 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stoppedTask(arn, deploymentID, stopCode, reason string, stoppedAt time.Time, exitCode *int64) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:           aws.String(arn),
+		StartedBy:         aws.String(deploymentID),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"),
+		LastStatus:        aws.String(ecs.DesiredStatusStopped),
+		StopCode:          aws.String(stopCode),
+		StoppedReason:     aws.String(reason),
+		StoppedAt:         aws.Time(stoppedAt),
+		Containers:        []*ecs.Container{{Name: aws.String("my-container"), ExitCode: exitCode}},
+	}
+}
+
+func TestStoppedTaskFailed(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		task   *ecs.Task
+		failed bool
+	}{
+		{
+			name:   "essential container exited",
+			task:   stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", now, aws.Int64(1)),
+			failed: true,
+		},
+		{
+			name:   "failed to start",
+			task:   stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeTaskFailedToStart, "CannotPullContainerError", now, nil),
+			failed: true,
+		},
+		{
+			name:   "failed load balancer health checks",
+			task:   stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeServiceSchedulerInitiated, "Task failed ELB health checks in (target-group arn)", now, aws.Int64(143)),
+			failed: true,
+		},
+		{
+			name:   "stopped by a user",
+			task:   stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeUserInitiated, "Task stopped by user", now, aws.Int64(137)),
+			failed: false,
+		},
+		{
+			name: "non-essential container exited",
+			task: &ecs.Task{
+				TaskArn:    aws.String("task1"),
+				Containers: []*ecs.Container{{Name: aws.String("my-container"), ExitCode: aws.Int64(0)}, {Name: aws.String("my-sidecar"), ExitCode: aws.Int64(1)}},
+			},
+			failed: false,
+		},
+		{
+			name: "essential container exited",
+			task: &ecs.Task{
+				TaskArn:    aws.String("task1"),
+				Containers: []*ecs.Container{{Name: aws.String("my-container"), ExitCode: aws.Int64(1)}, {Name: aws.String("my-sidecar"), ExitCode: aws.Int64(0)}},
+			},
+			failed: true,
+		},
+		{
+			name:   "scaled in",
+			task:   stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeServiceSchedulerInitiated, "Scaling activity initiated by (deployment ecs-svc/1)", now, aws.Int64(0)),
+			failed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, failed := stoppedTaskFailed(tt.task, map[string]bool{"my-sidecar": true}); failed != tt.failed {
+				t.Errorf("stoppedTaskFailed() = %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestCheckFailedTasks(t *testing.T) {
+	now := time.Now()
+	api := newMockDeployEcsClient()
+	api.tasks = map[string][]*ecs.Task{
+		ecs.DesiredStatusStopped: {
+			stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", now.Add(-1*time.Minute), aws.Int64(1)),
+			stoppedTask("task2", "ecs-svc/1", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", now.Add(-2*time.Minute), aws.Int64(1)),
+			stoppedTask("task3", "ecs-svc/1", ecs.TaskStopCodeServiceSchedulerInitiated, "Scaling activity initiated by (deployment ecs-svc/1)", now.Add(-3*time.Minute), aws.Int64(0)),
+			stoppedTask("task4", "ecs-svc/1", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", now.Add(-4*time.Minute), aws.Int64(1)),
+			stoppedTask("task5", "ecs-svc/0", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", now, aws.Int64(1)),
+		},
+	}
+	svc := ecs.Service{
+		ClusterArn: aws.String("arn:aws:ecs:us-west-2:123456789012:cluster/my-cluster"),
+		Deployments: []*ecs.Deployment{
+			{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), TaskDefinition: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2")},
+		},
+	}
+	if err := checkFailedTasks(context.Background(), api, svc, 3); err != nil {
+		t.Errorf("2 consecutive failed tasks must not reach the threshold of 3, got %v", err)
+	}
+	if err := checkFailedTasks(context.Background(), api, svc, -1); err != nil {
+		t.Errorf("a negative threshold must disable the check, got %v", err)
+	}
+	if err := checkFailedTasks(context.Background(), api, svc, 0); err != nil {
+		t.Errorf("a zero threshold must disable the check, got %v", err)
+	}
+	err := checkFailedTasks(context.Background(), api, svc, 2)
+	var failedTasksError *FailedTasksError
+	if !errors.As(err, &failedTasksError) || !errors.Is(err, ErrTasksFailing) || !errors.Is(err, &backoff.PermanentError{}) {
+		t.Fatalf("expected permanent FailedTasksError, got %v", err)
+	}
+	if len(failedTasksError.Tasks) != 2 || failedTasksError.Tasks[0].TaskArn != "task1" || failedTasksError.Tasks[1].TaskArn != "task2" {
+		t.Errorf("unexpected failed tasks %v", failedTasksError.Tasks)
+	}
+	if !strings.Contains(err.Error(), "task1 EssentialContainerExited: Essential container in task exited (my-container exit code 1)") {
+		t.Errorf("the error must include the stopped reasons and exit codes, got %v", err)
+	}
+}
+
+func TestAlterServiceOrValidatedRollBackFailedTasks(t *testing.T) {
+	api := newMockDeployEcsClient()
+	now := time.Now()
+	api.tasks = map[string][]*ecs.Task{
+		ecs.DesiredStatusStopped: {
+			stoppedTask("task1", "ecs-svc/1", ecs.TaskStopCodeEssentialContainerExited, "Essential container in task exited", now, aws.Int64(1)),
+		},
+	}
+	validations := 0
+	validate := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		validations++
+		return validateDeployment(ctx, ecsapi, elbv2api, svc, bo)
+	}
+	bo := backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	err := alterServiceOrValidatedRollBack(context.Background(), &ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: "my-service", Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: bo, FailedTasksThreshold: 1}, validate, validate)
+	if !errors.Is(err, ErrSuccessfulRollback) {
+		t.Fatalf("expected %v, got %v", ErrSuccessfulRollback, err)
+	}
+	if validations != 1 {
+		t.Errorf("only the rollback is expected to be validated, got %d validations", validations)
+	}
+}
@@ -0,0 +1,177 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"strings"
+)
+
+// DefaultUnhealthyThreshold number of consecutive checks a target of the deployment may be reported unhealthy before
+// the deployment is considered failed
+const DefaultUnhealthyThreshold = 3
+
+var (
+	// ErrWaitingForHealthyTargets the targets of the deployment are not healthy yet
+	ErrWaitingForHealthyTargets = errors.New("waiting for the deployment targets to be healthy")
+	// ErrTargetsUnhealthy the targets of the deployment were reported unhealthy too many times
+	ErrTargetsUnhealthy = errors.New("the deployment targets are unhealthy")
+)
+
+// loadBalancerTarget identifies a target of a target group, either an IP address (awsvpc network mode) or an EC2
+// instance id and port
+type loadBalancerTarget struct {
+	id   string
+	port int64
+}
+
+func (t loadBalancerTarget) String() string {
+	return fmt.Sprintf("%s:%d", t.id, t.port)
+}
+
+func getTargetHealth(ctx context.Context, targetGroupArn string, elbv2api elbv2iface.ELBV2API) (map[loadBalancerTarget]*elbv2.TargetHealth, error) {
+	describeLbOutput, err := elbv2api.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("on get target health while describe target health: %w", err)
+	}
+	targetHealth := map[loadBalancerTarget]*elbv2.TargetHealth{}
+	for _, desc := range describeLbOutput.TargetHealthDescriptions {
+		target := loadBalancerTarget{id: aws.StringValue(desc.Target.Id), port: aws.Int64Value(desc.Target.Port)}
+		targetHealth[target] = desc.TargetHealth
+	}
+	return targetHealth, nil
+}
+
+func containerInstanceEc2Ids(ctx context.Context, api ecsiface.ECSAPI, cluster *string, tasks []*ecs.Task) (map[string]string, error) {
+	var containerInstanceArns []*string
+	found := map[string]bool{}
+	for _, task := range tasks {
+		if task.ContainerInstanceArn != nil && !found[*task.ContainerInstanceArn] {
+			found[*task.ContainerInstanceArn] = true
+			containerInstanceArns = append(containerInstanceArns, task.ContainerInstanceArn)
+		}
+	}
+	ec2Ids := map[string]string{}
+	for len(containerInstanceArns) > 0 {
+		batch := containerInstanceArns
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		containerInstanceArns = containerInstanceArns[len(batch):]
+		output, err := api.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{Cluster: cluster, ContainerInstances: batch})
+		if err != nil {
+			return nil, fmt.Errorf("on container instance ec2 ids while describe container instances: %w", err)
+		}
+		for _, containerInstance := range output.ContainerInstances {
+			ec2Ids[aws.StringValue(containerInstance.ContainerInstanceArn)] = aws.StringValue(containerInstance.Ec2InstanceId)
+		}
+	}
+	return ec2Ids, nil
+}
+
+// taskTarget returns the target the task registers in the load balancer target group, false if the task doesn't have
+// a network address yet
+func taskTarget(task *ecs.Task, loadBalancer *ecs.LoadBalancer, ec2Ids map[string]string) (loadBalancerTarget, bool) {
+	for _, container := range task.Containers {
+		if aws.StringValue(container.Name) != aws.StringValue(loadBalancer.ContainerName) {
+			continue
+		}
+		for _, networkInterface := range container.NetworkInterfaces {
+			if networkInterface.PrivateIpv4Address != nil {
+				return loadBalancerTarget{id: *networkInterface.PrivateIpv4Address, port: aws.Int64Value(loadBalancer.ContainerPort)}, true
+			}
+		}
+		ec2Id := ec2Ids[aws.StringValue(task.ContainerInstanceArn)]
+		for _, networkBinding := range container.NetworkBindings {
+			if ec2Id != "" && aws.Int64Value(networkBinding.ContainerPort) == aws.Int64Value(loadBalancer.ContainerPort) {
+				return loadBalancerTarget{id: ec2Id, port: aws.Int64Value(networkBinding.HostPort)}, true
+			}
+		}
+	}
+	return loadBalancerTarget{}, false
+}
+
+// newValidateTargetsHealthy returns a ValidateDeploymentFunc waiting until the RUNNING tasks of the PRIMARY deployment
+// are healthy in every target group of the service, targets reported unhealthy on unhealthyThreshold consecutive
+// checks fail the deployment
+func newValidateTargetsHealthy(unhealthyThreshold int) ValidateDeploymentFunc {
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	unhealthyChecks := map[string]int{} // Map of deployment target group and target and consecutive unhealthy checks
+	return func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
+		deployment := primaryDeployment(ecsService)
+		if deployment == nil {
+			return errNoPrimaryDeployment
+		}
+		if len(serviceTargetGroupArns(ecsService)) == 0 {
+			return ErrLoadBalancerNotConfigured
+		}
+		tasks, err := describeDeploymentTasks(ctx, ecsapi, ecsService.ClusterArn, *deployment, ecs.DesiredStatusRunning)
+		if err != nil {
+			return err
+		}
+		if int64(len(tasks)) < aws.Int64Value(deployment.DesiredCount) {
+			return fmt.Errorf("%w: %d of %d tasks running", ErrNotRunningDesiredCount, len(tasks), aws.Int64Value(deployment.DesiredCount))
+		}
+		ec2Ids, err := containerInstanceEc2Ids(ctx, ecsapi, ecsService.ClusterArn, tasks)
+		if err != nil {
+			return err
+		}
+		var waiting, unhealthy []string
+		for _, loadBalancer := range ecsService.LoadBalancers {
+			if loadBalancer.TargetGroupArn == nil {
+				continue
+			}
+			targetGroupArn := *loadBalancer.TargetGroupArn
+			targetHealth, err := getTargetHealth(ctx, targetGroupArn, elbv2api)
+			if err != nil {
+				return err
+			}
+			states := map[string]string{}
+			for _, task := range tasks {
+				target, found := taskTarget(task, loadBalancer, ec2Ids)
+				if !found {
+					waiting = append(waiting, fmt.Sprintf("%s without target in %s", aws.StringValue(task.TaskArn), targetGroupArn))
+					continue
+				}
+				state := "unregistered"
+				if health := targetHealth[target]; health != nil {
+					state = aws.StringValue(health.State)
+				}
+				states[fmt.Sprint(target)] = state
+				key := fmt.Sprintf("%s %s %s", aws.StringValue(deployment.Id), targetGroupArn, target)
+				switch state {
+				case elbv2.TargetHealthStateEnumHealthy:
+					delete(unhealthyChecks, key)
+					continue
+				case elbv2.TargetHealthStateEnumUnhealthy:
+					unhealthyChecks[key]++
+					if unhealthyChecks[key] >= unhealthyThreshold {
+						health := targetHealth[target]
+						unhealthy = append(unhealthy, fmt.Sprintf("%s in %s %s: %s", target, targetGroupArn, aws.StringValue(health.Reason), aws.StringValue(health.Description)))
+					}
+				default:
+					delete(unhealthyChecks, key)
+				}
+				waiting = append(waiting, fmt.Sprintf("%s %s in %s", target, state, targetGroupArn))
+			}
+			emit(ctx, DeploymentTargetStates{TargetGroupArn: targetGroupArn, DeploymentId: aws.StringValue(deployment.Id), States: states})
+		}
+		if len(unhealthy) > 0 {
+			return backoff.Permanent(fmt.Errorf("%w: %s", ErrTargetsUnhealthy, strings.Join(unhealthy, "; ")))
+		}
+		if len(waiting) > 0 {
+			return fmt.Errorf("%w: %s", ErrWaitingForHealthyTargets, strings.Join(waiting, ", "))
+		}
+		return nil
+	}
+}
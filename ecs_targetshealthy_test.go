@@ -0,0 +1,155 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"testing"
+)
+
+type mockContainerInstancesEcsClient struct {
+	*mockDeployEcsClient
+	ec2Ids map[string]string // Map of container instance ARNs and EC2 instance ids
+}
+
+func (m *mockContainerInstancesEcsClient) DescribeContainerInstancesWithContext(ctx aws.Context, input *ecs.DescribeContainerInstancesInput, opts ...request.Option) (*ecs.DescribeContainerInstancesOutput, error) {
+	output := &ecs.DescribeContainerInstancesOutput{}
+	for _, containerInstanceArn := range input.ContainerInstances {
+		output.ContainerInstances = append(output.ContainerInstances, &ecs.ContainerInstance{ContainerInstanceArn: containerInstanceArn, Ec2InstanceId: aws.String(m.ec2Ids[*containerInstanceArn])})
+	}
+	return output, nil
+}
+
+type mockTargetDescriptionsClient struct {
+	elbv2iface.ELBV2API
+	descriptions map[string][][]*elbv2.TargetHealthDescription // Map of target group ARNs and the descriptions of each call
+	calls        map[string]int
+}
+
+func (m *mockTargetDescriptionsClient) DescribeTargetHealthWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	descriptions := m.descriptions[*input.TargetGroupArn]
+	call := m.calls[*input.TargetGroupArn]
+	if call >= len(descriptions) {
+		call = len(descriptions) - 1
+	}
+	m.calls[*input.TargetGroupArn]++
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: descriptions[call]}, nil
+}
+
+func targetHealthDescription(id string, port int64, state string) *elbv2.TargetHealthDescription {
+	return &elbv2.TargetHealthDescription{
+		Target:       &elbv2.TargetDescription{Id: aws.String(id), Port: aws.Int64(port)},
+		TargetHealth: &elbv2.TargetHealth{State: aws.String(state), Reason: aws.String("Target.ResponseCodeMismatch"), Description: aws.String("Health checks failed with these codes: [502]")},
+	}
+}
+
+func runningAwsvpcTask(arn, ip string) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:           aws.String(arn),
+		StartedBy:         aws.String("ecs-svc/1"),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"),
+		Containers: []*ecs.Container{
+			{Name: aws.String("my-container"), NetworkInterfaces: []*ecs.NetworkInterface{{PrivateIpv4Address: aws.String(ip)}}},
+		},
+	}
+}
+
+func TestValidateTargetsHealthy(t *testing.T) {
+	healthy, initial, unhealthy := elbv2.TargetHealthStateEnumHealthy, elbv2.TargetHealthStateEnumInitial, elbv2.TargetHealthStateEnumUnhealthy
+	bridgeTask := &ecs.Task{
+		TaskArn:              aws.String("task3"),
+		StartedBy:            aws.String("ecs-svc/1"),
+		TaskDefinitionArn:    aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"),
+		ContainerInstanceArn: aws.String("container-instance1"),
+		Containers: []*ecs.Container{
+			{Name: aws.String("my-container"), NetworkBindings: []*ecs.NetworkBinding{{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(32768)}}},
+		},
+	}
+	tests := []struct {
+		name         string
+		tasks        []*ecs.Task
+		descriptions map[string][][]*elbv2.TargetHealthDescription
+		want         []error
+	}{
+		{
+			name:  "healthy in every target group",
+			tasks: []*ecs.Task{runningAwsvpcTask("task1", "10.0.0.1"), runningAwsvpcTask("task2", "10.0.0.2")},
+			descriptions: map[string][][]*elbv2.TargetHealthDescription{
+				"public": {
+					{targetHealthDescription("10.0.0.1", 8080, initial), targetHealthDescription("10.0.0.2", 8080, healthy)},
+					{targetHealthDescription("10.0.0.1", 8080, healthy), targetHealthDescription("10.0.0.2", 8080, healthy)},
+				},
+				"internal": {
+					{targetHealthDescription("10.0.0.1", 8080, healthy), targetHealthDescription("10.0.0.9", 8080, healthy)},
+					{targetHealthDescription("10.0.0.1", 8080, healthy), targetHealthDescription("10.0.0.9", 8080, healthy)},
+					{targetHealthDescription("10.0.0.1", 8080, healthy), targetHealthDescription("10.0.0.2", 8080, healthy)},
+				},
+			},
+			want: []error{ErrWaitingForHealthyTargets, ErrWaitingForHealthyTargets, nil},
+		},
+		{
+			name:  "bridge network mode",
+			tasks: []*ecs.Task{bridgeTask},
+			descriptions: map[string][][]*elbv2.TargetHealthDescription{
+				"public":   {{targetHealthDescription("i-0123", 32768, healthy)}},
+				"internal": {{targetHealthDescription("i-0123", 32767, healthy)}, {targetHealthDescription("i-0123", 32768, healthy)}},
+			},
+			want: []error{ErrWaitingForHealthyTargets, nil},
+		},
+		{
+			name:  "unhealthy past the threshold",
+			tasks: []*ecs.Task{runningAwsvpcTask("task1", "10.0.0.1")},
+			descriptions: map[string][][]*elbv2.TargetHealthDescription{
+				"public":   {{targetHealthDescription("10.0.0.1", 8080, unhealthy)}},
+				"internal": {{targetHealthDescription("10.0.0.1", 8080, initial)}},
+			},
+			want: []error{ErrWaitingForHealthyTargets, ErrWaitingForHealthyTargets, ErrTargetsUnhealthy},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ecsapi := &mockContainerInstancesEcsClient{mockDeployEcsClient: newMockDeployEcsClient(), ec2Ids: map[string]string{"container-instance1": "i-0123"}}
+			ecsapi.tasks = map[string][]*ecs.Task{ecs.DesiredStatusRunning: tt.tasks}
+			elbv2api := &mockTargetDescriptionsClient{descriptions: tt.descriptions, calls: map[string]int{}}
+			svc := ecs.Service{
+				ClusterArn: ecsapi.service.ClusterArn,
+				LoadBalancers: []*ecs.LoadBalancer{
+					{TargetGroupArn: aws.String("public"), ContainerName: aws.String("my-container"), ContainerPort: aws.Int64(8080)},
+					{TargetGroupArn: aws.String("internal"), ContainerName: aws.String("my-container"), ContainerPort: aws.Int64(8080)},
+				},
+				Deployments: []*ecs.Deployment{
+					{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), TaskDefinition: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2"), DesiredCount: aws.Int64(int64(len(tt.tasks)))},
+				},
+			}
+			validate := newValidateTargetsHealthy(3)
+			for i, want := range tt.want {
+				err := validate(context.Background(), ecsapi, elbv2api, svc, &backoff.ZeroBackOff{})
+				if !errors.Is(err, want) {
+					t.Fatalf("check %d: expected %v, got %v", i, want, err)
+				}
+				if permanent := errors.Is(err, &backoff.PermanentError{}); permanent != (want == ErrTargetsUnhealthy) {
+					t.Errorf("check %d: unexpected permanent %v", i, permanent)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTargetsHealthyNotRunningDesiredCount(t *testing.T) {
+	ecsapi := newMockDeployEcsClient()
+	ecsapi.tasks = map[string][]*ecs.Task{ecs.DesiredStatusRunning: {runningAwsvpcTask("task1", "10.0.0.1")}}
+	svc := ecs.Service{
+		ClusterArn:    ecsapi.service.ClusterArn,
+		LoadBalancers: []*ecs.LoadBalancer{{TargetGroupArn: aws.String("public"), ContainerName: aws.String("my-container"), ContainerPort: aws.Int64(8080)}},
+		Deployments:   []*ecs.Deployment{{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY"), DesiredCount: aws.Int64(2)}},
+	}
+	err := newValidateTargetsHealthy(0)(context.Background(), ecsapi, nil, svc, &backoff.ZeroBackOff{})
+	if !errors.Is(err, ErrNotRunningDesiredCount) {
+		t.Errorf("expected %v, got %v", ErrNotRunningDesiredCount, err)
+	}
+}
@@ -1,10 +1,15 @@
 package awsecs
 
 import (
+	"context"
 	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
 	"reflect"
 	"testing"
 )
@@ -202,3 +207,124 @@ func Test_ifEmptyThenNil(t *testing.T) {
 		})
 	}
 }
+
+func Test_copyTd(t *testing.T) {
+	input := ecs.TaskDefinition{}
+	inputValue := reflect.ValueOf(&input).Elem()
+	for i := 0; i < inputValue.NumField(); i++ {
+		field := inputValue.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Ptr:
+			field.Set(reflect.New(field.Type().Elem()))
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		default:
+			t.Fatalf("unexpected kind %s for field %s", field.Kind(), inputValue.Type().Field(i).Name)
+		}
+	}
+	// fields which can't be copied from the task definition
+	notCopied := map[string]bool{"Tags": true}
+	output := copyTd(input, nil)
+	outputValue := reflect.ValueOf(output)
+	for i := 0; i < outputValue.NumField(); i++ {
+		field := outputValue.Type().Field(i)
+		if field.PkgPath != "" || notCopied[field.Name] {
+			continue
+		}
+		if outputValue.Field(i).IsZero() {
+			t.Errorf("copyTd() did not copy %s", field.Name)
+		}
+	}
+}
+
+func Test_copyTdRuntimePlatformAndEphemeralStorage(t *testing.T) {
+	input := ecs.TaskDefinition{
+		Family:           aws.String("my-family"),
+		Revision:         aws.Int64(2),
+		EphemeralStorage: &ecs.EphemeralStorage{SizeInGiB: aws.Int64(50)},
+		RuntimePlatform: &ecs.RuntimePlatform{
+			CpuArchitecture:       aws.String(ecs.CPUArchitectureArm64),
+			OperatingSystemFamily: aws.String(ecs.OSFamilyLinux),
+		},
+	}
+	want := ecs.RegisterTaskDefinitionInput{
+		Family:           aws.String("my-family"),
+		EphemeralStorage: &ecs.EphemeralStorage{SizeInGiB: aws.Int64(50)},
+		RuntimePlatform: &ecs.RuntimePlatform{
+			CpuArchitecture:       aws.String(ecs.CPUArchitectureArm64),
+			OperatingSystemFamily: aws.String(ecs.OSFamilyLinux),
+		},
+	}
+	if got := copyTd(input, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("copyTd() = %v, want %v", got, want)
+	}
+}
+
+type mockTargetHealthClient struct {
+	elbv2iface.ELBV2API
+	targetStates map[string][]map[string]string // Map of target group ARNs and the target states of each call
+	calls        map[string]int
+}
+
+func (m *mockTargetHealthClient) DescribeTargetHealthWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	states := m.targetStates[*input.TargetGroupArn]
+	call := m.calls[*input.TargetGroupArn]
+	if call >= len(states) {
+		call = len(states) - 1
+	}
+	m.calls[*input.TargetGroupArn]++
+	output := &elbv2.DescribeTargetHealthOutput{}
+	for id, state := range states[call] {
+		output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(id)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		})
+	}
+	return output, nil
+}
+
+func TestValidateDraining(t *testing.T) {
+	healthy, draining := elbv2.TargetHealthStateEnumHealthy, elbv2.TargetHealthStateEnumDraining
+	tests := []struct {
+		name         string
+		targetStates map[string][]map[string]string
+		wantErr      error
+	}{
+		{
+			name: "every target group draining",
+			targetStates: map[string][]map[string]string{
+				"public":   {{"i-1": healthy}, {"i-1": draining}},
+				"internal": {{"i-1": healthy}, {"i-1": healthy}, {"i-1": draining}, {}},
+			},
+		},
+		{
+			name: "one target group never draining",
+			targetStates: map[string][]map[string]string{
+				"public":   {{"i-1": healthy}, {"i-1": draining}},
+				"internal": {{"i-1": healthy}},
+			},
+			wantErr: ErrWaitingForDrainingState,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ecsapi := newMockDeployEcsClient()
+			ecsapi.service.LoadBalancers = []*ecs.LoadBalancer{
+				{TargetGroupArn: aws.String("public"), ContainerName: aws.String("my-container")},
+				{TargetGroupArn: aws.String("internal"), ContainerName: aws.String("my-container")},
+				{TargetGroupArn: aws.String("public"), ContainerName: aws.String("my-container")},
+			}
+			elbv2api := &mockTargetHealthClient{targetStates: tt.targetStates, calls: map[string]int{}}
+			err := validateDraining(context.Background(), ecsapi, elbv2api, *ecsapi.service, backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 5))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if len(elbv2api.calls) != 2 {
+				t.Errorf("expected the 2 distinct target groups to be described, got %v", elbv2api.calls)
+			}
+		})
+	}
+}
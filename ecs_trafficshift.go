@@ -0,0 +1,358 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTrafficShiftSteps percentages of the traffic forwarded to the updated service when
+// ECSTrafficShiftUpdate.Steps is empty
+var DefaultTrafficShiftSteps = []int64{10, 50, 100}
+
+var (
+	// ErrTargetGroupsNotForwarded the listener or listener rule forwards to neither the blue nor the green target group
+	ErrTargetGroupsNotForwarded = errors.New("the listener forwards to neither the blue nor the green target group")
+	// ErrInvalidTrafficShiftSteps the steps are not increasing percentages ending with 100
+	ErrInvalidTrafficShiftSteps = errors.New("the traffic shift steps must be increasing percentages ending with 100")
+	// ErrTargetGroupUnhealthy targets of the target group of the updated service are unhealthy
+	ErrTargetGroupUnhealthy = errors.New("the target group has unhealthy targets")
+)
+
+// TrafficShiftService a service of an ECSTrafficShiftUpdate and the target group it is attached to
+type TrafficShiftService struct {
+	Service        string // Name of the service
+	TargetGroupArn string // Target group the service is attached to
+}
+
+// ECSTrafficShiftUpdate updates the idle one of two services, blue and green, each attached to its own target group
+// of an ALB listener or listener rule, and shifts the traffic to it in steps with a weighted forward action. The idle
+// service is the one receiving the least traffic, it is updated with the desired count of the live one unless
+// Update.DesiredCount is set. Every step must keep passing the validation of the update and the health of the target
+// group of the updated service for StepTime. If any step fails the weights are reverted and the updated service is
+// rolled back, once the traffic is shifted the previously live service is left idle for the next update
+type ECSTrafficShiftUpdate struct {
+	Update      ECSServiceUpdate    // Update of the idle service, its Service is ignored
+	ListenerArn string              // Listener whose default action forwards to the target groups, used if RuleArn is empty
+	RuleArn     string              // Listener rule whose action forwards to the target groups
+	Blue        TrafficShiftService // One of the services
+	Green       TrafficShiftService // The other service
+	Steps       []int64             // Percentages of the traffic forwarded to the updated service, increasing and ending with 100, if empty DefaultTrafficShiftSteps is used
+	StepTime    time.Duration       // Time each step must keep passing the validation before the next step
+}
+
+func (s *ECSTrafficShiftUpdate) steps() ([]int64, error) {
+	steps := s.Steps
+	if len(steps) == 0 {
+		steps = DefaultTrafficShiftSteps
+	}
+	var previous int64
+	for _, step := range steps {
+		if step <= previous || step > 100 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTrafficShiftSteps, steps)
+		}
+		previous = step
+	}
+	if previous != 100 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTrafficShiftSteps, steps)
+	}
+	return steps, nil
+}
+
+// actions returns the actions of the listener rule, or the default actions of the listener
+func (s *ECSTrafficShiftUpdate) actions(ctx context.Context) ([]*elbv2.Action, error) {
+	if s.RuleArn != "" {
+		output, err := s.Update.ElbApi.DescribeRulesWithContext(ctx, &elbv2.DescribeRulesInput{RuleArns: []*string{aws.String(s.RuleArn)}})
+		if err != nil {
+			return nil, fmt.Errorf("on traffic shift while describe rules: %w", err)
+		}
+		if len(output.Rules) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrTargetGroupsNotForwarded, s.RuleArn)
+		}
+		return output.Rules[0].Actions, nil
+	}
+	output, err := s.Update.ElbApi.DescribeListenersWithContext(ctx, &elbv2.DescribeListenersInput{ListenerArns: []*string{aws.String(s.ListenerArn)}})
+	if err != nil {
+		return nil, fmt.Errorf("on traffic shift while describe listeners: %w", err)
+	}
+	if len(output.Listeners) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTargetGroupsNotForwarded, s.ListenerArn)
+	}
+	return output.Listeners[0].DefaultActions, nil
+}
+
+// modifyActions sets the actions of the listener rule, or the default actions of the listener
+func (s *ECSTrafficShiftUpdate) modifyActions(ctx context.Context, actions []*elbv2.Action) error {
+	if s.RuleArn != "" {
+		_, err := s.Update.ElbApi.ModifyRuleWithContext(ctx, &elbv2.ModifyRuleInput{RuleArn: aws.String(s.RuleArn), Actions: actions})
+		if err != nil {
+			return fmt.Errorf("on traffic shift while modify rule: %w", err)
+		}
+		return nil
+	}
+	_, err := s.Update.ElbApi.ModifyListenerWithContext(ctx, &elbv2.ModifyListenerInput{ListenerArn: aws.String(s.ListenerArn), DefaultActions: actions})
+	if err != nil {
+		return fmt.Errorf("on traffic shift while modify listener: %w", err)
+	}
+	return nil
+}
+
+// forwardWeights returns the weight of every target group the forward action forwards to
+func forwardWeights(actions []*elbv2.Action) map[string]int64 {
+	weights := map[string]int64{}
+	for _, action := range actions {
+		if aws.StringValue(action.Type) != elbv2.ActionTypeEnumForward {
+			continue
+		}
+		if action.ForwardConfig == nil || len(action.ForwardConfig.TargetGroups) == 0 {
+			weights[aws.StringValue(action.TargetGroupArn)] = 1
+			continue
+		}
+		for _, targetGroup := range action.ForwardConfig.TargetGroups {
+			// a target group without weight has the weight 1
+			weight := int64(1)
+			if targetGroup.Weight != nil {
+				weight = *targetGroup.Weight
+			}
+			weights[aws.StringValue(targetGroup.TargetGroupArn)] = weight
+		}
+	}
+	return weights
+}
+
+// weightedActions returns a copy of actions with a forward action to the target groups of weights, the other target
+// groups of the forward action keep their weight
+func weightedActions(actions []*elbv2.Action, weights map[string]int64) []*elbv2.Action {
+	var copied []*elbv2.Action
+	for _, action := range actions {
+		if aws.StringValue(action.Type) != elbv2.ActionTypeEnumForward {
+			copied = append(copied, action)
+			continue
+		}
+		all := forwardWeights([]*elbv2.Action{action})
+		for targetGroupArn, weight := range weights {
+			all[targetGroupArn] = weight
+		}
+		var targetGroupArns []string
+		for targetGroupArn := range all {
+			targetGroupArns = append(targetGroupArns, targetGroupArn)
+		}
+		sort.Strings(targetGroupArns)
+		forwardConfig := &elbv2.ForwardActionConfig{}
+		if action.ForwardConfig != nil {
+			forwardConfig.TargetGroupStickinessConfig = action.ForwardConfig.TargetGroupStickinessConfig
+		}
+		for _, targetGroupArn := range targetGroupArns {
+			forwardConfig.TargetGroups = append(forwardConfig.TargetGroups, &elbv2.TargetGroupTuple{TargetGroupArn: aws.String(targetGroupArn), Weight: aws.Int64(all[targetGroupArn])})
+		}
+		copied = append(copied, &elbv2.Action{Type: action.Type, Order: action.Order, ForwardConfig: forwardConfig})
+	}
+	return copied
+}
+
+// liveAndIdle returns the service receiving the most traffic and the other one
+func (s *ECSTrafficShiftUpdate) liveAndIdle(weights map[string]int64) (TrafficShiftService, TrafficShiftService, error) {
+	blueWeight, blueFound := weights[s.Blue.TargetGroupArn]
+	greenWeight, greenFound := weights[s.Green.TargetGroupArn]
+	if !blueFound && !greenFound {
+		return TrafficShiftService{}, TrafficShiftService{}, ErrTargetGroupsNotForwarded
+	}
+	if greenWeight > blueWeight {
+		return s.Green, s.Blue, nil
+	}
+	return s.Blue, s.Green, nil
+}
+
+// targetGroupHealthy validates that the target group has healthy targets and no unhealthy one
+func targetGroupHealthy(targetGroupArn string) ValidateDeploymentFunc {
+	return func(ctx context.Context, _ ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, _ ecs.Service, _ backoff.BackOff) error {
+		targetStates, err := getTargetStates(ctx, targetGroupArn, elbv2api)
+		if err != nil {
+			return fmt.Errorf("on target group healthy while describe target health: %w", err)
+		}
+		var healthy int
+		var unhealthy []string
+		for id, state := range targetStates {
+			switch state {
+			case elbv2.TargetHealthStateEnumHealthy:
+				healthy++
+			case elbv2.TargetHealthStateEnumUnhealthy:
+				unhealthy = append(unhealthy, id)
+			}
+		}
+		if len(unhealthy) > 0 {
+			sort.Strings(unhealthy)
+			return backoff.Permanent(fmt.Errorf("%w: %s: %s", ErrTargetGroupUnhealthy, targetGroupArn, strings.Join(unhealthy, ", ")))
+		}
+		if healthy == 0 {
+			return fmt.Errorf("%w: %s", ErrWaitingForHealthyTargets, targetGroupArn)
+		}
+		return nil
+	}
+}
+
+// idleUpdate returns the update of the idle service, with the desired count of the live one if not set
+func (s *ECSTrafficShiftUpdate) idleUpdate(ctx context.Context, live, idle TrafficShiftService) (*ECSServiceUpdate, error) {
+	update := s.Update
+	update.Service = idle.Service
+	if update.DesiredCount == nil {
+		output, err := update.EcsApi.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(update.Cluster), Services: []*string{aws.String(live.Service)}})
+		if err != nil {
+			return nil, fmt.Errorf("on traffic shift while describe service: %w", err)
+		}
+		svc := activeService(output, live.Service)
+		if svc == nil {
+			return nil, ErrServiceNotFound
+		}
+		update.DesiredCount = svc.DesiredCount
+	}
+	return &update, nil
+}
+
+// Apply the ECS Traffic Shift Update
+func (s *ECSTrafficShiftUpdate) Apply() error {
+	return s.ApplyWithContext(context.Background())
+}
+
+// ApplyWithContext applies the ECS Traffic Shift Update, if the context is cancelled the weights are reverted and the
+// updated service is rolled back
+func (s *ECSTrafficShiftUpdate) ApplyWithContext(ctx context.Context) error {
+	ctx = withEventSink(ctx, s.Update.EventSink)
+	steps, err := s.steps()
+	if err != nil {
+		return err
+	}
+	actions, err := s.actions(ctx)
+	if err != nil {
+		return err
+	}
+	weights := forwardWeights(actions)
+	live, idle, err := s.liveAndIdle(weights)
+	if err != nil {
+		return err
+	}
+	e, err := s.idleUpdate(ctx, live, idle)
+	if err != nil {
+		return err
+	}
+	validate, err := e.validator()
+	if err != nil {
+		return err
+	}
+	validateRollback, err := e.rollbackValidator()
+	if err != nil {
+		return err
+	}
+
+	emit(ctx, TrafficShiftStarted{LiveService: live.Service, IdleService: idle.Service})
+	shifted := false
+	oldsvc, newsvc, deployErr := alterServiceValidateDeployment(ctx, e, validate)
+	if deployErr == nil {
+		newStepValidator := func() (ValidateDeploymentFunc, error) {
+			validate, err := e.validator()
+			if err != nil {
+				return nil, err
+			}
+			return ChainValidators(targetGroupHealthy(idle.TargetGroupArn), validate), nil
+		}
+		for _, step := range steps {
+			emit(ctx, TrafficShifted{Service: idle.Service, Percent: step})
+			shifted = true
+			deployErr = s.modifyActions(ctx, weightedActions(actions, map[string]int64{idle.TargetGroupArn: step, live.TargetGroupArn: 100 - step}))
+			if deployErr == nil {
+				deployErr = bakeDeployment(ctx, e.EcsApi, e.ElbApi, newsvc, s.StepTime, e.BackOff, newStepValidator, e.FailedTasksThreshold)
+			}
+			if deployErr != nil {
+				break
+			}
+		}
+	}
+	if deployErr != nil {
+		rollbackCtx := detachedContext{parent: ctx}
+		var revertErr error
+		if shifted {
+			// the traffic goes back to the live service before the updated one is rolled back
+			emit(rollbackCtx, TrafficRevertStarted{Service: live.Service})
+			if revertErr = s.modifyActions(rollbackCtx, weightedActions(actions, weights)); revertErr != nil {
+				emit(rollbackCtx, TrafficRevertFailed{Service: live.Service, Err: revertErr})
+			}
+		}
+		rollbackErr := rollBackService(rollbackCtx, e.EcsApi, e.ElbApi, e.CodeDeploy, oldsvc, newsvc, deployErr, e.BackOff, validateRollback)
+		if rollbackErr == ErrNothingToRollback {
+			return deployErr
+		}
+		if rollback, ok := rollbackErr.(*RollbackError); ok && revertErr != nil && rollback.Err == nil {
+			rollback.Err = revertErr
+		}
+		// the rollback outcome is what matters, a failing post-rollback hook is only emitted
+		outcome := rollbackOutcome(rollbackErr)
+		if err := runHooks(rollbackCtx, e.EcsApi, oldsvc, e.PostRollbackHooks, hookEnv(oldsvc, newsvc, outcome)); err != nil {
+			emit(rollbackCtx, PostRollbackHooksFailed{Service: e.Service, Outcome: outcome, Err: err})
+		}
+		return rollbackErr
+	}
+	// the deployment is validated, a failing post-success hook doesn't roll it back
+	if err := runHooks(ctx, e.EcsApi, newsvc, e.PostSuccessHooks, hookEnv(oldsvc, newsvc, OutcomeSuccess)); err != nil {
+		return fmt.Errorf("%w: %v", ErrPostSuccessHookFailed, err)
+	}
+	return nil
+}
+
+// IdleService returns the service receiving the least traffic, the one Apply updates
+func (s *ECSTrafficShiftUpdate) IdleService() (TrafficShiftService, error) {
+	return s.IdleServiceWithContext(context.Background())
+}
+
+// IdleServiceWithContext returns the service receiving the least traffic using the provided context
+func (s *ECSTrafficShiftUpdate) IdleServiceWithContext(ctx context.Context) (TrafficShiftService, error) {
+	actions, err := s.actions(ctx)
+	if err != nil {
+		return TrafficShiftService{}, err
+	}
+	_, idle, err := s.liveAndIdle(forwardWeights(actions))
+	return idle, err
+}
+
+// Plan the ECS Traffic Shift Update without registering the task definition, updating the service nor shifting the
+// traffic
+func (s *ECSTrafficShiftUpdate) Plan() (string, error) {
+	return s.PlanWithContext(context.Background())
+}
+
+// PlanWithContext plans the ECS Traffic Shift Update using the provided context
+func (s *ECSTrafficShiftUpdate) PlanWithContext(ctx context.Context) (string, error) {
+	steps, err := s.steps()
+	if err != nil {
+		return "", err
+	}
+	actions, err := s.actions(ctx)
+	if err != nil {
+		return "", err
+	}
+	live, idle, err := s.liveAndIdle(forwardWeights(actions))
+	if err != nil {
+		return "", err
+	}
+	e, err := s.idleUpdate(ctx, live, idle)
+	if err != nil {
+		return "", err
+	}
+	plan, err := e.PlanWithContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	var percentages []string
+	for _, step := range steps {
+		percentages = append(percentages, fmt.Sprintf("%d%%", step))
+	}
+	return fmt.Sprintf("traffic: %s -> %s in steps of %s\n%s", live.Service, idle.Service, strings.Join(percentages, ", "), plan), nil
+}
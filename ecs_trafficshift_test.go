@@ -0,0 +1,201 @@
+package awsecs
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	blueTargetGroupArn  = "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/blue/1"
+	greenTargetGroupArn = "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/green/1"
+)
+
+// mockListenerClient forwards to the blue and green target groups with a listener rule or the default action of a
+// listener, the target group receiving traffic turns unhealthy once its weight reaches unhealthyFrom
+type mockListenerClient struct {
+	elbv2iface.ELBV2API
+	actions       []*elbv2.Action
+	unhealthyFrom int64              // If 0 the target groups stay healthy
+	weights       []map[string]int64 // Weights of each modification
+}
+
+func (m *mockListenerClient) DescribeRulesWithContext(ctx aws.Context, input *elbv2.DescribeRulesInput, opts ...request.Option) (*elbv2.DescribeRulesOutput, error) {
+	return &elbv2.DescribeRulesOutput{Rules: []*elbv2.Rule{{RuleArn: input.RuleArns[0], Actions: m.actions}}}, nil
+}
+
+func (m *mockListenerClient) DescribeListenersWithContext(ctx aws.Context, input *elbv2.DescribeListenersInput, opts ...request.Option) (*elbv2.DescribeListenersOutput, error) {
+	return &elbv2.DescribeListenersOutput{Listeners: []*elbv2.Listener{{ListenerArn: input.ListenerArns[0], DefaultActions: m.actions}}}, nil
+}
+
+func (m *mockListenerClient) ModifyRuleWithContext(ctx aws.Context, input *elbv2.ModifyRuleInput, opts ...request.Option) (*elbv2.ModifyRuleOutput, error) {
+	m.weights = append(m.weights, forwardWeights(input.Actions))
+	return &elbv2.ModifyRuleOutput{}, nil
+}
+
+func (m *mockListenerClient) ModifyListenerWithContext(ctx aws.Context, input *elbv2.ModifyListenerInput, opts ...request.Option) (*elbv2.ModifyListenerOutput, error) {
+	m.weights = append(m.weights, forwardWeights(input.DefaultActions))
+	return &elbv2.ModifyListenerOutput{}, nil
+}
+
+func (m *mockListenerClient) DescribeTargetHealthWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	state := elbv2.TargetHealthStateEnumHealthy
+	if len(m.weights) > 0 && m.unhealthyFrom > 0 && m.weights[len(m.weights)-1][*input.TargetGroupArn] >= m.unhealthyFrom {
+		state = elbv2.TargetHealthStateEnumUnhealthy
+	}
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: []*elbv2.TargetHealthDescription{targetHealthDescription("10.0.0.1", 8080, state)}}, nil
+}
+
+// newMockBlueGreenEcsClient returns a client with the blue and green services, the live one runs 4 tasks
+func newMockBlueGreenEcsClient(live string) *mockCanaryEcsClient {
+	api := newMockCanaryEcsClient()
+	for _, name := range []string{"blue", "green"} {
+		svc := *api.services["my-service"]
+		svc.ServiceName = aws.String(name)
+		if name != live {
+			svc.DesiredCount, svc.RunningCount = aws.Int64(0), aws.Int64(0)
+		}
+		api.services[name] = &svc
+	}
+	return api
+}
+
+func forwardAction(blueWeight, greenWeight int64) []*elbv2.Action {
+	return []*elbv2.Action{{Type: aws.String(elbv2.ActionTypeEnumForward), ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{
+		{TargetGroupArn: aws.String(blueTargetGroupArn), Weight: aws.Int64(blueWeight)},
+		{TargetGroupArn: aws.String(greenTargetGroupArn), Weight: aws.Int64(greenWeight)},
+	}}}}
+}
+
+func TestECSTrafficShiftUpdate(t *testing.T) {
+	tests := []struct {
+		name          string
+		live          string
+		rule          bool
+		actions       []*elbv2.Action
+		unhealthyFrom int64
+		wantErr       error
+		wantService   string
+		wantWeights   []map[string]int64
+		wantUpdates   int
+	}{
+		{
+			name:        "to green with a rule",
+			live:        "blue",
+			rule:        true,
+			actions:     forwardAction(100, 0),
+			wantService: "green",
+			wantWeights: []map[string]int64{
+				{blueTargetGroupArn: 90, greenTargetGroupArn: 10},
+				{blueTargetGroupArn: 50, greenTargetGroupArn: 50},
+				{blueTargetGroupArn: 0, greenTargetGroupArn: 100},
+			},
+			wantUpdates: 1,
+		},
+		{
+			name:        "to blue with a listener",
+			live:        "green",
+			actions:     forwardAction(0, 100),
+			wantService: "blue",
+			wantWeights: []map[string]int64{
+				{blueTargetGroupArn: 10, greenTargetGroupArn: 90},
+				{blueTargetGroupArn: 50, greenTargetGroupArn: 50},
+				{blueTargetGroupArn: 100, greenTargetGroupArn: 0},
+			},
+			wantUpdates: 1,
+		},
+		{
+			name:          "reverted",
+			live:          "blue",
+			rule:          true,
+			actions:       []*elbv2.Action{{Type: aws.String(elbv2.ActionTypeEnumForward), TargetGroupArn: aws.String(blueTargetGroupArn)}},
+			unhealthyFrom: 50,
+			wantErr:       ErrSuccessfulRollback,
+			wantService:   "green",
+			wantWeights: []map[string]int64{
+				{blueTargetGroupArn: 90, greenTargetGroupArn: 10},
+				{blueTargetGroupArn: 50, greenTargetGroupArn: 50},
+				{blueTargetGroupArn: 1},
+			},
+			wantUpdates: 2,
+		},
+		{name: "not forwarded", live: "blue", actions: []*elbv2.Action{{Type: aws.String(elbv2.ActionTypeEnumFixedResponse)}}, wantErr: ErrTargetGroupsNotForwarded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockBlueGreenEcsClient(tt.live)
+			elbapi := &mockListenerClient{actions: tt.actions, unhealthyFrom: tt.unhealthyFrom}
+			shift := ECSTrafficShiftUpdate{
+				Update: ECSServiceUpdate{
+					EcsApi:  api,
+					ElbApi:  elbapi,
+					Cluster: "my-cluster",
+					Image:   map[string]string{"my-container": "myrepo/myimg:newtag"},
+					BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+				},
+				ListenerArn: "arn:aws:elasticloadbalancing:us-west-2:123456789012:listener/app/my-alb/1/1",
+				Blue:        TrafficShiftService{Service: "blue", TargetGroupArn: blueTargetGroupArn},
+				Green:       TrafficShiftService{Service: "green", TargetGroupArn: greenTargetGroupArn},
+			}
+			if tt.rule {
+				shift.RuleArn = "arn:aws:elasticloadbalancing:us-west-2:123456789012:listener-rule/app/my-alb/1/1/1"
+			}
+			if idle, err := shift.IdleService(); idle.Service != tt.wantService || err != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected the idle service %q, got %q: %v", tt.wantService, idle.Service, err)
+			}
+			err := shift.Apply()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(elbapi.weights, tt.wantWeights) {
+				t.Errorf("expected weights %v, got %v", tt.wantWeights, elbapi.weights)
+			}
+			updates := api.updateInputs[tt.wantService]
+			if len(updates) != tt.wantUpdates || len(api.updateInputs[tt.live]) != 0 {
+				t.Fatalf("expected %d updates of %s only, got %v", tt.wantUpdates, tt.wantService, api.updateInputs)
+			}
+			if tt.wantUpdates > 0 && *updates[0].DesiredCount != 4 {
+				t.Errorf("expected %s updated with the desired count of the live service, got %v", tt.wantService, updates[0])
+			}
+			if tt.wantErr != nil && tt.wantUpdates > 0 && *api.services[tt.wantService].DesiredCount != 0 {
+				t.Errorf("expected %s rolled back, got %v", tt.wantService, api.services[tt.wantService])
+			}
+		})
+	}
+}
+
+func TestECSTrafficShiftUpdateSteps(t *testing.T) {
+	for _, steps := range [][]int64{{10, 50}, {50, 10, 100}, {0, 100}, {50, 150}} {
+		shift := ECSTrafficShiftUpdate{Steps: steps}
+		if err := shift.Apply(); !errors.Is(err, ErrInvalidTrafficShiftSteps) {
+			t.Errorf("%v: expected %v, got %v", steps, ErrInvalidTrafficShiftSteps, err)
+		}
+	}
+}
+
+func TestECSTrafficShiftUpdatePlan(t *testing.T) {
+	shift := ECSTrafficShiftUpdate{
+		Update: ECSServiceUpdate{
+			EcsApi:  newMockBlueGreenEcsClient("blue"),
+			ElbApi:  &mockListenerClient{actions: forwardAction(100, 0)},
+			Cluster: "my-cluster",
+			Image:   map[string]string{"my-container": "myrepo/myimg:newtag"},
+		},
+		RuleArn: "arn:aws:elasticloadbalancing:us-west-2:123456789012:listener-rule/app/my-alb/1/1/1",
+		Blue:    TrafficShiftService{Service: "blue", TargetGroupArn: blueTargetGroupArn},
+		Green:   TrafficShiftService{Service: "green", TargetGroupArn: greenTargetGroupArn},
+	}
+	plan, err := shift.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plan, "traffic: blue -> green in steps of 10%, 50%, 100%\nservice: ") {
+		t.Errorf("unexpected plan %q", plan)
+	}
+}
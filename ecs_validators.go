@@ -0,0 +1,127 @@
+package awsecs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"strings"
+)
+
+// ValidatorFactory creates the validator of a wait until option for an update, it is called once per Apply so the
+// validator may keep state across retries
+type ValidatorFactory func(e *ECSServiceUpdate) ValidateDeploymentFunc
+
+func staticValidator(validate ValidateDeploymentFunc) ValidatorFactory {
+	return func(*ECSServiceUpdate) ValidateDeploymentFunc {
+		return validate
+	}
+}
+
+var waitUntilValidators = map[string]ValidatorFactory{
+	WaitUntilPrimaryRolled:     staticValidator(validateDeployment),
+	WaitUntilDrainingStarted:   staticValidator(validateDraining),
+	WaitUntilRolloutCompleted:  staticValidator(validateRolloutState),
+	WaitUntilContainersHealthy: staticValidator(validateContainersHealthy),
+	WaitUntilTargetsHealthy: func(e *ECSServiceUpdate) ValidateDeploymentFunc {
+		return newValidateTargetsHealthy(e.UnhealthyThreshold)
+	},
+}
+
+// RegisterWaitUntil makes a wait until option available to every ECSServiceUpdate, registering an existing option
+// replaces it. It is not safe for concurrent use, call it from an init function
+func RegisterWaitUntil(name string, factory ValidatorFactory) {
+	if _, found := waitUntilValidators[name]; !found {
+		WaitUntilOptionList = append(WaitUntilOptionList, name)
+	}
+	waitUntilValidators[name] = factory
+}
+
+func parseWaitUntil(waitUntil string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(waitUntil, ",") {
+		name = strings.TrimSpace(name)
+		if _, found := waitUntilValidators[name]; !found {
+			return nil, fmt.Errorf("%w: %q is not one of: %s", ErrInvalidWaitUntil, name, strings.Join(WaitUntilOptionList, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ChainValidators returns a validator passing once every validator passed, in order. A validator which passed for a
+// deployment is not run again for the same deployment when a later validator has to be retried
+func ChainValidators(validators ...ValidateDeploymentFunc) ValidateDeploymentFunc {
+	passed := map[string]int{} // Map of deployment ids and number of validators passed
+	return func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
+		deploymentId := ""
+		if deployment := primaryDeployment(ecsService); deployment != nil {
+			deploymentId = aws.StringValue(deployment.Id)
+		}
+		for passed[deploymentId] < len(validators) {
+			if err := validators[passed[deploymentId]](ctx, ecsapi, elbv2api, ecsService, bo); err != nil {
+				return err
+			}
+			passed[deploymentId]++
+		}
+		return nil
+	}
+}
+
+// waitsUntil tells whether the update waits until the option
+func (e *ECSServiceUpdate) waitsUntil(option string) bool {
+	if e.WaitUntil == nil {
+		return option == WaitUntilPrimaryRolled
+	}
+	names, _ := parseWaitUntil(*e.WaitUntil)
+	for _, name := range names {
+		if name == option {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ECSServiceUpdate) validator() (ValidateDeploymentFunc, error) {
+	validators, err := e.waitUntilValidators()
+	if err != nil {
+		return nil, err
+	}
+	return chain(append(validators, e.Validators...)), nil
+}
+
+// rollbackValidator returns a new validator of the rollbacks of the update, the WaitUntil ones only, the Validators
+// such as the smoke tests are meant for the new deployment
+func (e *ECSServiceUpdate) rollbackValidator() (ValidateDeploymentFunc, error) {
+	validators, err := e.waitUntilValidators()
+	if err != nil {
+		return nil, err
+	}
+	return chain(validators), nil
+}
+
+func (e *ECSServiceUpdate) waitUntilValidators() ([]ValidateDeploymentFunc, error) {
+	names := []string{WaitUntilPrimaryRolled}
+	if e.WaitUntil != nil {
+		var err error
+		names, err = parseWaitUntil(*e.WaitUntil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var validators []ValidateDeploymentFunc
+	for _, name := range names {
+		validators = append(validators, waitUntilValidators[name](e))
+	}
+	return validators, nil
+}
+
+func chain(validators []ValidateDeploymentFunc) ValidateDeploymentFunc {
+	if len(validators) == 1 {
+		return validators[0]
+	}
+	return ChainValidators(validators...)
+}
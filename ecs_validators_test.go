@@ -0,0 +1,107 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"testing"
+)
+
+var errNotReady = errors.New("not ready")
+
+// countingValidator fails with errNotReady the first failures calls
+func countingValidator(calls *int, failures int) ValidateDeploymentFunc {
+	return func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, ecsService ecs.Service, bo backoff.BackOff) error {
+		*calls++
+		if *calls <= failures {
+			return errNotReady
+		}
+		return nil
+	}
+}
+
+func TestChainValidators(t *testing.T) {
+	var first, second int
+	validate := ChainValidators(countingValidator(&first, 0), countingValidator(&second, 2))
+	svc := ecs.Service{Deployments: []*ecs.Deployment{{Id: aws.String("ecs-svc/1"), Status: aws.String("PRIMARY")}}}
+	for i, want := range []error{errNotReady, errNotReady, nil, nil} {
+		if err := validate(context.Background(), nil, nil, svc, nil); err != want {
+			t.Fatalf("call %d: expected %v, got %v", i, want, err)
+		}
+	}
+	if first != 1 || second != 3 {
+		t.Errorf("passed validators must not run again for the same deployment, got %d and %d calls", first, second)
+	}
+	rollback := ecs.Service{Deployments: []*ecs.Deployment{{Id: aws.String("ecs-svc/2"), Status: aws.String("PRIMARY")}}}
+	if err := validate(context.Background(), nil, nil, rollback, nil); err != nil {
+		t.Fatal(err)
+	}
+	if first != 2 || second != 4 {
+		t.Errorf("every validator must run for another deployment, got %d and %d calls", first, second)
+	}
+}
+
+func TestApplyValidators(t *testing.T) {
+	var registered, custom int
+	RegisterWaitUntil("test-registered", func(e *ECSServiceUpdate) ValidateDeploymentFunc {
+		return countingValidator(&registered, 1)
+	})
+	defer func() {
+		delete(waitUntilValidators, "test-registered")
+		WaitUntilOptionList = WaitUntilOptionList[:len(WaitUntilOptionList)-1]
+	}()
+	api := newMockDeployEcsClient()
+	esu := ECSServiceUpdate{
+		EcsApi:     api,
+		Cluster:    "my-cluster",
+		Service:    "my-service",
+		Image:      map[string]string{"my-container": "myrepo/myimg:newtag"},
+		BackOff:    backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 5),
+		WaitUntil:  aws.String("primary-rolled, test-registered"),
+		Validators: []ValidateDeploymentFunc{countingValidator(&custom, 1)},
+	}
+	if err := esu.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if registered != 2 || custom != 2 {
+		t.Errorf("expected every validator to be retried until it passed, got %d and %d calls", registered, custom)
+	}
+	if len(api.updateInputs) != 1 {
+		t.Errorf("expected 1 update, got %d", len(api.updateInputs))
+	}
+
+	esu.WaitUntil = aws.String("primary-rolled,forever")
+	if err := esu.Apply(); !errors.Is(err, ErrInvalidWaitUntil) {
+		t.Errorf("expected %v, got %v", ErrInvalidWaitUntil, err)
+	}
+}
+
+func TestApplyRollbackValidators(t *testing.T) {
+	calls := 0
+	api := newMockDeployEcsClient()
+	esu := ECSServiceUpdate{
+		EcsApi:  api,
+		Cluster: "my-cluster",
+		Service: "my-service",
+		Image:   map[string]string{"my-container": "myrepo/myimg:newtag"},
+		BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 5),
+		Validators: []ValidateDeploymentFunc{func(context.Context, ecsiface.ECSAPI, elbv2iface.ELBV2API, ecs.Service, backoff.BackOff) error {
+			calls++
+			return backoff.Permanent(errors.New("never valid"))
+		}},
+	}
+	// the Validators validate the new deployment only, the rollback doesn't have to pass them
+	if err := esu.Apply(); !errors.Is(err, ErrSuccessfulRollback) {
+		t.Fatalf("expected %v, got %v", ErrSuccessfulRollback, err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the validator to run once, got %d calls", calls)
+	}
+	if *api.service.TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" {
+		t.Errorf("expected the service rolled back, got %s", *api.service.TaskDefinition)
+	}
+}
@@ -0,0 +1,234 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidDeploymentPlan the waves or their dependencies are not valid
+	ErrInvalidDeploymentPlan = errors.New("invalid deployment plan")
+)
+
+// DeploymentPlan deploys waves of services in order, a wave starts once every service of the previous wave is
+// validated. If a wave fails its updated services are rolled back, then the completed waves in reverse order
+type DeploymentPlan struct {
+	Waves         []Wave         // Waves in deployment order
+	MaxParallel   int            // Services of a wave deployed at the same time when Wave.MaxParallel is 0, if 0 without limit
+	PreDeployTask *PreDeployTask // If non nil, run once with the new task definition of the first service of the first wave before any service is updated, the services are only updated if it succeeds
+}
+
+// Wave group of services deployed together, each one once the services it comes after are validated
+type Wave struct {
+	Name        string        // Used in the log and the results
+	Services    []WaveService // Services of the wave, they may belong to different clusters or regions
+	MaxParallel int           // Services deployed at the same time, if 0 DeploymentPlan.MaxParallel is used
+}
+
+// WaveService update of a service of a wave
+type WaveService struct {
+	Name   string           // Unique in the plan, referenced by After, if empty Update.Service is used
+	After  []string         // Services of the same wave or of a previous one which must be validated first
+	Update ECSServiceUpdate // Update of the service, with its own BackOff and the ECS and ELBV2 Apis of its region
+}
+
+// WaveResult outcome of the services of a wave
+type WaveResult struct {
+	Wave     string          // Name of the wave
+	Services []ServiceResult // Outcome of every service, in the order of Wave.Services
+}
+
+func (s WaveService) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Update.Service
+}
+
+// dependencies returns the services of every wave each service comes after, services of previous waves are validated
+// before the wave starts so only dependencies within the wave are kept
+func (p *DeploymentPlan) dependencies() ([][][]int, error) {
+	var problems []string
+	waveOf, indexOf := map[string]int{}, map[string]int{}
+	for w, wave := range p.Waves {
+		for i, service := range wave.Services {
+			name := service.name()
+			if _, found := waveOf[name]; found {
+				problems = append(problems, fmt.Sprintf("duplicate service %q", name))
+			}
+			waveOf[name], indexOf[name] = w, i
+		}
+	}
+	waves := make([][][]int, len(p.Waves))
+	for w, wave := range p.Waves {
+		if len(wave.Services) == 0 {
+			problems = append(problems, fmt.Sprintf("wave %q: no services", wave.Name))
+		}
+		waves[w] = make([][]int, len(wave.Services))
+		for i, service := range wave.Services {
+			for _, dependency := range service.After {
+				dependencyWave, found := waveOf[dependency]
+				switch {
+				case !found:
+					problems = append(problems, fmt.Sprintf("%q comes after unknown service %q", service.name(), dependency))
+				case dependencyWave > w:
+					problems = append(problems, fmt.Sprintf("%q comes after %q of a later wave", service.name(), dependency))
+				case dependencyWave == w:
+					waves[w][i] = append(waves[w][i], indexOf[dependency])
+				}
+			}
+		}
+		if cycle := dependencyCycle(wave, waves[w]); cycle != "" {
+			problems = append(problems, fmt.Sprintf("wave %q: dependency cycle %s", wave.Name, cycle))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDeploymentPlan, strings.Join(problems, "; "))
+	}
+	return waves, nil
+}
+
+// dependencyCycle returns the services of a dependency cycle of the wave, empty if there is none
+func dependencyCycle(wave Wave, after [][]int) string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(after))
+	var path []string
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		state[i] = visiting
+		path = append(path, wave.Services[i].name())
+		for _, j := range after[i] {
+			if state[j] == visiting {
+				path = append(path, wave.Services[j].name())
+				return true
+			}
+			if state[j] == unvisited && visit(j) {
+				return true
+			}
+		}
+		state[i] = visited
+		path = path[:len(path)-1]
+		return false
+	}
+	for i := range after {
+		if state[i] == unvisited && visit(i) {
+			return strings.Join(path, " -> ")
+		}
+	}
+	return ""
+}
+
+// Apply the Deployment Plan
+func (p *DeploymentPlan) Apply() ([]WaveResult, error) {
+	return p.ApplyWithContext(context.Background())
+}
+
+// ApplyWithContext applies the Deployment Plan and returns the outcome of every service of every wave. Returns nil if
+// every wave was validated, ErrSuccessfulRollback or ErrFailedRollback if services were rolled back,
+// ErrPostSuccessHookFailed if a post-success hook failed or the error of the deployment if no service was updated. The
+// post-success hooks run once every wave is validated. If the context is cancelled the deployment is rolled back
+func (p *DeploymentPlan) ApplyWithContext(ctx context.Context) ([]WaveResult, error) {
+	if len(p.Waves) == 0 {
+		return nil, ErrNoServices
+	}
+	dependencies, err := p.dependencies()
+	if err != nil {
+		return nil, err
+	}
+	waves := make([][]*serviceDeployment, len(p.Waves))
+	for w := range p.Waves {
+		for i := range p.Waves[w].Services {
+			d, err := newServiceDeployment(&p.Waves[w].Services[i].Update)
+			if err != nil {
+				return nil, fmt.Errorf("wave %q: %w", p.Waves[w].Name, err)
+			}
+			waves[w] = append(waves[w], d)
+		}
+	}
+	if p.PreDeployTask != nil {
+		first := &p.Waves[0].Services[0].Update
+		update, err := first.preDeploy(withEventSink(ctx, first.EventSink), *p.PreDeployTask)
+		if err != nil {
+			for _, deployments := range waves {
+				leftNotUpdated(deployments, err)
+			}
+			return p.results(waves), err
+		}
+		waves[0][0].update = update
+	}
+
+	// the events of the waves go to the EventSink of the first service
+	eventCtx := withEventSink(ctx, p.Waves[0].Services[0].Update.EventSink)
+	var all []*serviceDeployment
+	for w, deployments := range waves {
+		all = append(all, deployments...)
+		emit(eventCtx, WaveStarted{Wave: p.Waves[w].Name})
+		cause := deployServices(ctx, deployments, dependencies[w], p.maxParallel(w))
+		if cause == nil {
+			continue
+		}
+		emit(eventCtx, WaveFailed{Wave: p.Waves[w].Name, Cause: cause})
+		// the waves not reached have nothing to roll back, they only record why
+		rollbackCtx := detachedContext{parent: ctx}
+		for w := len(waves) - 1; w >= 0; w-- {
+			rollBackServices(rollbackCtx, waves[w], dependencies[w], p.maxParallel(w), cause)
+		}
+		return p.results(waves), rollbackResult(all, cause)
+	}
+	for _, d := range all {
+		if hookErr := d.succeed(ctx); hookErr != nil {
+			err = hookErr
+		}
+	}
+	return p.results(waves), err
+}
+
+func (p *DeploymentPlan) maxParallel(w int) int {
+	if p.Waves[w].MaxParallel != 0 {
+		return p.Waves[w].MaxParallel
+	}
+	return p.MaxParallel
+}
+
+func (p *DeploymentPlan) results(waves [][]*serviceDeployment) []WaveResult {
+	results := make([]WaveResult, len(waves))
+	for w, deployments := range waves {
+		results[w].Wave = p.Waves[w].Name
+		for _, d := range deployments {
+			results[w].Services = append(results[w].Services, d.result)
+		}
+	}
+	return results
+}
+
+// Plan the Deployment Plan without registering the task definitions nor updating the services
+func (p *DeploymentPlan) Plan() (string, error) {
+	return p.PlanWithContext(context.Background())
+}
+
+// PlanWithContext plans the Deployment Plan using the provided context, the plans of the services are separated by an
+// empty line
+func (p *DeploymentPlan) PlanWithContext(ctx context.Context) (string, error) {
+	if _, err := p.dependencies(); err != nil {
+		return "", err
+	}
+	var plans []string
+	for _, wave := range p.Waves {
+		var updates []ECSServiceUpdate
+		for _, service := range wave.Services {
+			updates = append(updates, service.Update)
+		}
+		plan, err := planServices(ctx, updates)
+		if err != nil {
+			return "", fmt.Errorf("wave %q: %w", wave.Name, err)
+		}
+		plans = append(plans, fmt.Sprintf("wave: %s\n%s", wave.Name, plan))
+	}
+	return strings.Join(plans, "\n"), nil
+}
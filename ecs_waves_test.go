@@ -0,0 +1,172 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeploymentPlanDependencies(t *testing.T) {
+	service := func(name string, after ...string) WaveService {
+		return WaveService{Update: ECSServiceUpdate{Service: name}, After: after}
+	}
+	tests := []struct {
+		name    string
+		waves   []Wave
+		want    [][][]int
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			waves: []Wave{{Services: []WaveService{service("api"), service("worker", "api")}}, {Services: []WaveService{service("gateway", "api", "worker")}}},
+			want:  [][][]int{{nil, {0}}, {nil}},
+		},
+		{name: "unknown", waves: []Wave{{Services: []WaveService{service("worker", "api")}}}, wantErr: `"worker" comes after unknown service "api"`},
+		{name: "later wave", waves: []Wave{{Services: []WaveService{service("api", "worker")}}, {Services: []WaveService{service("worker")}}}, wantErr: `"api" comes after "worker" of a later wave`},
+		{name: "duplicate", waves: []Wave{{Services: []WaveService{service("api")}}, {Services: []WaveService{service("api")}}}, wantErr: `duplicate service "api"`},
+		{name: "cycle", waves: []Wave{{Name: "backend", Services: []WaveService{service("api", "worker"), service("worker", "api")}}}, wantErr: `wave "backend": dependency cycle api -> worker -> api`},
+		{name: "empty wave", waves: []Wave{{Name: "backend"}}, wantErr: `wave "backend": no services`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := DeploymentPlan{Waves: tt.waves}
+			got, err := p.dependencies()
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidDeploymentPlan) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected %v containing %q, got %v", ErrInvalidDeploymentPlan, tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dependencies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentPlanApply(t *testing.T) {
+	failGateway := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		if *svc.ServiceName == "gateway" && strings.HasSuffix(*svc.TaskDefinition, "my-family:2") {
+			return backoff.Permanent(errNotReady)
+		}
+		return nil
+	}
+	pass := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+		return nil
+	}
+	tests := []struct {
+		name         string
+		validate     ValidateDeploymentFunc
+		wantErr      error
+		wantOutcome  string
+		wantUpdates  []string
+		wantHookRuns int
+	}{
+		{
+			name:         "succeeded",
+			validate:     pass,
+			wantOutcome:  OutcomeSuccess,
+			wantUpdates:  []string{"api my-family:2", "worker my-family:2", "gateway my-family:2"},
+			wantHookRuns: 3,
+		},
+		{
+			name:        "later wave failed",
+			validate:    failGateway,
+			wantErr:     ErrSuccessfulRollback,
+			wantOutcome: OutcomeSuccessfulRollback,
+			wantUpdates: []string{"api my-family:2", "worker my-family:2", "gateway my-family:2", "gateway my-family:1", "worker my-family:1", "api my-family:1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var updates []string
+			hook := &recordingHook{}
+			waveService := func(name string, after ...string) WaveService {
+				api := newMockDeployEcsClient()
+				api.service.ServiceName = aws.String(name)
+				api.afterUpdate = func(svc *ecs.Service) {
+					mu.Lock()
+					defer mu.Unlock()
+					updates = append(updates, name+" "+strings.TrimPrefix(*svc.TaskDefinition, "arn:aws:ecs:us-west-2:123456789012:task-definition/"))
+				}
+				return WaveService{After: after, Update: ECSServiceUpdate{
+					EcsApi:           api,
+					Cluster:          "my-cluster",
+					Service:          name,
+					Image:            map[string]string{"my-container": "myrepo/myimg:newtag"},
+					BackOff:          backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+					Validators:       []ValidateDeploymentFunc{tt.validate},
+					PostSuccessHooks: []Hook{hook},
+				}}
+			}
+			p := DeploymentPlan{MaxParallel: 2, Waves: []Wave{
+				{Name: "backend", Services: []WaveService{waveService("api"), waveService("worker", "api")}},
+				{Name: "edge", Services: []WaveService{waveService("gateway", "worker")}},
+			}}
+			results, err := p.Apply()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(updates, tt.wantUpdates) {
+				t.Errorf("expected updates %v, got %v", tt.wantUpdates, updates)
+			}
+			if len(hook.envs) != tt.wantHookRuns {
+				t.Errorf("expected %d post-success hook runs, got %d", tt.wantHookRuns, len(hook.envs))
+			}
+			for _, wave := range results {
+				for _, result := range wave.Services {
+					if result.Outcome != tt.wantOutcome {
+						t.Errorf("%s/%s: expected %s, got %s: %v", wave.Wave, result.Service, tt.wantOutcome, result.Outcome, result.Err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDeploymentPlanApplyPreDeployTask(t *testing.T) {
+	defer func(interval time.Duration) { oneOffTaskPollInterval = interval }(oneOffTaskPollInterval)
+	oneOffTaskPollInterval = time.Millisecond
+	preDeployApi := &mockPreDeployEcsClient{mockDeployEcsClient: newMockDeployEcsClient(), exitCode: aws.Int64(1)}
+	preDeployApi.service.ServiceName = aws.String("api")
+	apis := []*mockDeployEcsClient{preDeployApi.mockDeployEcsClient, newMockDeployEcsClient(), newMockDeployEcsClient()}
+	waveService := func(i int, name string) WaveService {
+		apis[i].service.ServiceName = aws.String(name)
+		var api ecsiface.ECSAPI = apis[i]
+		if i == 0 {
+			api = preDeployApi
+		}
+		return WaveService{Update: ECSServiceUpdate{EcsApi: api, Cluster: "my-cluster", Service: name, Image: map[string]string{"my-container": "myrepo/myimg:newtag"}, BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)}}
+	}
+	p := DeploymentPlan{PreDeployTask: &PreDeployTask{Container: "my-container"}, Waves: []Wave{
+		{Name: "backend", Services: []WaveService{waveService(0, "api"), waveService(1, "worker")}},
+		{Name: "edge", Services: []WaveService{waveService(2, "gateway")}},
+	}}
+	results, err := p.Apply()
+	if !errors.Is(err, ErrPreDeployTaskFailed) {
+		t.Fatalf("expected %v, got %v", ErrPreDeployTaskFailed, err)
+	}
+	// the services of the wave start at the same time, the pre-deploy task runs before any of them
+	var i int
+	for _, wave := range results {
+		for _, result := range wave.Services {
+			if result.Outcome != OutcomeNotUpdated || !errors.Is(result.Err, ErrPreDeployTaskFailed) || len(apis[i].updateInputs) != 0 {
+				t.Errorf("%s/%s: expected %s, got %s after %d updates: %v", wave.Wave, result.Service, OutcomeNotUpdated, result.Outcome, len(apis[i].updateInputs), result.Err)
+			}
+			i++
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package awsecs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event a progress event of an ECS service update or a LaunchConfig enforcement, String returns its log line
+type Event interface {
+	String() string
+}
+
+// EventSink receives the progress events, Emit may be called from several goroutines at once and must not block
+type EventSink interface {
+	Emit(Event)
+}
+
+// LogEventSink the default EventSink, logs the events the way the updates and enforcements always logged their
+// progress. TaskDefinitionRegistered, ServiceUpdated, RollbackSucceeded, RollbackFailed, InstanceDrained events and
+// ValidationAttempt events which passed or repeat the previous error are not logged
+type LogEventSink struct{}
+
+// Emit logs the event
+func (LogEventSink) Emit(event Event) {
+	switch event := event.(type) {
+	case TaskDefinitionRegistered, ServiceUpdated, RollbackSucceeded, RollbackFailed, InstanceDrained:
+	case ValidationAttempt:
+		if event.Err != nil && !event.Repeated {
+			log.Print(event)
+		}
+	case InstanceActionRequired:
+		log.Print(event)
+		if event.Err != nil {
+			log.Printf("{%s %s} %v", event.InstanceId, event.ContainerInstanceId, event.Err)
+		}
+	default:
+		log.Print(event)
+	}
+}
+
+// JSONEventSink writes every event as a line of JSON to Writer, with the type and time of the event, its log line as
+// message and its fields, error fields are written as their message
+type JSONEventSink struct {
+	Writer io.Writer // Receives the lines of JSON
+	mu     sync.Mutex
+}
+
+// EventRecord a line of JSON written by JSONEventSink
+type EventRecord struct {
+	Type    string                 `json:"type"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message"`
+	Event   map[string]interface{} `json:"event"`
+}
+
+// Emit writes the event, failures to write are logged
+func (s *JSONEventSink) Emit(event Event) {
+	value := reflect.ValueOf(event)
+	record := EventRecord{Type: value.Type().Name(), Time: time.Now().UTC(), Message: event.String(), Event: map[string]interface{}{}}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i).Interface()
+		if err, ok := field.(error); ok {
+			field = err.Error()
+		}
+		record.Event[value.Type().Field(i).Name] = field
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.NewEncoder(s.Writer).Encode(record); err != nil {
+		log.Printf("on JSON event sink while write event: %v", err)
+	}
+}
+
+type eventSinkKey struct{}
+
+// withEventSink returns a context delivering the events emitted with it to sink, unless sink is nil
+func withEventSink(ctx context.Context, sink EventSink) context.Context {
+	if sink == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, eventSinkKey{}, sink)
+}
+
+// emit delivers the event to the EventSink of the context, or to LogEventSink
+func emit(ctx context.Context, event Event) {
+	sink, ok := ctx.Value(eventSinkKey{}).(EventSink)
+	if !ok {
+		sink = LogEventSink{}
+	}
+	sink.Emit(event)
+}
+
+// TaskDefinitionRegistered the altered copy of a task definition was registered
+type TaskDefinitionRegistered struct {
+	SourceTaskDefinition string // Task definition the copy was altered from
+	TaskDefinition       string // ARN of the registered task definition
+}
+
+func (e TaskDefinitionRegistered) String() string {
+	return fmt.Sprintf("The task definition '%s' was registered from '%s'", e.TaskDefinition, e.SourceTaskDefinition)
+}
+
+// ServiceUpdated the service was updated with a new deployment
+type ServiceUpdated struct {
+	Cluster           string // Cluster of the service
+	Service           string // Name of the service
+	TaskDefinition    string // Task definition of the new deployment
+	DeploymentId      string // ID of the PRIMARY deployment, or of the CodeDeploy deployment
+	DesiredCount      int64  // Desired count of the new deployment
+	OldTaskDefinition string // Task definition of the service before the update
+	OldDesiredCount   int64  // Desired count of the service before the update
+}
+
+func (e ServiceUpdated) String() string {
+	return fmt.Sprintf("The service '%s' deploys '%s' with the deployment '%s'", e.Service, e.TaskDefinition, e.DeploymentId)
+}
+
+// ValidationAttempt an attempt to validate the deployment of a service, or of its rollback
+type ValidationAttempt struct {
+	Service      string // Name of the service
+	DeploymentId string // ID of the validated deployment
+	Attempt      int    // Attempts of the validation so far, starting at 1
+	Err          error  // Nil once the deployment passed the validation
+	Repeated     bool   // The attempt failed with the error of the previous attempt
+}
+
+func (e ValidationAttempt) String() string {
+	if e.Err == nil {
+		return fmt.Sprintf("The deployment '%s' of '%s' passed the validation", e.DeploymentId, e.Service)
+	}
+	return e.Err.Error()
+}
+
+// validationAttempt returns the event of an attempt to validate the PRIMARY deployment of svc, prevErr is the error of
+// the previous failed attempt
+func validationAttempt(svc ecs.Service, attempt int, err, prevErr error) ValidationAttempt {
+	event := ValidationAttempt{Service: aws.StringValue(svc.ServiceName), Attempt: attempt, Err: err, Repeated: err != nil && err == prevErr}
+	if deployment := primaryDeployment(svc); deployment != nil {
+		event.DeploymentId = aws.StringValue(deployment.Id)
+	}
+	return event
+}
+
+// SmokeTestPassed the smoke test probe of the deployment got the expected response
+type SmokeTestPassed struct {
+	Service      string // Name of the service
+	DeploymentId string // ID of the validated deployment
+	URL          string // URL probed
+}
+
+func (e SmokeTestPassed) String() string {
+	return fmt.Sprintf("The smoke test GET %s passed", e.URL)
+}
+
+// TargetStateChanged a target which was registered before the deployment transitioned to another state
+type TargetStateChanged struct {
+	TargetGroupArn string // Target group of the target
+	TargetId       string // Empty if no target registered before the deployment is left
+	State          string // State the target transitioned to
+}
+
+func (e TargetStateChanged) String() string {
+	if e.TargetId == "" {
+		return fmt.Sprintf("Either there are no initial targets of '%s' or all targets are new or the service desired count was set to 0", e.TargetGroupArn)
+	}
+	return fmt.Sprintf("The target '%s' of '%s' transitioned to %s state", e.TargetId, e.TargetGroupArn, e.State)
+}
+
+// TargetStates the states of the targets of a target group, keyed by target ID, while waiting until the service
+// started draining
+type TargetStates struct {
+	TargetGroupArn string            // Target group of the targets
+	States         map[string]string // States keyed by target ID
+	Initial        bool              // The states before the deployment
+}
+
+func (e TargetStates) String() string {
+	if e.Initial {
+		return fmt.Sprintf("Initial target states of '%s': '%s'", e.TargetGroupArn, mapStringStringAsJson(e.States))
+	}
+	return fmt.Sprintf("Waiting for targets of '%s' transitioning to draining state: '%s'", e.TargetGroupArn, mapStringStringAsJson(e.States))
+}
+
+// DeploymentTargetStates the states of the targets of the tasks of a deployment in a target group, keyed by target,
+// while waiting until the targets are healthy
+type DeploymentTargetStates struct {
+	TargetGroupArn string            // Target group of the targets
+	DeploymentId   string            // Deployment of the tasks
+	States         map[string]string // States keyed by target, "unregistered" if the target is not registered yet
+}
+
+func (e DeploymentTargetStates) String() string {
+	var states []string
+	for target, state := range e.States {
+		states = append(states, fmt.Sprintf("%s %s", target, state))
+	}
+	sort.Strings(states)
+	return fmt.Sprintf("Deployment target states of '%s': '%s'", e.TargetGroupArn, strings.Join(states, ", "))
+}
+
+// RollbackStarted the deployment of the service failed and the service is rolled back
+type RollbackStarted struct {
+	Service string // Name of the service
+	Cause   error  // Failure of the deployment
+	Awaited bool   // ECS or CodeDeploy rolls the service back, the rollback is awaited
+}
+
+func (e RollbackStarted) String() string {
+	if e.Awaited {
+		return fmt.Sprintf("wait for rollback %v", e.Cause)
+	}
+	return fmt.Sprintf("attempt rollback %v", e.Cause)
+}
+
+// RollbackSucceeded the service was rolled back and the rollback passed the validation
+type RollbackSucceeded struct {
+	Service string // Name of the service
+}
+
+func (e RollbackSucceeded) String() string {
+	return fmt.Sprintf("The rollback of '%s' succeeded", e.Service)
+}
+
+// RollbackFailed the service could not be rolled back or the rollback failed the validation
+type RollbackFailed struct {
+	Service string // Name of the service
+}
+
+func (e RollbackFailed) String() string {
+	return fmt.Sprintf("The rollback of '%s' failed", e.Service)
+}
+
+// PostRollbackHooksFailed a post-rollback hook of the service failed, the outcome of the rollback is kept
+type PostRollbackHooksFailed struct {
+	Service string // Name of the service
+	Outcome string // Outcome of the rollback the hooks ran for
+	Err     error  // Failure of the hook
+}
+
+func (e PostRollbackHooksFailed) String() string {
+	return fmt.Sprintf("on post-rollback hooks of '%s': %v", e.Service, e.Err)
+}
+
+// HooksSucceeded every hook of the outcome of the service succeeded
+type HooksSucceeded struct {
+	Service string // Name of the service
+	Outcome string // Outcome the hooks ran for
+}
+
+func (e HooksSucceeded) String() string {
+	return fmt.Sprintf("The %s hooks succeeded", e.Outcome)
+}
+
+// OneOffTaskStarted a pre-deploy task or a hook task was started, it is awaited until it stops
+type OneOffTaskStarted struct {
+	Service string // Name of the service the task belongs to
+	Task    string // Kind of the task, pre-deploy or hook
+	TaskArn string // ARN of the task
+}
+
+func (e OneOffTaskStarted) String() string {
+	return fmt.Sprintf("Waiting for the %s task '%s' to stop", e.Task, e.TaskArn)
+}
+
+// OneOffTaskSucceeded a pre-deploy task or a hook task stopped and its containers exited successfully
+type OneOffTaskSucceeded struct {
+	Service string // Name of the service the task belongs to
+	Task    string // Kind of the task, pre-deploy or hook
+	TaskArn string // ARN of the task
+}
+
+func (e OneOffTaskSucceeded) String() string {
+	return fmt.Sprintf("The %s task '%s' succeeded", e.Task, e.TaskArn)
+}
+
+// OneOffTaskStopFailed a pre-deploy task or a hook task which was cancelled or timed out could not be stopped
+type OneOffTaskStopFailed struct {
+	Service string // Name of the service the task belongs to
+	Task    string // Kind of the task, pre-deploy or hook
+	TaskArn string // ARN of the task
+	Err     error  // Failure of the stop
+}
+
+func (e OneOffTaskStopFailed) String() string {
+	return fmt.Sprintf("on stop one-off task %s: %v", e.TaskArn, e.Err)
+}
+
+// CodeDeployDeploymentCreated the CodeDeploy deployment of the service was created
+type CodeDeployDeploymentCreated struct {
+	Service        string // Name of the service
+	DeploymentId   string // ID of the CodeDeploy deployment
+	TaskDefinition string // Task definition deployed
+}
+
+func (e CodeDeployDeploymentCreated) String() string {
+	return fmt.Sprintf("The CodeDeploy deployment '%s' deploys '%s'", e.DeploymentId, e.TaskDefinition)
+}
+
+// HealthCheckMissing no essential container of the task definition of the deployment declares a health check, only
+// the running tasks are validated
+type HealthCheckMissing struct {
+	Service        string // Name of the service
+	DeploymentId   string // ID of the validated deployment
+	TaskDefinition string // Task definition of the deployment
+}
+
+func (e HealthCheckMissing) String() string {
+	return fmt.Sprintf("No essential container of '%s' declares a health check", e.TaskDefinition)
+}
+
+// CanaryStarted the canary service of the service runs tasks of the new task definition, it is baked next
+type CanaryStarted struct {
+	Service        string // Name of the service
+	Canary         string // Name of the canary service
+	TaskDefinition string // Task definition of the canary tasks
+	Count          int64  // Desired count of the canary service
+}
+
+func (e CanaryStarted) String() string {
+	return fmt.Sprintf("The canary '%s' runs %d tasks of '%s'", e.Canary, e.Count, e.TaskDefinition)
+}
+
+// CanaryScaledDown the desired count of the canary service was set to zero
+type CanaryScaledDown struct {
+	Service string // Name of the service
+	Canary  string // Name of the canary service
+}
+
+func (e CanaryScaledDown) String() string {
+	return fmt.Sprintf("The canary '%s' was scaled down", e.Canary)
+}
+
+// CanaryScaleDownFailed the canary service could not be scaled down, it keeps running its tasks
+type CanaryScaleDownFailed struct {
+	Service string // Name of the service
+	Canary  string // Name of the canary service
+	Err     error  // Failure of the scale down
+}
+
+func (e CanaryScaleDownFailed) String() string {
+	return e.Err.Error()
+}
+
+// ServiceDeploymentFailed the deployment of a service of several failed, the deployments in progress are stopped and
+// the updated services rolled back
+type ServiceDeploymentFailed struct {
+	Service string // Name of the service
+	Err     error  // Failure of the deployment
+}
+
+func (e ServiceDeploymentFailed) String() string {
+	return fmt.Sprintf("The deployment of '%s' failed: %v", e.Service, e.Err)
+}
+
+// ServiceRolledBack the rollback of a service of several completed
+type ServiceRolledBack struct {
+	Service string // Name of the service
+	Outcome string // Outcome of the rollback
+	Err     error  // ErrSuccessfulRollback or ErrFailedRollback with the cause
+}
+
+func (e ServiceRolledBack) String() string {
+	return fmt.Sprintf("The rollback of '%s': %v", e.Service, e.Err)
+}
+
+// WaveStarted the services of the wave are deployed
+type WaveStarted struct {
+	Wave string // Name of the wave
+}
+
+func (e WaveStarted) String() string {
+	return fmt.Sprintf("Deploying wave '%s'", e.Wave)
+}
+
+// WaveFailed a service of the wave failed, the wave and the completed waves are rolled back
+type WaveFailed struct {
+	Wave  string // Name of the wave
+	Cause error  // Failure of the service which stopped the wave
+}
+
+func (e WaveFailed) String() string {
+	return fmt.Sprintf("The wave '%s' failed, rolling back", e.Wave)
+}
+
+// TrafficShiftStarted the idle service is updated while the live service serves the traffic
+type TrafficShiftStarted struct {
+	LiveService string // Name of the service serving the traffic
+	IdleService string // Name of the updated service
+}
+
+func (e TrafficShiftStarted) String() string {
+	return fmt.Sprintf("Updating '%s' while '%s' serves the traffic", e.IdleService, e.LiveService)
+}
+
+// TrafficShifted a step of the traffic goes to the updated service, it is baked next
+type TrafficShifted struct {
+	Service string // Name of the updated service
+	Percent int64  // Weight of the updated service
+}
+
+func (e TrafficShifted) String() string {
+	return fmt.Sprintf("Shifting %d%% of the traffic to '%s'", e.Percent, e.Service)
+}
+
+// TrafficRevertStarted the traffic goes back to the live service before the updated one is rolled back
+type TrafficRevertStarted struct {
+	Service string // Name of the live service
+}
+
+func (e TrafficRevertStarted) String() string {
+	return fmt.Sprintf("Reverting the traffic to '%s'", e.Service)
+}
+
+// TrafficRevertFailed the weights of the listener rules could not be reverted
+type TrafficRevertFailed struct {
+	Service string // Name of the live service
+	Err     error  // Failure of the revert
+}
+
+func (e TrafficRevertFailed) String() string {
+	return e.Err.Error()
+}
+
+// InstanceDetached an activity of the detachment of an instance from its ASG
+type InstanceDetached struct {
+	InstanceId          string // EC2 instance ID
+	ContainerInstanceId string // ECS container instance ID
+	Activity            string // Description of the ASG activity
+}
+
+func (e InstanceDetached) String() string {
+	return fmt.Sprintf("{%s %s} %s", e.InstanceId, e.ContainerInstanceId, e.Activity)
+}
+
+// InstanceDraining the container instance is not drained yet
+type InstanceDraining struct {
+	InstanceId          string // EC2 instance ID
+	ContainerInstanceId string // ECS container instance ID
+	Err                 error  // Why the container instance is not drained
+}
+
+func (e InstanceDraining) String() string {
+	return fmt.Sprintf("{%s %s} %v", e.InstanceId, e.ContainerInstanceId, e.Err)
+}
+
+// InstanceDrained the container instance drained its tasks, the instance is terminated next
+type InstanceDrained struct {
+	InstanceId          string // EC2 instance ID
+	ContainerInstanceId string // ECS container instance ID
+}
+
+func (e InstanceDrained) String() string {
+	return fmt.Sprintf("{%s %s} drained", e.InstanceId, e.ContainerInstanceId)
+}
+
+// InstanceActionRequired the instance was left detached or draining, it requires a manual action
+type InstanceActionRequired struct {
+	InstanceId          string // EC2 instance ID
+	ContainerInstanceId string // ECS container instance ID
+	Action              string // What failed
+	Err                 error  // Nil if the failure is the returned error
+}
+
+func (e InstanceActionRequired) String() string {
+	return fmt.Sprintf("[ACTIONABLE ACTION REQUIRED] %s", e.Action)
+}
@@ -0,0 +1,170 @@
+package awsecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cenkalti/backoff"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type recordingEventSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *recordingEventSink) Emit(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *recordingEventSink) types() []string {
+	var types []string
+	for _, event := range s.events {
+		types = append(types, fmt.Sprintf("%T", event))
+	}
+	return types
+}
+
+func TestECSServiceUpdateEvents(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int // Failed validations of the new deployment before it passes, if negative it never passes
+		lostRollbacks int // Rollback updates whose response is lost
+		wantErr       error
+		wantTypes     []string
+	}{
+		{
+			name:      "validated",
+			failures:  2,
+			wantTypes: []string{"awsecs.TaskDefinitionRegistered", "awsecs.ServiceUpdated", "awsecs.ValidationAttempt", "awsecs.ValidationAttempt", "awsecs.ValidationAttempt"},
+		},
+		{
+			name:      "rolled back",
+			failures:  -1,
+			wantErr:   ErrSuccessfulRollback,
+			wantTypes: []string{"awsecs.TaskDefinitionRegistered", "awsecs.ServiceUpdated", "awsecs.ValidationAttempt", "awsecs.RollbackStarted", "awsecs.ValidationAttempt", "awsecs.RollbackSucceeded"},
+		},
+		{
+			name:          "rollback retried",
+			failures:      -1,
+			lostRollbacks: 1,
+			wantErr:       ErrSuccessfulRollback,
+			wantTypes:     []string{"awsecs.TaskDefinitionRegistered", "awsecs.ServiceUpdated", "awsecs.ValidationAttempt", "awsecs.RollbackStarted", "awsecs.ValidationAttempt", "awsecs.RollbackSucceeded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newMockDeployEcsClient()
+			validations := 0
+			validate := func(ctx context.Context, ecsapi ecsiface.ECSAPI, elbv2api elbv2iface.ELBV2API, svc ecs.Service, bo backoff.BackOff) error {
+				if *svc.TaskDefinition == "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1" {
+					return nil
+				}
+				if tt.failures < 0 {
+					api.lostUpdates = tt.lostRollbacks
+					return backoff.Permanent(errNotReady)
+				}
+				validations++
+				if validations <= tt.failures {
+					return errNotReady
+				}
+				return nil
+			}
+			sink := &recordingEventSink{}
+			esu := ECSServiceUpdate{
+				EcsApi:               api,
+				Cluster:              "my-cluster",
+				Service:              "my-service",
+				Image:                map[string]string{"my-container": "myrepo/myimg:newtag"},
+				BackOff:              backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3),
+				FailedTasksThreshold: -1,
+				Validators:           []ValidateDeploymentFunc{validate},
+				EventSink:            sink,
+			}
+			if err := esu.Apply(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(sink.types(), tt.wantTypes) {
+				t.Fatalf("expected events %v, got %v", tt.wantTypes, sink.types())
+			}
+			updated := sink.events[1].(ServiceUpdated)
+			if updated.Service != "my-service" || updated.DeploymentId != "ecs-svc/1" || updated.TaskDefinition != "arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:2" {
+				t.Errorf("unexpected %#v", updated)
+			}
+			if want := 1 + tt.lostRollbacks; tt.wantErr != nil && len(api.updateInputs) != 1+want {
+				t.Errorf("expected %d rollback updates, got %d", want, len(api.updateInputs)-1)
+			}
+			if attempt := sink.events[2].(ValidationAttempt); attempt.Attempt != 1 || attempt.DeploymentId != "ecs-svc/1" || !errors.Is(attempt.Err, errNotReady) {
+				t.Errorf("unexpected %#v", attempt)
+			}
+		})
+	}
+}
+
+func TestLogEventSink(t *testing.T) {
+	defer func(flags int, writer io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(writer)
+	}(log.Flags(), log.Writer())
+	var buf bytes.Buffer
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+
+	for _, event := range []Event{
+		ServiceUpdated{Service: "my-service"},
+		ValidationAttempt{Err: errNotReady},
+		ValidationAttempt{Err: errNotReady, Repeated: true},
+		ValidationAttempt{},
+		RollbackStarted{Cause: errNotReady},
+		TargetStateChanged{TargetGroupArn: "tg", TargetId: "10.0.0.1", State: "draining"},
+		DeploymentTargetStates{TargetGroupArn: "tg", States: map[string]string{"10.0.0.2:80": "initial", "10.0.0.1:80": "healthy"}},
+		InstanceActionRequired{InstanceId: "i-1", ContainerInstanceId: "ci-1", Action: "instance re-attachment failed!", Err: errNotReady},
+		CanaryStarted{Service: "my-service", Canary: "my-service-canary", TaskDefinition: "my-family:2", Count: 2},
+		TrafficShifted{Service: "my-service-green", Percent: 10},
+		PostRollbackHooksFailed{Service: "my-service", Outcome: OutcomeSuccessfulRollback, Err: errNotReady},
+	} {
+		LogEventSink{}.Emit(event)
+	}
+	want := fmt.Sprintf("%v\nattempt rollback %v\nThe target '10.0.0.1' of 'tg' transitioned to draining state\n", errNotReady, errNotReady) +
+		"Deployment target states of 'tg': '10.0.0.1:80 healthy, 10.0.0.2:80 initial'\n" +
+		fmt.Sprintf("[ACTIONABLE ACTION REQUIRED] instance re-attachment failed!\n{i-1 ci-1} %v\n", errNotReady) +
+		"The canary 'my-service-canary' runs 2 tasks of 'my-family:2'\nShifting 10% of the traffic to 'my-service-green'\n" +
+		fmt.Sprintf("on post-rollback hooks of 'my-service': %v\n", errNotReady)
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestJSONEventSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &JSONEventSink{Writer: &buf}
+	sink.Emit(ValidationAttempt{Service: "my-service", DeploymentId: "ecs-svc/1", Attempt: 2, Err: errNotReady})
+	sink.Emit(ValidationAttempt{Service: "my-service", DeploymentId: "ecs-svc/1", Attempt: 3})
+	decoder := json.NewDecoder(&buf)
+	for _, want := range []map[string]interface{}{
+		{"Service": "my-service", "DeploymentId": "ecs-svc/1", "Attempt": float64(2), "Err": errNotReady.Error(), "Repeated": false},
+		{"Service": "my-service", "DeploymentId": "ecs-svc/1", "Attempt": float64(3), "Err": nil, "Repeated": false},
+	} {
+		var record EventRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Type != "ValidationAttempt" || record.Time.IsZero() || record.Message == "" {
+			t.Errorf("unexpected record %v", record)
+		}
+		if !reflect.DeepEqual(record.Event, want) {
+			t.Errorf("expected %v, got %v", want, record.Event)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package awsecs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"net/http"
+)
+
+// Exit codes of update-aws-ecs-service and enforce-aws-ecs-asg-launchconfig, the values are stable
+const (
+	ExitCodeSuccess           = 0  // The update or enforcement succeeded
+	ExitCodeError             = 1  // Any other error
+	ExitCodeInvalidInput      = 2  // Invalid flags, files or values, nothing was changed
+	ExitCodeNotFound          = 3  // The service, container, ASG, container instance or target group doesn't exist
+	ExitCodeAborted           = 4  // The pre-deploy task or the canary failed, the service was not updated
+	ExitCodeRolledBack        = 5  // The deployment failed and was rolled back successfully
+	ExitCodeRollbackFailed    = 6  // The deployment failed and so did the rollback, the service requires attention
+	ExitCodePostSuccessFailed = 7  // The deployment succeeded but a post-success hook failed
+	ExitCodeAWSAuth           = 8  // AWS rejected the credentials or denied the access
+	ExitCodeAWSThrottled      = 9  // AWS throttled the requests beyond the retries
+	ExitCodeInterrupted       = 10 // The update was cancelled before the service was updated
+)
+
+// authErrorCodes AWS error codes of missing, invalid or expired credentials and denied access
+var authErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"AuthFailure":                 true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidClientTokenId":        true,
+	"InvalidSignatureException":   true,
+	"NoCredentialProviders":       true,
+	"SignatureDoesNotMatch":       true,
+	"UnauthorizedOperation":       true,
+	"UnrecognizedClientException": true,
+}
+
+var (
+	invalidInputErrors = []error{ErrInvalidWaitUntil, ErrInvalidDeploymentPlan, ErrInvalidTrafficShiftSteps, ErrNoServices, ErrCodeDeployRequired, ErrInvalidMetricsSink}
+	notFoundErrors     = []error{ErrServiceNotFound, ErrContainerNotFound, ErrASGNotFound, ErrContainerInstanceNotFound, ErrTargetGroupsNotForwarded, ErrImageDigestNotFound}
+	abortedErrors      = []error{ErrPreDeployTaskFailed, ErrPreDeployTaskTimeout, ErrCanaryFailed}
+)
+
+// ExitCode returns the exit code of the tools for err, the error returned by an update or an enforcement
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitCodeSuccess
+	case errors.Is(err, ErrFailedRollback):
+		return ExitCodeRollbackFailed
+	case errors.Is(err, ErrSuccessfulRollback):
+		return ExitCodeRolledBack
+	case errors.Is(err, ErrPostSuccessHookFailed):
+		return ExitCodePostSuccessFailed
+	case isAWSAuthError(err):
+		return ExitCodeAWSAuth
+	case isAWSThrottleError(err):
+		return ExitCodeAWSThrottled
+	case isAny(err, invalidInputErrors):
+		return ExitCodeInvalidInput
+	case isAny(err, notFoundErrors):
+		return ExitCodeNotFound
+	case isAny(err, abortedErrors):
+		return ExitCodeAborted
+	case errors.Is(err, context.Canceled):
+		return ExitCodeInterrupted
+	}
+	return ExitCodeError
+}
+
+func isAny(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAWSAuthError(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && (requestFailure.StatusCode() == http.StatusUnauthorized || requestFailure.StatusCode() == http.StatusForbidden) {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && authErrorCodes[awsErr.Code()]
+}
+
+func isAWSThrottleError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && request.IsErrorThrottle(awsErr)
+}
@@ -0,0 +1,129 @@
+package awsecs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/cenkalti/backoff"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", want: ExitCodeSuccess},
+		{name: "other", err: errors.New("boom"), want: ExitCodeError},
+		{name: "invalid wait until", err: fmt.Errorf("%w: ready", ErrInvalidWaitUntil), want: ExitCodeInvalidInput},
+		{name: "invalid metrics sink", err: fmt.Errorf("%w: \"graphite\"", ErrInvalidMetricsSink), want: ExitCodeInvalidInput},
+		{name: "service not found", err: ErrServiceNotFound, want: ExitCodeNotFound},
+		{name: "container not found", err: fmt.Errorf("%w: my-container", ErrContainerNotFound), want: ExitCodeNotFound},
+		{name: "pre-deploy task failed", err: fmt.Errorf("%w: exit code 1", ErrPreDeployTaskFailed), want: ExitCodeAborted},
+		{name: "successful rollback", err: ErrSuccessfulRollback, want: ExitCodeRolledBack},
+		{name: "failed rollback", err: ErrFailedRollback, want: ExitCodeRollbackFailed},
+		{name: "post-success hook failed", err: fmt.Errorf("%w: exit status 1", ErrPostSuccessHookFailed), want: ExitCodePostSuccessFailed},
+		{name: "expired token", err: fmt.Errorf("on alter service while describe service: %w", awserr.New("ExpiredTokenException", "expired", nil)), want: ExitCodeAWSAuth},
+		{name: "forbidden", err: awserr.NewRequestFailure(awserr.New("Forbidden", "forbidden", nil), http.StatusForbidden, "1"), want: ExitCodeAWSAuth},
+		{name: "throttled", err: fmt.Errorf("on alter service while describe service: %w", awserr.New("ThrottlingException", "rate exceeded", nil)), want: ExitCodeAWSThrottled},
+		{name: "cancelled", err: fmt.Errorf("on alter service while describe service: %w", context.Canceled), want: ExitCodeInterrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeClient answers the requests of c with respond instead of sending them to AWS
+func fakeClient(c *client.Client, respond func(r *request.Request)) {
+	c.Handlers.Send.Clear()
+	c.Handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(&bytes.Buffer{})}
+		respond(r)
+	})
+	c.Handlers.UnmarshalMeta.Clear()
+	c.Handlers.ValidateResponse.Clear()
+	c.Handlers.Unmarshal.Clear()
+	c.Handlers.UnmarshalError.Clear()
+}
+
+func TestExitCodeEnforceLaunchConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		detachErr map[string]error // Map of instance ID and DetachInstances error
+		drainErr  error            // UpdateContainerInstancesState error
+		want      int
+	}{
+		{
+			name:      "throttled",
+			detachErr: map[string]error{"i-1": errors.New("boom"), "i-2": awserr.New("Throttling", "rate exceeded", nil)},
+			want:      ExitCodeAWSThrottled,
+		},
+		{
+			name:     "access denied",
+			drainErr: awserr.New("AccessDeniedException", "denied", nil),
+			want:     ExitCodeAWSAuth,
+		},
+		{
+			name:      "failed detach",
+			detachErr: map[string]error{"i-1": errors.New("boom"), "i-2": errors.New("boom")},
+			want:      ExitCodeError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-west-2"), Credentials: credentials.NewStaticCredentials("id", "secret", ""), MaxRetries: aws.Int(0)}))
+			asapi, ecsapi, ec2api := autoscaling.New(sess), ecs.New(sess), ec2.New(sess)
+			fakeClient(asapi.Client, func(r *request.Request) {
+				switch input := r.Params.(type) {
+				case *autoscaling.DescribeAutoScalingGroupsInput:
+					*r.Data.(*autoscaling.DescribeAutoScalingGroupsOutput) = autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{{
+						LaunchConfigurationName: aws.String("lc-2"),
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("i-1"), LaunchConfigurationName: aws.String("lc-1")},
+							{InstanceId: aws.String("i-2"), LaunchConfigurationName: aws.String("lc-1")},
+							{InstanceId: aws.String("i-3"), LaunchConfigurationName: aws.String("lc-2")},
+						},
+					}}}
+				case *autoscaling.DetachInstancesInput:
+					r.Error = tt.detachErr[*input.InstanceIds[0]]
+				}
+			})
+			fakeClient(ecsapi.Client, func(r *request.Request) {
+				switch r.Params.(type) {
+				case *ecs.ListContainerInstancesInput:
+					r.Data.(*ecs.ListContainerInstancesOutput).ContainerInstanceArns = []*string{aws.String("arn:aws:ecs:us-west-2:123456789012:container-instance/my-cluster/ci-1"), aws.String("arn:aws:ecs:us-west-2:123456789012:container-instance/my-cluster/ci-2")}
+				case *ecs.DescribeContainerInstancesInput:
+					r.Data.(*ecs.DescribeContainerInstancesOutput).ContainerInstances = []*ecs.ContainerInstance{
+						{Ec2InstanceId: aws.String("i-1"), ContainerInstanceArn: aws.String("arn:aws:ecs:us-west-2:123456789012:container-instance/my-cluster/ci-1")},
+						{Ec2InstanceId: aws.String("i-2"), ContainerInstanceArn: aws.String("arn:aws:ecs:us-west-2:123456789012:container-instance/my-cluster/ci-2")},
+					}
+				case *ecs.UpdateContainerInstancesStateInput:
+					r.Error = tt.drainErr
+				}
+			})
+			fakeClient(ec2api.Client, func(r *request.Request) {})
+			elc := EnforceLaunchConfig{ECSAPI: *ecsapi, ASAPI: *asapi, EC2API: *ec2api, ASGName: "my-asg", ECSClusterName: "my-cluster", BackOff: &backoff.ZeroBackOff{}, EventSink: &recordingEventSink{}}
+			err := elc.Apply()
+			if got := ExitCode(err); got != tt.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", err, got, tt.want)
+			}
+		})
+	}
+}
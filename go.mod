@@ -6,6 +6,7 @@ require (
 	github.com/aws/aws-sdk-go v1.44.174
 	github.com/cenkalti/backoff v0.0.0-00010101000000-000000000000
 	github.com/sergi/go-diff v1.1.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 replace github.com/cenkalti/backoff => github.com/cenkalti/backoff/v4 v4.1.0
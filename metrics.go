@@ -0,0 +1,262 @@
+package awsecs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MetricUnitSeconds the unit of durations
+	MetricUnitSeconds = "Seconds"
+	// MetricUnitCount the unit of counts
+	MetricUnitCount = "Count"
+)
+
+const (
+	// MetricsPrometheus prometheus=<path> writes the metrics to a Prometheus textfile collector file
+	MetricsPrometheus = "prometheus"
+	// MetricsStatsD statsd=<host:port> sends the metrics to a StatsD server over UDP
+	MetricsStatsD = "statsd"
+	// MetricsEMF emf or emf=<namespace> writes the metrics in the CloudWatch Embedded Metric Format
+	MetricsEMF = "emf"
+)
+
+var (
+	// ErrInvalidMetricsSink invalid metrics sink
+	ErrInvalidMetricsSink = errors.New("invalid metrics sink")
+)
+
+// Metric a measurement of an ECS service update or a LaunchConfig enforcement
+type Metric struct {
+	Name   string            // The sinks add their prefix or namespace
+	Help   string            // What is measured
+	Unit   string            // MetricUnitSeconds or MetricUnitCount
+	Value  float64           // The value of a single update or enforcement
+	Labels map[string]string // For example the tool, the cluster, the service and the outcome
+}
+
+// MetricsSink writes the metrics of an update or an enforcement
+type MetricsSink interface {
+	WriteMetrics(metrics []Metric) error
+}
+
+// ParseMetricsSink returns the metrics sink of spec, one of prometheus=<path>, statsd=<host:port>, emf or
+// emf=<namespace>. The emf sink writes to w, stderr in the commands so stdout is left to their JSON output
+func ParseMetricsSink(spec string, w io.Writer) (MetricsSink, error) {
+	kind, target := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		kind, target = spec[:i], spec[i+1:]
+	}
+	switch {
+	case kind == MetricsPrometheus && target != "":
+		return &PrometheusTextfileSink{Path: target}, nil
+	case kind == MetricsStatsD && target != "":
+		return &StatsDSink{Addr: target, Prefix: "awsecs."}, nil
+	case kind == MetricsEMF && target != "":
+		return &EMFSink{Writer: w, Namespace: target}, nil
+	case kind == MetricsEMF:
+		return &EMFSink{Writer: w, Namespace: "go-awsecs"}, nil
+	}
+	return nil, fmt.Errorf("%w: %q, valid sinks are: %s=<path>, %s=<host:port>, %s[=<namespace>]", ErrInvalidMetricsSink, spec, MetricsPrometheus, MetricsStatsD, MetricsEMF)
+}
+
+// MetricsCollector an EventSink collecting the metrics of an update or an enforcement from its progress events, the
+// events are passed on to Next
+type MetricsCollector struct {
+	Next               EventSink         // Receives every event, LogEventSink if nil
+	Sink               MetricsSink       // Receives the metrics on Flush
+	Labels             map[string]string // Labels of every metric, empty values are left out
+	started            time.Time
+	mu                 sync.Mutex
+	validationAttempts int
+	rollbacks          int
+	instancesDrained   int
+	drainDuration      time.Duration
+	detached           map[string]time.Time // Map of instance id and detach time
+}
+
+// NewMetricsCollector returns a MetricsCollector measuring the duration from now on
+func NewMetricsCollector(next EventSink, sink MetricsSink, labels map[string]string) *MetricsCollector {
+	return &MetricsCollector{Next: next, Sink: sink, Labels: labels, started: time.Now(), detached: map[string]time.Time{}}
+}
+
+// Emit passes the event on to Next and counts it
+func (c *MetricsCollector) Emit(event Event) {
+	if c.Next != nil {
+		c.Next.Emit(event)
+	} else {
+		LogEventSink{}.Emit(event)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch event := event.(type) {
+	case ValidationAttempt:
+		c.validationAttempts++
+	case RollbackSucceeded, RollbackFailed:
+		c.rollbacks++
+	case InstanceDetached:
+		c.detached[event.InstanceId] = time.Now()
+	case InstanceDrained:
+		c.instancesDrained++
+		if detached, found := c.detached[event.InstanceId]; found {
+			c.drainDuration += time.Since(detached)
+		}
+	}
+}
+
+// Metrics returns the metrics collected so far, outcome is the outcome of the update or enforcement
+func (c *MetricsCollector) Metrics(outcome string) []Metric {
+	labels := map[string]string{"outcome": outcome}
+	for name, value := range c.Labels {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []Metric{
+		{Name: "deployment_duration_seconds", Help: "Duration of the update or enforcement", Unit: MetricUnitSeconds, Value: time.Since(c.started).Seconds(), Labels: labels},
+		{Name: "deployments", Help: "Updates or enforcements, the outcome label tells how they ended", Unit: MetricUnitCount, Value: 1, Labels: labels},
+		{Name: "validation_attempts", Help: "Validation attempts of the deployments and rollbacks", Unit: MetricUnitCount, Value: float64(c.validationAttempts), Labels: labels},
+		{Name: "rollbacks", Help: "Rolled back services", Unit: MetricUnitCount, Value: float64(c.rollbacks), Labels: labels},
+		{Name: "instances_drained", Help: "Drained container instances", Unit: MetricUnitCount, Value: float64(c.instancesDrained), Labels: labels},
+		{Name: "instance_drain_duration_seconds", Help: "Total duration of the drains, from the detach to the drained instance", Unit: MetricUnitSeconds, Value: c.drainDuration.Seconds(), Labels: labels},
+	}
+}
+
+// Flush writes the metrics collected so far to Sink
+func (c *MetricsCollector) Flush(outcome string) error {
+	return c.Sink.WriteMetrics(c.Metrics(outcome))
+}
+
+// PrometheusTextfileSink writes the metrics to a file read by the textfile collector of the Prometheus node exporter,
+// the file is replaced atomically by every update or enforcement
+type PrometheusTextfileSink struct {
+	Path string // The .prom file
+}
+
+// WriteMetrics replaces the file with the metrics, prefixed with awsecs_
+func (s *PrometheusTextfileSink) WriteMetrics(metrics []Metric) error {
+	var b strings.Builder
+	for _, metric := range metrics {
+		name := "awsecs_" + metric.Name
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s{", name, metric.Help, name, name)
+		for i, label := range sortedKeys(metric.Labels) {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", label, prometheusLabelValueReplacer.Replace(metric.Labels[label]))
+		}
+		fmt.Fprintf(&b, "} %s\n", strconv.FormatFloat(metric.Value, 'g', -1, 64))
+	}
+	// the collector must never read a partially written file
+	tmp := s.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("on Prometheus textfile sink: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("on Prometheus textfile sink: %w", err)
+	}
+	return nil
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// StatsDSink sends the metrics to a StatsD server over UDP in a single packet, counts as counters and durations as
+// gauges, the labels as DogStatsD tags
+type StatsDSink struct {
+	Addr   string // The host:port of the server
+	Prefix string // Prefix of the metric names, for example "awsecs."
+}
+
+// WriteMetrics sends the metrics
+func (s *StatsDSink) WriteMetrics(metrics []Metric) error {
+	var lines []string
+	for _, metric := range metrics {
+		metricType := "g"
+		if metric.Unit == MetricUnitCount {
+			metricType = "c"
+		}
+		var tags []string
+		for _, label := range sortedKeys(metric.Labels) {
+			tags = append(tags, label+":"+metric.Labels[label])
+		}
+		line := fmt.Sprintf("%s%s:%s|%s", s.Prefix, metric.Name, strconv.FormatFloat(metric.Value, 'f', -1, 64), metricType)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+	conn, err := net.Dial("udp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("on StatsD sink: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		return fmt.Errorf("on StatsD sink: %w", err)
+	}
+	return nil
+}
+
+// EMFSink writes the metrics as a line of JSON in the CloudWatch Embedded Metric Format, the CloudWatch agent or
+// the CloudWatch Logs of the task extract the metrics. The labels are the dimensions
+type EMFSink struct {
+	Writer    io.Writer // Receives the line of JSON
+	Namespace string    // The CloudWatch namespace
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// WriteMetrics writes the metrics, which must share their labels
+func (s *EMFSink) WriteMetrics(metrics []Metric) error {
+	record := map[string]interface{}{}
+	directive := emfDirective{Namespace: s.Namespace, Dimensions: [][]string{{}}}
+	for _, metric := range metrics {
+		for _, label := range sortedKeys(metric.Labels) {
+			if _, found := record[label]; !found {
+				directive.Dimensions[0] = append(directive.Dimensions[0], label)
+			}
+			record[label] = metric.Labels[label]
+		}
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: metric.Name, Unit: metric.Unit})
+		record[metric.Name] = metric.Value
+	}
+	record["_aws"] = emfMetadata{Timestamp: time.Now().UnixNano() / int64(time.Millisecond), CloudWatchMetrics: []emfDirective{directive}}
+	if err := json.NewEncoder(s.Writer).Encode(record); err != nil {
+		return fmt.Errorf("on EMF sink: %w", err)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,180 @@
+package awsecs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingMetricsSink struct {
+	metrics []Metric
+}
+
+func (s *recordingMetricsSink) WriteMetrics(metrics []Metric) error {
+	s.metrics = metrics
+	return nil
+}
+
+func testMetrics() []Metric {
+	labels := map[string]string{"outcome": "successful-rollback", "service": "my-service"}
+	return []Metric{
+		{Name: "deployment_duration_seconds", Help: "Duration", Unit: MetricUnitSeconds, Value: 1.5, Labels: labels},
+		{Name: "rollbacks", Help: "Rollbacks", Unit: MetricUnitCount, Value: 1, Labels: labels},
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	next := &recordingEventSink{}
+	sink := &recordingMetricsSink{}
+	collector := NewMetricsCollector(next, sink, map[string]string{"tool": "update-aws-ecs-service", "cluster": "my-cluster", "service": ""})
+	for _, event := range []Event{
+		ServiceUpdated{Service: "my-service"},
+		ValidationAttempt{Err: errNotReady},
+		RollbackStarted{Cause: errNotReady},
+		ValidationAttempt{},
+		RollbackSucceeded{},
+		InstanceDetached{InstanceId: "i-1"},
+		InstanceDrained{InstanceId: "i-1"},
+		InstanceDrained{InstanceId: "i-2"},
+	} {
+		collector.Emit(event)
+	}
+	if len(next.events) != 8 {
+		t.Errorf("expected the events passed on, got %v", next.types())
+	}
+	if err := collector.Flush(OutcomeSuccessfulRollback); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, metric := range sink.metrics {
+		values[metric.Name] = metric.Value
+		if want := map[string]string{"tool": "update-aws-ecs-service", "cluster": "my-cluster", "outcome": OutcomeSuccessfulRollback}; !reflect.DeepEqual(metric.Labels, want) {
+			t.Errorf("expected labels %v, got %v", want, metric.Labels)
+		}
+	}
+	for name, want := range map[string]float64{"deployments": 1, "validation_attempts": 2, "rollbacks": 1, "instances_drained": 2} {
+		if values[name] != want {
+			t.Errorf("expected %s %v, got %v", name, want, values[name])
+		}
+	}
+	if values["deployment_duration_seconds"] <= 0 || values["instance_drain_duration_seconds"] <= 0 {
+		t.Errorf("expected durations, got %v", values)
+	}
+}
+
+func TestParseMetricsSink(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    MetricsSink
+		wantErr error
+	}{
+		{spec: "prometheus=/var/lib/node_exporter/awsecs.prom", want: &PrometheusTextfileSink{Path: "/var/lib/node_exporter/awsecs.prom"}},
+		{spec: "statsd=127.0.0.1:8125", want: &StatsDSink{Addr: "127.0.0.1:8125", Prefix: "awsecs."}},
+		{spec: "emf", want: &EMFSink{Writer: os.Stdout, Namespace: "go-awsecs"}},
+		{spec: "emf=my-namespace", want: &EMFSink{Writer: os.Stdout, Namespace: "my-namespace"}},
+		{spec: "prometheus", wantErr: ErrInvalidMetricsSink},
+		{spec: "graphite=127.0.0.1:2003", wantErr: ErrInvalidMetricsSink},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseMetricsSink(tt.spec, os.Stdout)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPrometheusTextfileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "awsecs.prom")
+	if err := (&PrometheusTextfileSink{Path: path}).WriteMetrics(testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP awsecs_deployment_duration_seconds Duration
+# TYPE awsecs_deployment_duration_seconds gauge
+awsecs_deployment_duration_seconds{outcome="successful-rollback",service="my-service"} 1.5
+# HELP awsecs_rollbacks Rollbacks
+# TYPE awsecs_rollbacks gauge
+awsecs_rollbacks{outcome="successful-rollback",service="my-service"} 1
+`
+	if string(data) != want {
+		t.Errorf("expected %q, got %q", want, data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file renamed, got %v", err)
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := (&StatsDSink{Addr: conn.LocalAddr().String(), Prefix: "awsecs."}).WriteMetrics(testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"awsecs.deployment_duration_seconds:1.5|g|#outcome:successful-rollback,service:my-service",
+		"awsecs.rollbacks:1|c|#outcome:successful-rollback,service:my-service",
+	}
+	if got := strings.Split(string(packet[:n]), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestEMFSink(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&EMFSink{Writer: &buf, Namespace: "go-awsecs"}).WriteMetrics(testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	metadata := record["_aws"].(map[string]interface{})
+	if metadata["Timestamp"].(float64) <= 0 {
+		t.Errorf("expected a timestamp, got %v", metadata)
+	}
+	delete(record, "_aws")
+	want := map[string]interface{}{"outcome": "successful-rollback", "service": "my-service", "deployment_duration_seconds": 1.5, "rollbacks": float64(1)}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("expected %v, got %v", want, record)
+	}
+	directives, err := json.Marshal(metadata["CloudWatchMetrics"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDirectives := `[{"Dimensions":[["outcome","service"]],"Metrics":[{"Name":"deployment_duration_seconds","Unit":"Seconds"},{"Name":"rollbacks","Unit":"Count"}],"Namespace":"go-awsecs"}]`
+	if string(directives) != wantDirectives {
+		t.Errorf("expected %s, got %s", wantDirectives, directives)
+	}
+}
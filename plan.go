@@ -0,0 +1,222 @@
+package awsecs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"reflect"
+	"strings"
+)
+
+const planDiffContext = 3
+
+type planDiffLine struct {
+	op   diffmatchpatch.Operation
+	text string
+}
+
+func planDiffLines(from, to string) []planDiffLine {
+	dmp := diffmatchpatch.New()
+	fromChars, toChars, lineArray := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(fromChars, toChars, false), lineArray)
+	var lines []planDiffLine
+	for _, diff := range diffs {
+		for _, text := range strings.SplitAfter(diff.Text, "\n") {
+			if text != "" {
+				lines = append(lines, planDiffLine{op: diff.Type, text: strings.TrimSuffix(text, "\n")})
+			}
+		}
+	}
+	return lines
+}
+
+func unifiedDiff(fromName, toName, from, to string) string {
+	lines := planDiffLines(from, to)
+	fromLineNo := make([]int, len(lines))
+	toLineNo := make([]int, len(lines))
+	fromLine, toLine := 1, 1
+	for i, line := range lines {
+		fromLineNo[i], toLineNo[i] = fromLine, toLine
+		if line.op != diffmatchpatch.DiffInsert {
+			fromLine++
+		}
+		if line.op != diffmatchpatch.DiffDelete {
+			toLine++
+		}
+	}
+
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", fromName, toName)
+	next := 0
+	for next < len(lines) {
+		first := next
+		for first < len(lines) && lines[first].op == diffmatchpatch.DiffEqual {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		end := first
+		for end < len(lines) {
+			if lines[end].op != diffmatchpatch.DiffEqual {
+				end++
+				continue
+			}
+			gap := end
+			for gap < len(lines) && lines[gap].op == diffmatchpatch.DiffEqual {
+				gap++
+			}
+			if gap == len(lines) || gap-end > 2*planDiffContext {
+				break
+			}
+			end = gap
+		}
+		hunkStart := first - planDiffContext
+		if hunkStart < next {
+			hunkStart = next
+		}
+		hunkEnd := end + planDiffContext
+		if hunkEnd > len(lines) {
+			hunkEnd = len(lines)
+		}
+		fromCount, toCount := 0, 0
+		for _, line := range lines[hunkStart:hunkEnd] {
+			if line.op != diffmatchpatch.DiffInsert {
+				fromCount++
+			}
+			if line.op != diffmatchpatch.DiffDelete {
+				toCount++
+			}
+		}
+		fromStart, toStart := fromLineNo[hunkStart], toLineNo[hunkStart]
+		if fromCount == 0 {
+			fromStart--
+		}
+		if toCount == 0 {
+			toStart--
+		}
+		fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", fromStart, fromCount, toStart, toCount)
+		for _, line := range lines[hunkStart:hunkEnd] {
+			prefix := " "
+			switch line.op {
+			case diffmatchpatch.DiffDelete:
+				prefix = "-"
+			case diffmatchpatch.DiffInsert:
+				prefix = "+"
+			}
+			fmt.Fprintf(buf, "%s%s\n", prefix, line.text)
+		}
+		next = hunkEnd
+	}
+	return buf.String()
+}
+
+func panicMarshalIndent(v interface{}) string {
+	out, err := json.MarshalIndent(apiValue(reflect.ValueOf(v)), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(out) + "\n"
+}
+
+// apiValue returns v as the AWS API represents it, structs as objects keyed by the locationName of their fields, nil
+// fields left out
+func apiValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return apiValue(v.Elem())
+	case reflect.Struct:
+		object := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := field.Tag.Get("locationName")
+			if field.PkgPath != "" || name == "" {
+				continue
+			}
+			if value := apiValue(v.Field(i)); value != nil {
+				object[name] = value
+			}
+		}
+		return object
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		list := []interface{}{}
+		for i := 0; i < v.Len(); i++ {
+			list = append(list, apiValue(v.Index(i)))
+		}
+		return list
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		object := map[string]interface{}{}
+		for _, key := range v.MapKeys() {
+			object[key.String()] = apiValue(v.MapIndex(key))
+		}
+		return object
+	}
+	return v.Interface()
+}
+
+func renderPlan(svc ecs.Service, sourceTaskDefinitionArn string, original, altered ecs.RegisterTaskDefinitionInput, desiredCount *int64) string {
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "service: %s\n", aws.StringValue(svc.ServiceArn))
+
+	tdChanged := !reflect.DeepEqual(original, altered)
+	newTaskDefinition := sourceTaskDefinitionArn
+	if tdChanged {
+		newTaskDefinition = fmt.Sprintf("%s (new revision)", aws.StringValue(altered.Family))
+	}
+	if aws.StringValue(svc.TaskDefinition) != newTaskDefinition {
+		fmt.Fprintf(buf, "task definition: %s -> %s\n", aws.StringValue(svc.TaskDefinition), newTaskDefinition)
+	} else {
+		fmt.Fprintf(buf, "task definition: %s (unchanged)\n", newTaskDefinition)
+	}
+
+	if desiredCount != nil && *desiredCount != aws.Int64Value(svc.DesiredCount) {
+		fmt.Fprintf(buf, "desired count: %d -> %d\n", aws.Int64Value(svc.DesiredCount), *desiredCount)
+	} else {
+		fmt.Fprintf(buf, "desired count: %d (unchanged)\n", aws.Int64Value(svc.DesiredCount))
+	}
+
+	if tdChanged {
+		buf.WriteString(unifiedDiff(sourceTaskDefinitionArn, newTaskDefinition, panicMarshalIndent(original), panicMarshalIndent(altered)))
+	}
+	return buf.String()
+}
+
+func planService(ctx context.Context, e *ECSServiceUpdate) (string, error) {
+	output, err := e.EcsApi.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(e.Cluster), Services: []*string{aws.String(e.Service)}})
+	if err != nil {
+		return "", fmt.Errorf("on plan service while describe service: %w", err)
+	}
+	if len(output.Services) == 0 {
+		return "", ErrServiceNotFound
+	}
+	svc := output.Services[0]
+	parsedClusterArn, err := arn.Parse(aws.StringValue(svc.ClusterArn))
+	if err != nil {
+		return "", err
+	}
+	if !matchService(parsedClusterArn, svc, e.Cluster, e.Service) {
+		return "", ErrServiceNotFound
+	}
+	srcTaskDef := aws.StringValue(svc.TaskDefinition)
+	if e.Taskdef != "" {
+		srcTaskDef = e.Taskdef
+	}
+	taskDefinitionArn, asRegisterTaskDefinitionInput, tdCopy, err := newTaskDefinitionInput(ctx, e, srcTaskDef)
+	if err != nil {
+		return "", err
+	}
+	return renderPlan(*svc, taskDefinitionArn, asRegisterTaskDefinitionInput, tdCopy, e.DesiredCount), nil
+}
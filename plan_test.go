@@ -0,0 +1,173 @@
+package awsecs
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"strings"
+	"testing"
+)
+
+type mockPlanEcsClient struct {
+	ecsiface.ECSAPI
+	registered bool
+	updated    bool
+}
+
+func (m *mockPlanEcsClient) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	return &ecs.DescribeServicesOutput{
+		Services: []*ecs.Service{
+			{
+				ClusterArn:     aws.String("arn:aws:ecs:us-west-2:123456789012:cluster/my-cluster"),
+				ServiceArn:     aws.String("arn:aws:ecs:us-west-2:123456789012:service/my-cluster/my-service"),
+				ServiceName:    aws.String("my-service"),
+				TaskDefinition: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1"),
+				DesiredCount:   aws.Int64(2),
+			},
+		},
+	}, nil
+}
+
+func (m *mockPlanEcsClient) DescribeTaskDefinitionWithContext(ctx aws.Context, input *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{
+			TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1"),
+			Family:            aws.String("my-family"),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{
+					Name:  aws.String("my-container"),
+					Image: aws.String("myrepo/myimg:oldtag"),
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *mockPlanEcsClient) RegisterTaskDefinitionWithContext(ctx aws.Context, input *ecs.RegisterTaskDefinitionInput, opts ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error) {
+	m.registered = true
+	return nil, nil
+}
+
+func (m *mockPlanEcsClient) UpdateServiceWithContext(ctx aws.Context, input *ecs.UpdateServiceInput, opts ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	m.updated = true
+	return nil, nil
+}
+
+func TestPlan(t *testing.T) {
+	api := &mockPlanEcsClient{}
+	esu := ECSServiceUpdate{
+		EcsApi:       api,
+		Cluster:      "my-cluster",
+		Service:      "my-service",
+		Image:        map[string]string{"my-container": "myrepo/myimg:newtag"},
+		DesiredCount: aws.Int64(3),
+	}
+	plan, err := esu.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.registered || api.updated {
+		t.Fatal("plan must not register task definitions nor update services")
+	}
+	for _, want := range []string{
+		"task definition: arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1 -> my-family (new revision)\n",
+		"desired count: 2 -> 3\n",
+		"--- arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1\n",
+		"+++ my-family (new revision)\n",
+		`-      "image": "myrepo/myimg:oldtag",`,
+		`+      "image": "myrepo/myimg:newtag",`,
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan does not contain %q\n%s", want, plan)
+		}
+	}
+}
+
+func TestPlanNoChanges(t *testing.T) {
+	esu := ECSServiceUpdate{
+		EcsApi:  &mockPlanEcsClient{},
+		Cluster: "my-cluster",
+		Service: "my-service",
+	}
+	plan, err := esu.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "service: arn:aws:ecs:us-west-2:123456789012:service/my-cluster/my-service\n" +
+		"task definition: arn:aws:ecs:us-west-2:123456789012:task-definition/my-family:1 (unchanged)\n" +
+		"desired count: 2 (unchanged)\n"
+	if plan != want {
+		t.Errorf("Plan() = %q, want %q", plan, want)
+	}
+}
+
+func TestPlanServiceNotFound(t *testing.T) {
+	esu := ECSServiceUpdate{
+		EcsApi:  &mockPlanEcsClient{},
+		Cluster: "my-cluster",
+		Service: "my-other-service",
+	}
+	if _, err := esu.Plan(); err != ErrServiceNotFound {
+		t.Errorf("Plan() error = %v, want %v", err, ErrServiceNotFound)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	to := "a\nb\nc\nd\ne\nF\ng\nh\ni\nj\n"
+	want := "--- from\n+++ to\n" +
+		"@@ -3,7 +3,7 @@\n" +
+		" c\n d\n e\n-f\n+F\n g\n h\n i\n"
+	if got := unifiedDiff("from", "to", from, to); got != want {
+		t.Errorf("unifiedDiff() = %q, want %q", got, want)
+	}
+}
+
+func TestUnifiedDiffSeparateHunks(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	to := "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"
+	want := "--- from\n+++ to\n" +
+		"@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n" +
+		"@@ -9,4 +10,3 @@\n 9\n 10\n 11\n-12\n"
+	if got := unifiedDiff("from", "to", from, to); got != want {
+		t.Errorf("unifiedDiff() = %q, want %q", got, want)
+	}
+}
+
+func TestPanicMarshalIndent(t *testing.T) {
+	input := ecs.RegisterTaskDefinitionInput{
+		Family: aws.String("my-family"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("my-container"), DockerLabels: map[string]*string{"Team": aws.String("my-team")}},
+		},
+	}
+	want := `{
+  "containerDefinitions": [
+    {
+      "dockerLabels": {
+        "Team": "my-team"
+      },
+      "name": "my-container"
+    }
+  ],
+  "family": "my-family"
+}
+`
+	if got := panicMarshalIndent(input); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestPlanContainerNotFound(t *testing.T) {
+	esu := ECSServiceUpdate{
+		EcsApi:  &mockPlanEcsClient{},
+		Cluster: "my-cluster",
+		Service: "my-service",
+		Image:   map[string]string{"my-container": "myrepo/myimg:newtag", "my-contianer": "myrepo/myimg:newtag"},
+	}
+	if _, err := esu.Plan(); !errors.Is(err, ErrContainerNotFound) || !strings.HasSuffix(err.Error(), ": my-contianer") {
+		t.Errorf("Plan() error = %v, want %v: my-contianer", err, ErrContainerNotFound)
+	}
+}